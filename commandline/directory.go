@@ -24,7 +24,7 @@ var (
 	dirPort       = DirCmd.Flag.Int("port", 9666, "http listen port")
 	dirIP         = DirCmd.Flag.String("ip", "127.0.0.1", "ip address")
 	dirConfPath   = DirCmd.Flag.String("confpath", "/etc/rabbitfs", "configuration path")
-	maxVolumeSize = DirCmd.Flag.Int64("max_volume_size", 500, "max size of the volume file in MB")
+	maxVolumeSize = DirCmd.Flag.Int64("max_volume_size", 500, "max size of the volume file in MB, up to 32768")
 	pulse         = DirCmd.Flag.Int64("pulse", 2000, "the interval(in millisecond) of directory server polling store server")
 	timeout       = DirCmd.Flag.Int64("timeout", 10000, "maximum duration(in millisecond) before server timing out")
 	raftPulse     = DirCmd.Flag.Int64("raft_pulse", 0, "the interval(in millisecond) of raft server polling store server")
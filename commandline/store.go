@@ -25,7 +25,7 @@ var (
 	storeIP          = StoreCmd.Flag.String("ip", "127.0.0.1", "ip address")
 	storeConfPath    = StoreCmd.Flag.String("confpath", "/etc/rabbitfs", "configuration path")
 	volumeDir        = StoreCmd.Flag.String("volumedir", "/etc/rabbitfs", "the path to store volume file")
-	garbageThreshold = StoreCmd.Flag.Float64("garbage_threshold", 0.4, "volume will start cleaning deleted files when reaching the threshold")
+	garbageThreshold = StoreCmd.Flag.Float64("garbage_threshold", 0.4, "volume will be compacted when its deleted files reach the threshold")
 	storeTimeout     = StoreCmd.Flag.Int64("timeout", 10000, "maximum duration(in millisecond) before server timing out")
 )
 
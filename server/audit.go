@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// auditEntry is an attempt to delete or change the data of a volume under
+// retention or legal hold, written as a line of JSON to the audit log.
+// The attempts refused carry the error.
+type auditEntry struct {
+	Time       int64  `json:"time"` // unix time in seconds
+	Action     string `json:"action"`
+	Volume     uint32 `json:"volume,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	FileID     string `json:"fileid,omitempty"`
+	Remote     string `json:"remote,omitempty"` // the address of the client
+	Error      string `json:"error,omitempty"`
+}
+
+// auditLog appends the entries to a file, synced one by one
+// so that an attempt is never lost
+type auditLog struct {
+	path string
+	lock sync.Mutex
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path}
+}
+
+func (a *auditLog) record(e auditEntry) {
+	e.Time = time.Now().Unix()
+	if e.Error != "" {
+		log4go.Warn("refused to %s on volume %d %s from %s: %s", e.Action, e.Volume, e.FileID, e.Remote, e.Error)
+	} else {
+		log4go.Info("%s on held volume %d %s from %s", e.Action, e.Volume, e.FileID, e.Remote)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log4go.Error("audit error: %s", err.Error())
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log4go.Error("audit error: %s", err.Error())
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(line, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		log4go.Error("audit error: %s", err.Error())
+	}
+}
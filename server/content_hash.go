@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+// hashFileKey derives the needle id and cookie of a content
+// addressed file from the SHA-256 of its content
+func hashFileKey(sum []byte) (uint64, uint32) {
+	return helper.BytesToUInt64(sum[0:8]), helper.BytesToUInt32(sum[8:12])
+}
+
+// assignContentVolume picks the volume of a content addressed file, it returns
+// the status code to reply with on error. The content stays in the volume it
+// was first assigned to, so that the same bytes always get the same file id,
+// unless that volume is deleted or of another group, or stopped taking writes
+// before the content reached it.
+func (dir *Directory) assignContentVolume(sum []byte, collection string, replication string, ttl string) (*VolumeIDIP, int, error) {
+	group, err := dir.volumeGroupOf(collection, replication, ttl)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	hash := hex.EncodeToString(sum)
+	mapped := uint32(0)
+	if volIDIP, ok := dir.contentVolume(hash, group); ok {
+		// the volume was assigned before the upload, a sealed one
+		// may never have got the content
+		if volIDIP.Writable() || holdsContent(volIDIP, sum) {
+			return &volIDIP, http.StatusOK, nil
+		}
+		mapped = volIDIP.ID
+	}
+	volIDIP, status, err := dir.assignVolume(collection, replication, ttl)
+	if err != nil {
+		return nil, status, err
+	}
+	// another assign of the same content may have won the race
+	v, err := dir.raftServer.Do(&PutContentCommand{Sum: hash, ID: volIDIP.ID, Old: mapped})
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if id := v.(uint32); id != volIDIP.ID {
+		winner, ok := dir.getVolIDIP(id)
+		if !ok {
+			return nil, http.StatusInternalServerError, fmt.Errorf("no volume %d", id)
+		}
+		volIDIP = &winner
+	}
+	return volIDIP, http.StatusOK, nil
+}
+
+// contentVolume returns the volume the content of hash was assigned to,
+// if it's still in use by group
+func (dir *Directory) contentVolume(hash string, group volumeGroup) (VolumeIDIP, bool) {
+	dir.contentLock.RLock()
+	id, ok := dir.contents[hash]
+	dir.contentLock.RUnlock()
+	if !ok {
+		return VolumeIDIP{}, false
+	}
+	volIDIP, ok := dir.getVolIDIP(id)
+	if !ok || volIDIP.State == VolumeDeleted || volIDIP.Collection != group.collection ||
+		len(volIDIP.IP) != group.replicateCount || volIDIP.TTL != group.ttl {
+		return VolumeIDIP{}, false
+	}
+	return volIDIP, true
+}
+
+// holdsContent reports whether a replica of the volume stores the content
+// addressed file of sum
+func holdsContent(volIDIP VolumeIDIP, sum []byte) bool {
+	needleID, cookie := hashFileKey(sum)
+	for _, ip := range volIDIP.IP {
+		body, err := getAndError(fmt.Sprintf("http://%s/%d,%d,%d", ip, volIDIP.ID, needleID, cookie))
+		if err == nil {
+			body.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// isHashFileKey reports whether the needle id and cookie are derived from sum
+func isHashFileKey(needleID uint64, cookie uint32, sum []byte) bool {
+	id, c := hashFileKey(sum)
+	return id == needleID && c == cookie
+}
+
+// verifyContent returns the content of the needle of <needleID,cookie>
+// and its SHA-256 in hex, after checking that a content addressed
+// needle still holds the content its file id was derived from
+func verifyContent(n *storage.Needle, needleID uint64, cookie uint32) ([]byte, string, error) {
+	data, err := n.Content()
+	if err != nil {
+		return nil, "", err
+	}
+	if !n.IsContentAddressed() {
+		return data, "", nil
+	}
+	sum := sha256.Sum256(data)
+	if !isHashFileKey(needleID, cookie, sum[:]) {
+		return nil, "", fmt.Errorf("content of %d,%d doesn't match its hash", needleID, cookie)
+	}
+	return data, hex.EncodeToString(sum[:]), nil
+}
+
+// sameContent reports whether the needle holds data
+func sameContent(n *storage.Needle, data []byte) bool {
+	content, err := n.Content()
+	return err == nil && bytes.Equal(content, data)
+}
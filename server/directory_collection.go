@@ -0,0 +1,256 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+// Collection is a named group of volumes with its own defaults,
+// volumes of a collection never hold files of other collections
+type Collection struct {
+	Name          string `json:"name"`
+	RetainUntil   int64  `json:"retain_until,omitempty"`    // unix time in seconds, new volumes are held until
+	LegalHold     bool   `json:"legal_hold,omitempty"`      // new volumes are under legal hold
+	Replication   int    `json:"replication,omitempty"`     // replicate count when the client gives none
+	TTL           string `json:"ttl,omitempty"`             // like 30m, 12h, 7d or 4w
+	MaxVolumeSize int64  `json:"max_volume_size,omitempty"` // in bytes
+	QuotaSize     int64  `json:"quota_size,omitempty"`      // in bytes, 0 means no quota
+	QuotaFiles    int64  `json:"quota_files,omitempty"`     // 0 means no quota
+}
+
+// collectionUsage is the size and the number of the files stored in a
+// collection, counted once no matter how many replicas a volume has
+type collectionUsage struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Files      int64  `json:"files"`
+	QuotaSize  int64  `json:"quota_size,omitempty"`
+	QuotaFiles int64  `json:"quota_files,omitempty"`
+}
+
+type collectionUsageResult struct {
+	Usages []collectionUsage `json:"usages,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+type collectionStat struct {
+	Collection
+	Volumes         int   `json:"volumes"`
+	WritableVolumes int   `json:"writable_volumes"`
+	Size            int64 `json:"size"`
+}
+
+type dirStatResult struct {
+	Collections []collectionStat `json:"collections,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// parseTTL parses a time to live made of a number and a unit,
+// the unit is one of m(inute), h(our), d(ay) and w(eek)
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(ttl[:len(ttl)-1], 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid ttl %s", ttl)
+	}
+	unit := time.Duration(0)
+	switch ttl[len(ttl)-1] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("invalid ttl unit in %s", ttl)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func (dir *Directory) getCollection(name string) (Collection, bool) {
+	dir.colLock.RLock()
+	defer dir.colLock.RUnlock()
+	col, ok := dir.collections[name]
+	return col, ok
+}
+
+// createCollectionHandler creates a collection, or changes the defaults
+// of an existing one. Only the defaults given are changed, given empty
+// they are cleared. The new defaults only apply to new volumes.
+func (dir *Directory) createCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		helper.WriteJson(w, dirStatResult{Error: "no collection name"}, http.StatusInternalServerError)
+		return
+	}
+	// the hold is only changed through /vol/hold
+	col, ok := dir.getCollection(name)
+	if !ok {
+		col = Collection{Name: name}
+	}
+	given := func(field string) (string, bool) {
+		values, ok := r.Form[field]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	}
+	// sizes are in MB, like the volume_max_size configuration
+	parseMB := func(str string) (int64, error) {
+		if str == "" {
+			return 0, nil
+		}
+		mb, err := strconv.ParseUint(str, 10, 32)
+		return int64(mb) * 1024 * 1024, err
+	}
+	var err error
+	if str, ok := given("replication"); ok {
+		col.Replication = 0
+		if str != "" {
+			col.Replication, err = parseReplicateCount(str)
+		}
+	}
+	if str, ok := given("ttl"); err == nil && ok {
+		col.TTL = str
+		_, err = parseTTL(col.TTL)
+	}
+	if str, ok := given("max_volume_size"); err == nil && ok {
+		col.MaxVolumeSize, err = parseMB(str)
+		if col.MaxVolumeSize > storage.MaxVolumeSize {
+			err = fmt.Errorf("max volume size can't be over %d MB", storage.MaxVolumeSize/1024/1024)
+		}
+	}
+	if str, ok := given("quota_size"); err == nil && ok {
+		col.QuotaSize, err = parseMB(str)
+	}
+	if str, ok := given("quota_files"); err == nil && ok {
+		col.QuotaFiles = 0
+		if str != "" {
+			col.QuotaFiles, err = strconv.ParseInt(str, 10, 64)
+		}
+	}
+	if err != nil {
+		helper.WriteJson(w, dirStatResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	v, err := dir.raftServer.Do(&SetCollectionCommand{Collection: col})
+	if err != nil {
+		helper.WriteJson(w, dirStatResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	col = v.(Collection)
+	log4go.Info("set collection %s: %+v", col.Name, col)
+	helper.WriteJson(w, dirStatResult{Collections: []collectionStat{dir.collectionStat(col)}}, http.StatusOK)
+}
+
+// statHandler shows the collections along with their volumes
+func (dir *Directory) statHandler(w http.ResponseWriter, r *http.Request) {
+	dir.colLock.RLock()
+	// volumes out of any collection are shown as the collection with no name
+	cols := []Collection{{}}
+	for _, col := range dir.collections {
+		cols = append(cols, col)
+	}
+	dir.colLock.RUnlock()
+	sort.Sort(byName(cols))
+	res := dirStatResult{}
+	for _, col := range cols {
+		res.Collections = append(res.Collections, dir.collectionStat(col))
+	}
+	helper.WriteJson(w, res, http.StatusOK)
+}
+
+func (dir *Directory) collectionStat(col Collection) collectionStat {
+	stat := collectionStat{Collection: col}
+	dir.statLock.RLock()
+	defer dir.statLock.RUnlock()
+	for _, volIDIP := range dir.volumes() {
+		if volIDIP.Collection != col.Name || volIDIP.State == VolumeDeleted {
+			continue
+		}
+		stat.Volumes++
+		if volIDIP.Writable() {
+			stat.WritableVolumes++
+		}
+		stat.Size += dir.volInfoMap[volIDIP.ID].Size
+	}
+	return stat
+}
+
+// usageHandler shows the usage of the collection given by name,
+// or of every collection if no name is given
+func (dir *Directory) usageHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	cols := []Collection{}
+	if name != "" {
+		col, ok := dir.getCollection(name)
+		if !ok {
+			helper.WriteJson(w, collectionUsageResult{Error: "no collection " + name}, http.StatusInternalServerError)
+			return
+		}
+		cols = append(cols, col)
+	} else {
+		dir.colLock.RLock()
+		for _, col := range dir.collections {
+			cols = append(cols, col)
+		}
+		dir.colLock.RUnlock()
+		sort.Sort(byName(cols))
+	}
+	res := collectionUsageResult{}
+	for _, col := range cols {
+		res.Usages = append(res.Usages, dir.collectionUsage(col))
+	}
+	helper.WriteJson(w, res, http.StatusOK)
+}
+
+// collectionUsage sums the live bytes and files of the collection's volumes,
+// as last reported by the stores
+func (dir *Directory) collectionUsage(col Collection) collectionUsage {
+	usage := collectionUsage{Name: col.Name, QuotaSize: col.QuotaSize, QuotaFiles: col.QuotaFiles}
+	dir.statLock.RLock()
+	defer dir.statLock.RUnlock()
+	for _, volIDIP := range dir.volumes() {
+		if volIDIP.Collection != col.Name || volIDIP.State == VolumeDeleted {
+			continue
+		}
+		volInfo := dir.volInfoMap[volIDIP.ID]
+		usage.Size += volInfo.Size - volInfo.DeletedSize
+		usage.Files += volInfo.FileCount
+	}
+	return usage
+}
+
+// checkQuota returns an error if the collection has used up its quota
+func (dir *Directory) checkQuota(name string) error {
+	col, ok := dir.getCollection(name)
+	if !ok || (col.QuotaSize == 0 && col.QuotaFiles == 0) {
+		return nil
+	}
+	usage := dir.collectionUsage(col)
+	if col.QuotaSize > 0 && usage.Size >= col.QuotaSize {
+		return fmt.Errorf("quota exceeded: collection %s uses %d of %d bytes", name, usage.Size, col.QuotaSize)
+	}
+	if col.QuotaFiles > 0 && usage.Files >= col.QuotaFiles {
+		return fmt.Errorf("quota exceeded: collection %s has %d of %d files", name, usage.Files, col.QuotaFiles)
+	}
+	return nil
+}
+
+type byName []Collection
+
+func (c byName) Len() int           { return len(c) }
+func (c byName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byName) Less(i, j int) bool { return c[i].Name < c[j].Name }
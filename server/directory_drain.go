@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+)
+
+// Store states, a draining store gets no new volumes,
+// and its volumes are moved to other stores
+const (
+	StoreActive   = "active"
+	StoreDraining = "draining"
+)
+
+type drainStatus struct {
+	Store     string     `json:"store,omitempty"`
+	State     string     `json:"state,omitempty"`
+	Volumes   []uint32   `json:"volumes,omitempty"` // volumes still on the store
+	Transfers []transfer `json:"transfers,omitempty"`
+	Done      bool       `json:"done"` // the store holds nothing and can be removed
+	Error     string     `json:"error,omitempty"`
+}
+
+func (dir *Directory) drainStoreHandler(w http.ResponseWriter, r *http.Request) {
+	dir.setStoreStateHandler(w, r, StoreDraining)
+}
+
+func (dir *Directory) undrainStoreHandler(w http.ResponseWriter, r *http.Request) {
+	dir.setStoreStateHandler(w, r, StoreActive)
+}
+
+func (dir *Directory) setStoreStateHandler(w http.ResponseWriter, r *http.Request, state string) {
+	store := r.FormValue("store")
+	if !containsStr(dir.conf.Stores, store) {
+		helper.WriteJson(w, drainStatus{Error: "unknown store " + store}, http.StatusInternalServerError)
+		return
+	}
+	if _, err := dir.raftServer.Do(&SetStoreStateCommand{Store: store, State: state}); err != nil {
+		helper.WriteJson(w, drainStatus{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	log4go.Info("store %s is %s", store, state)
+	helper.WriteJson(w, dir.drainStatus(store), http.StatusOK)
+}
+
+func (dir *Directory) drainStatusHandler(w http.ResponseWriter, r *http.Request) {
+	helper.WriteJson(w, dir.drainStatus(r.FormValue("store")), http.StatusOK)
+}
+
+func (dir *Directory) drainStatus(store string) drainStatus {
+	status := drainStatus{Store: store, State: StoreActive}
+	dir.statLock.RLock()
+	if state, ok := dir.storeStates[store]; ok {
+		status.State = state
+	}
+	// the store may still hold stale replicas the directory doesn't know of
+	leftovers := len(dir.storeStatMap[store].VolsInfo)
+	dir.statLock.RUnlock()
+	for _, volIDIP := range dir.volumes() {
+		if volIDIP.State != VolumeDeleted && containsStr(volIDIP.IP, store) {
+			status.Volumes = append(status.Volumes, volIDIP.ID)
+		}
+	}
+	dir.transferLock.Lock()
+	for _, t := range dir.transfers {
+		if t.From == store {
+			status.Transfers = append(status.Transfers, *t)
+		}
+	}
+	dir.transferLock.Unlock()
+	status.Done = status.State == StoreDraining && len(status.Volumes) == 0 && leftovers == 0
+	return status
+}
+
+// drainStores moves the volumes off the draining stores,
+// one volume per store at a time
+func (dir *Directory) drainStores() {
+	draining := []string{}
+	dir.statLock.RLock()
+	for store, state := range dir.storeStates {
+		if state == StoreDraining {
+			draining = append(draining, store)
+		}
+	}
+	dir.statLock.RUnlock()
+	for _, store := range draining {
+		status := dir.drainStatus(store)
+		if len(status.Transfers) > 0 {
+			continue
+		}
+		for _, id := range status.Volumes {
+			if dir.transferring(id) {
+				continue
+			}
+			t, err := dir.startMove(id, store, "")
+			if err != nil {
+				log4go.Warn("drain volume %d from %s error: %s", id, store, err.Error())
+				continue
+			}
+			log4go.Info("draining volume %d from %s to %s", id, store, t.To)
+			break
+		}
+	}
+}
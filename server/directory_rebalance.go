@@ -0,0 +1,146 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+)
+
+type rebalanceMove struct {
+	ID   uint32 `json:"id"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type rebalanceResult struct {
+	DryRun bool            `json:"dry_run,omitempty"`
+	Moves  []rebalanceMove `json:"moves,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// rebalanceHandler moves volumes to even out the stores, with dryrun=true
+// it only returns the moves it would make
+func (dir *Directory) rebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.FormValue("dryrun") == "true"
+	moves := dir.rebalance(dryRun)
+	helper.WriteJson(w, rebalanceResult{DryRun: dryRun, Moves: moves}, http.StatusOK)
+}
+
+func (dir *Directory) rebalanceMaxMoves() int {
+	if dir.conf.RebalanceMaxMoves > 0 {
+		return dir.conf.RebalanceMaxMoves
+	}
+	return 1
+}
+
+// tickRebalance rebalances every RebalanceInterval seconds,
+// it's called by tickerMaintainVolumes
+func (dir *Directory) tickRebalance() {
+	interval := time.Duration(dir.conf.RebalanceInterval) * time.Second
+	if interval <= 0 || time.Since(dir.lastRebalance) < interval {
+		return
+	}
+	dir.lastRebalance = time.Now()
+	dir.rebalance(false)
+}
+
+// rebalance plans at most RebalanceMaxMoves moves, minus the moves
+// already running, and starts them unless dryRun is set
+func (dir *Directory) rebalance(dryRun bool) []rebalanceMove {
+	dir.transferLock.Lock()
+	running := len(dir.transfers)
+	dir.transferLock.Unlock()
+	maxMoves := dir.rebalanceMaxMoves() - running
+	if maxMoves <= 0 {
+		return nil
+	}
+	moves := dir.planRebalance(maxMoves)
+	if dryRun {
+		return moves
+	}
+	started := []rebalanceMove{}
+	for _, m := range moves {
+		if _, err := dir.startMove(m.ID, m.From, m.To); err != nil {
+			log4go.Warn("rebalance volume %d from %s to %s error: %s", m.ID, m.From, m.To, err.Error())
+			continue
+		}
+		log4go.Info("rebalancing volume %d from %s to %s", m.ID, m.From, m.To)
+		started = append(started, m)
+	}
+	return started
+}
+
+// planRebalance computes the target volume count of every alive, active
+// store in proportion to its disk capacity, and moves volumes from the
+// stores above their target to the stores below it
+func (dir *Directory) planRebalance(maxMoves int) []rebalanceMove {
+	dir.statLock.RLock()
+	defer dir.statLock.RUnlock()
+	stores := []string{}
+	capacity := map[string]float64{}
+	totalCapacity := 0.0
+	for _, store := range dir.conf.Stores {
+		stat := dir.storeStatMap[store]
+		if !stat.IsAlive || dir.storeStates[store] == StoreDraining {
+			continue
+		}
+		stores = append(stores, store)
+		capacity[store] = 1 // disk capacity unknown, every store gets the same share
+		if stat.TotalSpace > 0 {
+			capacity[store] = float64(stat.TotalSpace)
+		}
+		totalCapacity += capacity[store]
+	}
+	if len(stores) < 2 {
+		return nil
+	}
+	volsOnStore := map[string][]VolumeIDIP{}
+	totalReplicas := 0
+	for _, volIDIP := range dir.volumes() {
+		if volIDIP.State == VolumeDeleted || dir.transferring(volIDIP.ID) || !dir.allAlive(volIDIP.IP) {
+			continue
+		}
+		for _, store := range volIDIP.IP {
+			if _, ok := capacity[store]; ok {
+				volsOnStore[store] = append(volsOnStore[store], volIDIP)
+				totalReplicas++
+			}
+		}
+	}
+	target := map[string]float64{}
+	for _, store := range stores {
+		target[store] = float64(totalReplicas) * capacity[store] / totalCapacity
+	}
+	// surplus is how many volumes a store holds above its target
+	surplus := func(store string) float64 {
+		return float64(len(volsOnStore[store])) - target[store]
+	}
+	moves := []rebalanceMove{}
+	for len(moves) < maxMoves {
+		sort.Sort(byWeight{stores: stores, weight: surplus})
+		from, to := stores[0], stores[len(stores)-1]
+		// moving one volume only narrows the gap if it's more than one volume
+		if surplus(from)-surplus(to) <= 1 {
+			break
+		}
+		moved := false
+		for i, volIDIP := range volsOnStore[from] {
+			if containsStr(volIDIP.IP, to) {
+				continue
+			}
+			moves = append(moves, rebalanceMove{ID: volIDIP.ID, From: from, To: to})
+			volsOnStore[from] = append(volsOnStore[from][:i], volsOnStore[from][i+1:]...)
+			volsOnStore[to] = append(volsOnStore[to], volIDIP)
+			moved = true
+			break
+		}
+		if !moved {
+			break
+		}
+	}
+	return moves
+}
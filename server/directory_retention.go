@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+)
+
+type holdResult struct {
+	Volumes []VolumeIDIP `json:"volumes,omitempty"` // the volumes changed
+	Error   string       `json:"error,omitempty"`
+}
+
+// holdHandler sets the retention date and the legal hold of the volume
+// given by the volume parameter, or of every volume in the collection
+// given by the collection parameter. The parameters left out keep
+// their values, and the retention date can only be pushed back.
+func (dir *Directory) holdHandler(w http.ResponseWriter, r *http.Request) {
+	cmd := &SetHoldCommand{Collection: r.FormValue("collection")}
+	if cmd.Collection != "" {
+		col, ok := dir.getCollection(cmd.Collection)
+		if !ok {
+			helper.WriteJson(w, holdResult{Error: "no collection " + cmd.Collection}, http.StatusInternalServerError)
+			return
+		}
+		cmd.RetainUntil, cmd.LegalHold = col.RetainUntil, col.LegalHold
+	} else {
+		id, err := newVolumeID(r.FormValue("volume"))
+		if err != nil {
+			helper.WriteJson(w, holdResult{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		volIDIP, ok := dir.getVolIDIP(id)
+		if !ok || volIDIP.State == VolumeDeleted {
+			helper.WriteJson(w, holdResult{Error: fmt.Sprintf("no volume %d", id)}, http.StatusInternalServerError)
+			return
+		}
+		cmd.ID, cmd.RetainUntil, cmd.LegalHold = id, volIDIP.RetainUntil, volIDIP.LegalHold
+	}
+	var err error
+	if str := r.FormValue("retain_until"); str != "" {
+		var t time.Time
+		if t, err = parseRetainUntil(str); err == nil {
+			cmd.RetainUntil = t.Unix()
+		}
+	}
+	if str := r.FormValue("legal_hold"); err == nil && str != "" {
+		cmd.LegalHold, err = strconv.ParseBool(str)
+	}
+	if err != nil {
+		helper.WriteJson(w, holdResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	v, err := dir.raftServer.Do(cmd)
+	if err != nil {
+		helper.WriteJson(w, holdResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	volIDIPs := v.([]VolumeIDIP)
+	// the stores missed here get the hold from syncVolumeStates later
+	for _, volIDIP := range volIDIPs {
+		log4go.Info("volume %d retained until %d, legal hold %t", volIDIP.ID, volIDIP.RetainUntil, volIDIP.LegalHold)
+		for _, store := range volIDIP.IP {
+			if err = pushVolume(store, "update", volIDIP); err != nil {
+				log4go.Warn("update volume %d on %s error: %s", volIDIP.ID, store, err.Error())
+			}
+		}
+	}
+	helper.WriteJson(w, holdResult{Volumes: volIDIPs}, http.StatusOK)
+}
+
+// parseRetainUntil parses a retention date like 2030-01-02 in local time,
+// or a time in RFC 3339 like 2030-01-02T15:04:05Z
+func parseRetainUntil(str string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", str, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid retention date %s", str)
+	}
+	return t, nil
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,13 +11,16 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"code.google.com/p/log4go"
 
 	"github.com/gorilla/mux"
 	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
 )
 
 const (
@@ -35,6 +39,7 @@ var (
 type Directory struct {
 	router        *mux.Router
 	volumeMaxSize int64
+	volLock       sync.RWMutex // protects volIDIPs, raft commands change it
 	volIDIPs      []VolumeIDIP
 	volInfoMap    map[uint32]volumeInfo
 	confPath      string
@@ -44,18 +49,97 @@ type Directory struct {
 	raftServer    *RaftServer
 	pulse         time.Duration
 	storeStatMap  map[string]storeStat
+	storeLoadMap  map[string]storeLoad
+	statLock      sync.RWMutex // protects storeStatMap, storeLoadMap, volInfoMap and storeStates
+	growLock      sync.Mutex
+	volumeGroups  map[volumeGroup]bool // volume groups that clients have asked for
+	storeSeenMap  map[string]time.Time
+	startedAt     time.Time
+	transferLock  sync.Mutex
+	transfers     map[uint32]*transfer // volumes being moved between stores
+	storeStates   map[string]string    // the stores not in StoreActive state
+	lastRebalance time.Time
+	colLock       sync.RWMutex
+	collections   map[string]Collection
+	vacuumLock    sync.Mutex
+	vacuums       map[uint32]bool // volumes being vacuumed
+	audit         *auditLog       // the attempts to delete held volumes
+	contentLock   sync.RWMutex
+	contents      map[string]uint32 // the volume of each content addressed file, by its SHA-256 in hex
+}
+
+// volumeGroup is the volumes of a collection with the same replicate count
+// and TTL, the directory keeps enough writable volumes for every group in use
+type volumeGroup struct {
+	collection     string
+	replicateCount int
+	ttl            string
 }
 
 type storeStat struct {
-	IsAlive   bool         `json:"is_alive"`
-	VolsCount uint32       `json:"vols_count,omitempty"`
-	VolsInfo  []volumeInfo `json:"vols_info,omitempty"`
-	ErrStr    string       `json:"error,omitempty"`
+	IsAlive      bool         `json:"is_alive"`
+	VolsCount    uint32       `json:"vols_count,omitempty"`
+	VolsInfo     []volumeInfo `json:"vols_info,omitempty"`
+	FreeSpace    uint64       `json:"free_space,omitempty"`
+	TotalSpace   uint64       `json:"total_space,omitempty"`
+	WrittenBytes uint64       `json:"written_bytes,omitempty"`
+	ErrStr       string       `json:"error,omitempty"`
+}
+
+// storeLoad is the recent write rate of a store, computed from
+// the WrittenBytes counter of two consecutive polls
+type storeLoad struct {
+	writtenBytes uint64
+	polledAt     time.Time
+	bytesPerSec  float64
 }
 
 type configuration struct {
 	Directories []string `json:"directory,omitempty"`
 	Stores      []string `json:"store,omitempty"`
+	// MinWritableVolumes is the number of writable volumes the directory keeps
+	// for every replicate count in use, it defaults to 1
+	MinWritableVolumes int `json:"min_writable_volumes,omitempty"`
+	// ReReplicateDelay is how long(in seconds) a store must be unreachable
+	// before its volumes get copied to other stores, it defaults to 60
+	ReReplicateDelay int `json:"re_replicate_delay,omitempty"`
+	// RebalanceInterval is the interval(in seconds) of rebalancing volumes
+	// across stores, 0 means rebalancing only on request
+	RebalanceInterval int `json:"rebalance_interval,omitempty"`
+	// RebalanceMaxMoves is the maximum number of volumes being moved
+	// at the same time by rebalancing, it defaults to 1
+	RebalanceMaxMoves int `json:"rebalance_max_moves,omitempty"`
+	// CompactionWindow is the quiet hours when stores compact volumes,
+	// like "22:00-06:00" in local time, empty means any time
+	CompactionWindow string `json:"compaction_window,omitempty"`
+	// VacuumThreshold is the garbage ratio over which the directory compacts
+	// every replica of a volume together, 0 lets stores compact on their own
+	VacuumThreshold float32 `json:"vacuum_threshold,omitempty"`
+	// Fsync is when stores sync the volumes to disk: "none", "interval"
+	// or "always", it defaults to "none"
+	Fsync string `json:"fsync,omitempty"`
+	// FsyncInterval is the interval(in milliseconds) of syncing volumes
+	// with the "interval" policy, it defaults to 1000
+	FsyncInterval int `json:"fsync_interval,omitempty"`
+	// UploadSessionTimeout is how long(in seconds) an upload session may
+	// go without a part before it's dropped, it defaults to 86400
+	UploadSessionTimeout int `json:"upload_session_timeout,omitempty"`
+	// MaxChunkSize is the largest(in MB) part of an upload session, and the
+	// largest session stored as one file, it defaults to 64
+	MaxChunkSize int `json:"max_chunk_size,omitempty"`
+	// Dedup makes stores keep one needle for the files of identical
+	// name and content uploaded to a volume
+	Dedup bool `json:"dedup,omitempty"`
+	// Versions is the number of versions stores keep of each file, the
+	// latest included. Uploading to an existing file id adds a version,
+	// with 0, the default, it's refused.
+	Versions int `json:"versions,omitempty"`
+	// SoftDeleteWindow is how long(in seconds) stores keep the deleted
+	// files so they can be undeleted, 0, the default, deletes for good
+	SoftDeleteWindow int `json:"soft_delete_window,omitempty"`
+	// MasterKeyFile is the file holding the master key of a store in hex,
+	// the store encrypts the needles it writes if it's set
+	MasterKeyFile string `json:"master_key_file,omitempty"`
 }
 
 // NewDirectory returns a new Directory
@@ -77,7 +161,20 @@ func NewDirectory(
 		volumeMaxSize: volumeMaxSize * 1024 * 1024,
 		pulse:         pulse,
 		storeStatMap:  map[string]storeStat{},
+		storeLoadMap:  map[string]storeLoad{},
 		volInfoMap:    map[uint32]volumeInfo{},
+		volumeGroups:  map[volumeGroup]bool{},
+		storeSeenMap:  map[string]time.Time{},
+		startedAt:     time.Now(),
+		transfers:     map[uint32]*transfer{},
+		storeStates:   map[string]string{},
+		collections:   map[string]Collection{},
+		vacuums:       map[uint32]bool{},
+		audit:         newAuditLog(filepath.Join(confPath, "audit.log")),
+		contents:      map[string]uint32{},
+	}
+	if dir.volumeMaxSize > storage.MaxVolumeSize {
+		return nil, fmt.Errorf("volume max size can't be over %d MB", storage.MaxVolumeSize/1024/1024)
 	}
 	confFile, err := os.OpenFile(filepath.Join(confPath, "rabbitfs.conf.json"), os.O_RDWR|os.O_CREATE, 0644)
 	defer confFile.Close()
@@ -119,11 +216,48 @@ func NewDirectory(
 			return nil, err
 		}
 	}
+	storeConfBytes, err := ioutil.ReadFile(filepath.Join(confPath, "store.conf.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(storeConfBytes) > 0 {
+		if err = json.Unmarshal(storeConfBytes, &dir.storeStates); err != nil {
+			return nil, err
+		}
+	}
+	colConfBytes, err := ioutil.ReadFile(filepath.Join(confPath, "collection.conf.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(colConfBytes) > 0 {
+		if err = json.Unmarshal(colConfBytes, &dir.collections); err != nil {
+			return nil, err
+		}
+	}
+	if dir.contents, err = loadContents(confPath); err != nil {
+		return nil, err
+	}
 	dir.router.HandleFunc("/dir/assign", dir.proxyToLeader(dir.assignFileIDHandler))
+	dir.router.HandleFunc("/dir/submit", dir.proxyToLeader(dir.submitHandler)).Methods("POST")
 	dir.router.HandleFunc("/vol/create", dir.proxyToLeader(dir.createVolumeHandler))
 	dir.router.HandleFunc("/vol/info", dir.proxyToLeader(dir.updateVolumeInfoHandler))
+	dir.router.HandleFunc("/vol/lookup", dir.proxyToLeader(dir.lookupVolumeHandler))
+	dir.router.HandleFunc("/vol/seal", dir.proxyToLeader(dir.sealVolumeHandler))
+	dir.router.HandleFunc("/vol/delete", dir.proxyToLeader(dir.deleteVolumeHandler))
+	dir.router.HandleFunc("/vol/move", dir.proxyToLeader(dir.moveVolumeHandler))
+	dir.router.HandleFunc("/vol/transfers", dir.proxyToLeader(dir.transfersHandler))
+	dir.router.HandleFunc("/vol/rebalance", dir.proxyToLeader(dir.rebalanceHandler))
+	dir.router.HandleFunc("/vol/vacuum", dir.proxyToLeader(dir.vacuumHandler))
+	dir.router.HandleFunc("/vol/hold", dir.proxyToLeader(dir.holdHandler))
+	dir.router.HandleFunc("/col/create", dir.proxyToLeader(dir.createCollectionHandler))
+	dir.router.HandleFunc("/col/usage", dir.proxyToLeader(dir.usageHandler))
+	dir.router.HandleFunc("/dir/stat", dir.proxyToLeader(dir.statHandler))
+	dir.router.HandleFunc("/store/drain", dir.proxyToLeader(dir.drainStoreHandler))
+	dir.router.HandleFunc("/store/undrain", dir.proxyToLeader(dir.undrainStoreHandler))
+	dir.router.HandleFunc("/store/drain/status", dir.proxyToLeader(dir.drainStatusHandler))
 	// dir.router.HandleFunc("/store/hearbeat", dir.proxyToLeader(dir.heartbeatHandler))
 	go dir.tickerGetStoreStat()
+	go dir.tickerMaintainVolumes()
 	return
 }
 
@@ -158,65 +292,157 @@ func (dir *Directory) ListenAndServe() {
 	}
 }
 
-func (dir *Directory) pickVolume(replicateStr string) (*VolumeIDIP, error) {
-	replicateCount := 1
-	if replicateStr != "" {
-		var err error
-		replicateCount, err = strconv.Atoi(replicateStr)
-		if err != nil {
-			return nil, err
-		}
+// parseReplicateCount parses the replication parameter, it defaults to 1
+func parseReplicateCount(replicateStr string) (int, error) {
+	if replicateStr == "" {
+		return 1, nil
+	}
+	replicateCount, err := strconv.Atoi(replicateStr)
+	if err != nil {
+		return 0, err
 	}
 	if replicateCount < 1 {
-		return nil, fmt.Errorf("replicate count must be > 0")
+		return 0, fmt.Errorf("replicate count must be greater than 0")
 	}
-	candidateVolIDIP := []VolumeIDIP{}
-	for _, volIDIP := range dir.volIDIPs {
-		if len(volIDIP.IP) == replicateCount &&
-			dir.volInfoMap[volIDIP.ID].Size < dir.volumeMaxSize {
-			candidateVolIDIP = append(candidateVolIDIP, volIDIP)
+	return replicateCount, nil
+}
+
+// volumeGroupOf parses the replication and TTL parameters,
+// they default to the replication and TTL of the collection
+func (dir *Directory) volumeGroupOf(collection string, replicateStr string, ttl string) (volumeGroup, error) {
+	if collection != "" {
+		col, ok := dir.getCollection(collection)
+		if !ok {
+			return volumeGroup{}, fmt.Errorf("no collection %s", collection)
+		}
+		if replicateStr == "" && col.Replication > 0 {
+			replicateStr = strconv.Itoa(col.Replication)
+		}
+		if ttl == "" {
+			ttl = col.TTL
 		}
 	}
+	replicateCount, err := parseReplicateCount(replicateStr)
+	if err != nil {
+		return volumeGroup{}, err
+	}
+	if _, err = parseTTL(ttl); err != nil {
+		return volumeGroup{}, err
+	}
+	return volumeGroup{collection, replicateCount, ttl}, nil
+}
+
+// pickVolume picks a volume of the group. Volumes with more remaining
+// room are more likely to be picked, so the volumes fill evenly.
+func (dir *Directory) pickVolume(group volumeGroup) (*VolumeIDIP, error) {
+	candidateVolIDIP, rooms := dir.writableVolumes(group)
 	if len(candidateVolIDIP) == 0 {
-		return nil, fmt.Errorf("no volume fits the replicate count %d", replicateCount)
+		return nil, fmt.Errorf("no volume fits the replicate count %d", group.replicateCount)
+	}
+	totalRoom := int64(0)
+	for _, room := range rooms {
+		totalRoom += room
+	}
+	r := rand.Int63n(totalRoom)
+	for i, room := range rooms {
+		if r < room {
+			return &candidateVolIDIP[i], nil
+		}
+		r -= room
 	}
-	return &candidateVolIDIP[rand.Intn(len(candidateVolIDIP))], nil
+	return &candidateVolIDIP[len(candidateVolIDIP)-1], nil
 }
 
-func (dir *Directory) pickStoreServer(replicateStr string) ([]string, error) {
-	replicateCount := 1
-	if replicateStr != "" {
-		var err error
-		replicateCount, err = strconv.Atoi(replicateStr)
-		if err != nil {
-			return nil, err
+// writableVolumes returns the volumes of the group that still have room
+// and whose replicas are all alive, along with their remaining room
+func (dir *Directory) writableVolumes(group volumeGroup) ([]VolumeIDIP, []int64) {
+	dir.statLock.RLock()
+	defer dir.statLock.RUnlock()
+	volIDIPs := []VolumeIDIP{}
+	rooms := []int64{}
+	for _, volIDIP := range dir.volumes() {
+		if volIDIP.Collection != group.collection || len(volIDIP.IP) != group.replicateCount ||
+			volIDIP.TTL != group.ttl {
+			continue
+		}
+		room := dir.maxSizeOf(volIDIP) - dir.volInfoMap[volIDIP.ID].Size
+		if volIDIP.Writable() && room > 0 && !outlived(volIDIP) && dir.allAlive(volIDIP.IP) &&
+			!dir.vacuuming(volIDIP.ID) && !dir.transferring(volIDIP.ID) {
+			volIDIPs = append(volIDIPs, volIDIP)
+			rooms = append(rooms, room)
 		}
 	}
-	if replicateCount < 1 {
-		return nil, fmt.Errorf("replicate count must be greater than 0")
+	return volIDIPs, rooms
+}
+
+func (dir *Directory) maxSizeOf(volIDIP VolumeIDIP) int64 {
+	if volIDIP.MaxSize > 0 {
+		return volIDIP.MaxSize
+	}
+	return dir.volumeMaxSize
+}
+
+// pickStoreServer picks replicate count of alive stores to place a new volume,
+// preferring the stores with the highest storeWeight. The stores must have
+// room for a volume of maxSize bytes, the max volume size of its group or
+// collection. The excluded stores, e.g. the ones already holding the volume,
+// are never picked.
+func (dir *Directory) pickStoreServer(replicateStr string, maxSize int64, excluded ...string) ([]string, error) {
+	replicateCount, err := parseReplicateCount(replicateStr)
+	if err != nil {
+		return nil, err
 	}
 	if replicateCount > len(dir.conf.Stores) {
 		return nil, fmt.Errorf("does't have enough store machine for replication")
 	}
+	dir.statLock.RLock()
+	defer dir.statLock.RUnlock()
 	storesTmp := []string{}
-	candidateStore := []string{}
 	for _, store := range dir.conf.Stores {
-		if dir.storeStatMap[store].IsAlive == true {
-			storesTmp = append(storesTmp, store)
+		stat := dir.storeStatMap[store]
+		if !stat.IsAlive || containsStr(excluded, store) || dir.storeStates[store] == StoreDraining {
+			continue
 		}
+		// skip the store if we know it can't hold a full volume
+		if stat.TotalSpace > 0 && stat.FreeSpace < uint64(maxSize) {
+			continue
+		}
+		storesTmp = append(storesTmp, store)
 	}
 	if len(storesTmp) < replicateCount {
 		return nil, fmt.Errorf("only got %d stores, does't have enough store machine for %d replication", len(storesTmp), replicateCount)
 	}
-	// stores = append(candidateStore, dir.conf.Stores...)
-	for i := 0; i < replicateCount; i++ {
-		pickedIndex := rand.Intn(len(storesTmp))
-		candidateStore = append(candidateStore, storesTmp[pickedIndex])
-		storesTmp = append(storesTmp[:pickedIndex], storesTmp[pickedIndex+1:]...)
+	// shuffle first so that stores with the same weight are picked randomly
+	for i := range storesTmp {
+		j := rand.Intn(i + 1)
+		storesTmp[i], storesTmp[j] = storesTmp[j], storesTmp[i]
+	}
+	sort.Stable(byWeight{stores: storesTmp, weight: dir.storeWeight})
+	return storesTmp[:replicateCount], nil
+}
+
+// storeWeight scores how suitable a store is for a new volume.
+// Free disk space dominates the score, every volume already on the store
+// and every MB/s of recent writes make the store less attractive.
+func (dir *Directory) storeWeight(store string) float64 {
+	stat := dir.storeStatMap[store]
+	free := float64(stat.FreeSpace)
+	if stat.TotalSpace == 0 {
+		free = 1 // disk space unknown, weigh by volume count and load only
 	}
-	return candidateStore, nil
+	load := dir.storeLoadMap[store].bytesPerSec / (1024 * 1024)
+	return free / float64(1+stat.VolsCount) / (1 + load)
+}
+
+type byWeight struct {
+	stores []string
+	weight func(store string) float64
 }
 
+func (b byWeight) Len() int           { return len(b.stores) }
+func (b byWeight) Swap(i, j int)      { b.stores[i], b.stores[j] = b.stores[j], b.stores[i] }
+func (b byWeight) Less(i, j int) bool { return b.weight(b.stores[i]) > b.weight(b.stores[j]) }
+
 func (dir *Directory) tickerGetStoreStat() {
 	for _, storeAddr := range dir.conf.Stores {
 		go func(storeAddr string) {
@@ -225,25 +451,293 @@ func (dir *Directory) tickerGetStoreStat() {
 				resp, err := client.Get("http://" + storeAddr + "/store/stat")
 				if err != nil {
 					log4go.Error(err.Error())
-					// resp.Body.Close()
+					dir.statLock.Lock()
+					dir.storeStatMap[storeAddr] = storeStat{
+						IsAlive: false,
+					}
+					dir.statLock.Unlock()
 					continue
 				}
 				if resp.StatusCode != http.StatusOK {
 					log4go.Error("connect to " + storeAddr + " failed")
+					dir.statLock.Lock()
 					dir.storeStatMap[storeAddr] = storeStat{
 						IsAlive: false,
 					}
+					dir.statLock.Unlock()
 				} else {
 					bytes, _ := ioutil.ReadAll(resp.Body)
 					stat := storeStat{}
 					json.Unmarshal(bytes, &stat)
+					dir.statLock.Lock()
 					dir.storeStatMap[storeAddr] = stat
+					dir.storeSeenMap[storeAddr] = time.Now()
+					dir.updateStoreLoad(storeAddr, stat.WrittenBytes)
 					for _, volInfo := range stat.VolsInfo {
 						dir.volInfoMap[volInfo.ID] = volInfo
 					}
+					dir.statLock.Unlock()
 				}
 				resp.Body.Close()
 			}
 		}(storeAddr)
 	}
 }
+
+// updateStoreLoad must be called with statLock held
+func (dir *Directory) updateStoreLoad(storeAddr string, writtenBytes uint64) {
+	now := time.Now()
+	last, ok := dir.storeLoadMap[storeAddr]
+	load := storeLoad{writtenBytes: writtenBytes, polledAt: now}
+	// writtenBytes is reset when the store restarts
+	if ok && writtenBytes >= last.writtenBytes {
+		if elapsed := now.Sub(last.polledAt).Seconds(); elapsed > 0 {
+			load.bytesPerSec = float64(writtenBytes-last.writtenBytes) / elapsed
+		}
+	}
+	dir.storeLoadMap[storeAddr] = load
+}
+
+func (dir *Directory) minWritableVolumes() int {
+	if dir.conf.MinWritableVolumes > 0 {
+		return dir.conf.MinWritableVolumes
+	}
+	return 1
+}
+
+// growVolumes creates volumes in the group
+// until there are at least MinWritableVolumes writable ones
+func (dir *Directory) growVolumes(group volumeGroup) error {
+	dir.growLock.Lock()
+	defer dir.growLock.Unlock()
+	writable, _ := dir.writableVolumes(group)
+	for i := len(writable); i < dir.minWritableVolumes(); i++ {
+		volIDIP, err := dir.createVolume(group)
+		if err != nil {
+			return err
+		}
+		log4go.Info("grew volume %d on %v", volIDIP.ID, volIDIP.IP)
+	}
+	dir.volumeGroups[group] = true
+	return nil
+}
+
+// tickerMaintainVolumes seals the full volumes and keeps enough writable
+// volumes for every volume group in use, only the leader does the job
+func (dir *Directory) tickerMaintainVolumes() {
+	ticker := time.NewTicker(dir.pulse)
+	for range ticker.C {
+		if dir.raftServer.Leader() != dir.raftServer.Name() {
+			continue
+		}
+		dir.sealFullVolumes()
+		dir.dropExpiredVolumes()
+		dir.syncVolumeStates()
+		dir.repairVolumes()
+		dir.drainStores()
+		dir.tickRebalance()
+		dir.tickVacuum()
+		dir.growLock.Lock()
+		for _, volIDIP := range dir.volumes() {
+			if volIDIP.State != VolumeDeleted {
+				dir.volumeGroups[volumeGroup{volIDIP.Collection, len(volIDIP.IP), volIDIP.TTL}] = true
+			}
+		}
+		groups := []volumeGroup{}
+		for group := range dir.volumeGroups {
+			groups = append(groups, group)
+		}
+		dir.growLock.Unlock()
+		for _, group := range groups {
+			if err := dir.growVolumes(group); err != nil {
+				log4go.Warn("grow volumes of collection %q with replicate count %d and ttl %q error: %s",
+					group.collection, group.replicateCount, group.ttl, err.Error())
+			}
+		}
+	}
+}
+
+func (dir *Directory) sealFullVolumes() {
+	full := []uint32{}
+	dir.statLock.RLock()
+	for _, volIDIP := range dir.volumes() {
+		maxSize := dir.maxSizeOf(volIDIP)
+		// stores refuse the needles that don't fit, so a volume
+		// may never reach its max size exactly
+		if volIDIP.Writable() && (dir.volInfoMap[volIDIP.ID].Size >= maxSize-maxSize/100 || outlived(volIDIP)) {
+			full = append(full, volIDIP.ID)
+		}
+	}
+	dir.statLock.RUnlock()
+	for _, id := range full {
+		log4go.Info("volume %d is full or outlived its ttl, sealing it", id)
+		if _, err := dir.setVolumeState(id, VolumeSealed); err != nil {
+			log4go.Warn("seal volume %d error: %s", id, err.Error())
+		}
+	}
+}
+
+// syncVolumeStates pushes the volume state again to the stores
+// whose volume disagrees with the directory, e.g. a store that was down
+// when the volume got sealed, held or deleted. It also removes the stale replicas
+// left on the stores that came back after their volumes were re-replicated.
+// The volumes being moved are left alone.
+func (dir *Directory) syncVolumeStates() {
+	volIDIPMap := map[uint32]VolumeIDIP{}
+	for _, volIDIP := range dir.volumes() {
+		volIDIPMap[volIDIP.ID] = volIDIP
+	}
+	dir.statLock.RLock()
+	outdated := map[string][]VolumeIDIP{}
+	stale := map[string][]uint32{}
+	for store, stat := range dir.storeStatMap {
+		for _, volInfo := range stat.VolsInfo {
+			volIDIP, ok := volIDIPMap[volInfo.ID]
+			retainUntil, legalHold := volIDIP.hold()
+			if !ok || dir.transferring(volInfo.ID) || dir.vacuuming(volInfo.ID) {
+				continue
+			}
+			if volIDIP.State != VolumeDeleted && !containsStr(volIDIP.IP, store) {
+				if dir.allAlive(volIDIP.IP) {
+					stale[store] = append(stale[store], volIDIP.ID)
+				}
+				continue
+			}
+			if volIDIP.State == VolumeDeleted || volInfo.ReadOnly == volIDIP.Writable() ||
+				volInfo.LegalHold != legalHold || volInfo.RetainUntil < retainUntil {
+				outdated[store] = append(outdated[store], volIDIP)
+			}
+		}
+	}
+	dir.statLock.RUnlock()
+	for store, volIDIPs := range outdated {
+		for _, volIDIP := range volIDIPs {
+			op := "update"
+			if volIDIP.State == VolumeDeleted {
+				op = "delete"
+			}
+			if err := pushVolume(store, op, volIDIP); err != nil {
+				log4go.Warn("%s volume %d on %s error: %s", op, volIDIP.ID, store, err.Error())
+			}
+		}
+	}
+	for store, ids := range stale {
+		for _, id := range ids {
+			if err := dropReplica(store, id); err != nil {
+				log4go.Warn("delete volume %d on %s error: %s", id, store, err.Error())
+			}
+		}
+	}
+}
+
+// outlived reports whether a volume with TTL has been writable
+// longer than its TTL, so that its files expire at about the same time
+func outlived(volIDIP VolumeIDIP) bool {
+	ttl, _ := parseTTL(volIDIP.TTL)
+	return ttl > 0 && volIDIP.CreatedAt > 0 && time.Since(time.Unix(volIDIP.CreatedAt, 0)) >= ttl
+}
+
+// dropExpiredVolumes deletes the sealed volumes with TTL whose files have
+// all expired, which is much cheaper than compacting them
+func (dir *Directory) dropExpiredVolumes() {
+	expired := []uint32{}
+	for _, volIDIP := range dir.volumes() {
+		ttl, _ := parseTTL(volIDIP.TTL)
+		if ttl == 0 || volIDIP.State != VolumeSealed || volIDIP.SealedAt == 0 || volIDIP.Held() ||
+			dir.transferring(volIDIP.ID) || dir.vacuuming(volIDIP.ID) {
+			continue
+		}
+		// one more pulse for the files on their way when the volume got sealed
+		if time.Since(time.Unix(volIDIP.SealedAt, 0)) >= ttl+dir.pulse {
+			expired = append(expired, volIDIP.ID)
+		}
+	}
+	for _, id := range expired {
+		log4go.Info("files in volume %d have all expired, deleting it", id)
+		if _, err := dir.deleteVolume(id); err != nil {
+			log4go.Warn("delete expired volume %d error: %s", id, err.Error())
+		}
+	}
+}
+
+// setVolumeState changes the volume state through raft,
+// and enforces it on every replica
+func (dir *Directory) setVolumeState(id uint32, state string) (VolumeIDIP, error) {
+	v, err := dir.raftServer.Do(&SetVolStateCommand{ID: id, State: state, At: time.Now().Unix()})
+	if err != nil {
+		return VolumeIDIP{}, err
+	}
+	volIDIP := v.(VolumeIDIP)
+	for _, ip := range volIDIP.IP {
+		if err = pushVolume(ip, "update", volIDIP); err != nil {
+			return VolumeIDIP{}, err
+		}
+	}
+	return volIDIP, nil
+}
+
+// pushVolume posts volIDIP to /vol/<op> of the store
+func pushVolume(store string, op string, volIDIP VolumeIDIP) error {
+	volBytes, err := json.Marshal(volIDIP)
+	if err != nil {
+		return err
+	}
+	_, err = postAndError(fmt.Sprintf("http://%s/vol/%s", store, op), "application/json", bytes.NewReader(volBytes))
+	return err
+}
+
+// allAlive must be called with statLock held
+func (dir *Directory) allAlive(stores []string) bool {
+	for _, store := range stores {
+		if !dir.storeStatMap[store].IsAlive {
+			return false
+		}
+	}
+	return true
+}
+
+// storeLost reports whether the store has been unreachable for longer
+// than ReReplicateDelay, it must be called with statLock held
+func (dir *Directory) storeLost(store string) bool {
+	if dir.storeStatMap[store].IsAlive {
+		return false
+	}
+	delay := time.Duration(dir.conf.ReReplicateDelay) * time.Second
+	if delay <= 0 {
+		delay = 60 * time.Second
+	}
+	lastSeen, ok := dir.storeSeenMap[store]
+	if !ok || lastSeen.Before(dir.startedAt) {
+		// give the stores a chance to answer after the directory starts
+		lastSeen = dir.startedAt
+	}
+	return time.Since(lastSeen) > delay
+}
+
+func (dir *Directory) getVolIDIP(id uint32) (VolumeIDIP, bool) {
+	dir.volLock.RLock()
+	defer dir.volLock.RUnlock()
+	for _, volIDIP := range dir.volIDIPs {
+		if volIDIP.ID == id {
+			return volIDIP, true
+		}
+	}
+	return VolumeIDIP{}, false
+}
+
+// volumes returns a copy of the volume list, safe to range over
+// while raft commands change it
+func (dir *Directory) volumes() []VolumeIDIP {
+	dir.volLock.RLock()
+	defer dir.volLock.RUnlock()
+	return append([]VolumeIDIP{}, dir.volIDIPs...)
+}
+
+func containsStr(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
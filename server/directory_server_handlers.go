@@ -1,14 +1,19 @@
 package server
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
 	"github.com/twinj/uuid"
 )
 
@@ -24,15 +29,31 @@ type assignFileIDResult struct {
 }
 
 func (dir *Directory) assignFileIDHandler(w http.ResponseWriter, r *http.Request) {
-	u4 := uuid.NewV4()
-	keyBytes := u4.Bytes()
-	needleid := helper.BytesToUInt64(keyBytes[:8])
-	volIDIP, err := dir.pickVolume(r.FormValue("replication"))
+	var needleid uint64
+	var cookie uint32
+	var volIDIP *VolumeIDIP
+	var status int
+	var err error
+	if hash := r.FormValue("sha256"); hash != "" {
+		// the file id is derived from the content
+		sum, derr := hex.DecodeString(hash)
+		if derr != nil || len(sum) != sha256.Size {
+			helper.WriteJson(w, assignFileIDResult{Error: fmt.Sprintf("invalid sha256 %s", hash)}, http.StatusInternalServerError)
+			return
+		}
+		needleid, cookie = hashFileKey(sum)
+		volIDIP, status, err = dir.assignContentVolume(sum, r.FormValue("collection"), r.FormValue("replication"), r.FormValue("ttl"))
+	} else {
+		u4 := uuid.NewV4()
+		keyBytes := u4.Bytes()
+		needleid = helper.BytesToUInt64(keyBytes[:8])
+		cookie = rand.Uint32()
+		volIDIP, status, err = dir.assignVolume(r.FormValue("collection"), r.FormValue("replication"), r.FormValue("ttl"))
+	}
 	if err != nil {
-		helper.WriteJson(w, assignFileIDResult{Error: err.Error()}, http.StatusInternalServerError)
+		helper.WriteJson(w, assignFileIDResult{Error: err.Error()}, status)
 		return
 	}
-	cookie := rand.Uint32()
 	fid := fmt.Sprintf("%d,%d,%d", volIDIP.ID, needleid, cookie)
 	a := assignFileIDResult{
 		FID:   fid,
@@ -41,31 +62,160 @@ func (dir *Directory) assignFileIDHandler(w http.ResponseWriter, r *http.Request
 	helper.WriteJson(w, a, http.StatusOK)
 }
 
+// assignVolume picks a writable volume of the group for a new file,
+// it returns the status code to reply with on error
+func (dir *Directory) assignVolume(collection string, replication string, ttl string) (*VolumeIDIP, int, error) {
+	group, err := dir.volumeGroupOf(collection, replication, ttl)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err = dir.checkQuota(group.collection); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	volIDIP, err := dir.pickVolume(group)
+	if err != nil {
+		// no writable volume left, try to grow one before giving up
+		if err = dir.growVolumes(group); err == nil {
+			volIDIP, err = dir.pickVolume(group)
+		}
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return volIDIP, http.StatusOK, nil
+}
+
+// submitHandler stores the uploaded file under a file id derived from
+// its content, and returns the file id
+func (dir *Directory) submitHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	// read the query only, r.FormValue would consume the multipart body
+	query := r.URL.Query()
+	data, name, err := parseUpload(r)
+	if err != nil {
+		helper.WriteJson(w, assignFileIDResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	volIDIP, status, err := dir.assignContentVolume(sum[:], query.Get("collection"), query.Get("replication"), query.Get("ttl"))
+	if err != nil {
+		helper.WriteJson(w, assignFileIDResult{Error: err.Error()}, status)
+		return
+	}
+	needleid, cookie := hashFileKey(sum[:])
+	a := assignFileIDResult{
+		FID:   fmt.Sprintf("%d,%d,%d", volIDIP.ID, needleid, cookie),
+		VolIP: volIDIP.IP[rand.Intn(len(volIDIP.IP))],
+	}
+	storeQuery := url.Values{}
+	if ttl := query.Get("ttl"); ttl != "" {
+		storeQuery.Set("ttl", ttl)
+	}
+	if err = postUpload(fmt.Sprintf("http://%s/%s?%s", a.VolIP, a.FID, storeQuery.Encode()), string(name), data); err != nil {
+		helper.WriteJson(w, assignFileIDResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, a, http.StatusOK)
+}
+
 func (dir *Directory) createVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	group, err := dir.volumeGroupOf(r.FormValue("collection"), r.FormValue("replication"), r.FormValue("ttl"))
+	if err != nil {
+		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	volidip, err := dir.createVolume(group)
+	if err != nil {
+		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, volidip, http.StatusOK)
+}
+
+// createVolume assigns a new volume of the group through raft,
+// and creates it on every picked store server
+func (dir *Directory) createVolume(group volumeGroup) (VolumeIDIP, error) {
 	// increase volumeID
-	createVolCmd := &CreateVolCommand{ReplicateStr: r.FormValue("replication")}
-	// fmt.Println("replication: ", createVolCmd.ReplicateStr)
+	createVolCmd := &CreateVolCommand{
+		ReplicateStr: strconv.Itoa(group.replicateCount),
+		Collection:   group.collection,
+		TTL:          group.ttl,
+		CreatedAt:    time.Now().Unix(),
+	}
 	v, err := dir.raftServer.Do(createVolCmd)
+	if err != nil {
+		return VolumeIDIP{}, err
+	}
+	volidip := v.(VolumeIDIP)
+	for _, ip := range volidip.IP {
+		if err = pushVolume(ip, "create", volidip); err != nil {
+			return VolumeIDIP{}, err
+		}
+	}
+	return volidip, nil
+}
+
+// lookupVolumeHandler returns the stores holding the volume
+func (dir *Directory) lookupVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := newVolumeID(r.FormValue("volume"))
+	if err != nil {
+		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	volidip, ok := dir.getVolIDIP(id)
+	if !ok || volidip.State == VolumeDeleted {
+		helper.WriteJson(w, createVolResult{Error: fmt.Sprintf("no volume %d", id)}, http.StatusNotFound)
+		return
+	}
+	helper.WriteJson(w, volidip, http.StatusOK)
+}
+
+func (dir *Directory) sealVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := newVolumeID(r.FormValue("volume"))
+	if err != nil {
+		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	volidip, err := dir.setVolumeState(id, VolumeSealed)
 	if err != nil {
 		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+	helper.WriteJson(w, volidip, http.StatusOK)
+}
+
+func (dir *Directory) deleteVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := newVolumeID(r.FormValue("volume"))
+	if err != nil {
+		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	volidip, err := dir.deleteVolume(id)
+	if err == storage.ErrHeld {
+		dir.audit.record(auditEntry{Action: "delete volume", Volume: id, Remote: r.RemoteAddr, Error: err.Error()})
+		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusForbidden)
+		return
+	} else if err != nil {
+		helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, volidip, http.StatusOK)
+}
+
+// deleteVolume marks the sealed volume deleted through raft,
+// and deletes it from its stores. A held volume can't be deleted.
+func (dir *Directory) deleteVolume(id uint32) (VolumeIDIP, error) {
+	v, err := dir.raftServer.Do(&DeleteVolCommand{ID: id, At: time.Now().Unix()})
+	if err != nil {
+		return VolumeIDIP{}, err
+	}
 	volidip := v.(VolumeIDIP)
 	for _, ip := range volidip.IP {
-		var b bytes.Buffer
-		bytes, err := json.Marshal(volidip)
-		if err != nil {
-			helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
-			return
-		}
-		b.Write(bytes)
-		_, err = postAndError(fmt.Sprintf("http://%s/vol/create", ip), "application/json", &b)
-		if err != nil {
-			helper.WriteJson(w, createVolResult{Error: err.Error()}, http.StatusInternalServerError)
-			return
+		if err = pushVolume(ip, "delete", volidip); err != nil {
+			return VolumeIDIP{}, err
 		}
 	}
-	helper.WriteJson(w, volidip, http.StatusOK)
+	return volidip, nil
 }
 
 func (dir *Directory) updateVolumeInfoHandler(w http.ResponseWriter, r *http.Request) {
@@ -79,5 +229,7 @@ func (dir *Directory) updateVolumeInfoHandler(w http.ResponseWriter, r *http.Req
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	dir.statLock.Lock()
 	dir.volInfoMap[volInfo.ID] = volInfo
+	dir.statLock.Unlock()
 }
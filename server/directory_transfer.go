@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+)
+
+const (
+	stageCopying    = "copying"
+	stageCatchingUp = "catching up"
+	stageSwitching  = "switching"
+
+	// catching up stops when a round fetches less than catchUpThreshold bytes,
+	// the rest gets fetched while the volume is read-only
+	catchUpThreshold = 1024 * 1024
+	maxCatchUpRounds = 10
+)
+
+// transfer is a volume being moved from one store to another
+type transfer struct {
+	ID    uint32 `json:"id"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Stage string `json:"stage"`
+}
+
+type transferResult struct {
+	Transfers []transfer `json:"transfers,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type syncVolumeResult struct {
+	Fetched int64 `json:"fetched"`
+}
+
+// moveVolumeHandler moves a replica of a volume from one store to another,
+// the target store is picked by the directory if not given
+func (dir *Directory) moveVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := newVolumeID(r.FormValue("volume"))
+	if err != nil {
+		helper.WriteJson(w, transferResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	t, err := dir.startMove(id, r.FormValue("from"), r.FormValue("to"))
+	if err != nil {
+		helper.WriteJson(w, transferResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, transferResult{Transfers: []transfer{t}}, http.StatusOK)
+}
+
+// transfersHandler lists the volumes being moved
+func (dir *Directory) transfersHandler(w http.ResponseWriter, r *http.Request) {
+	dir.transferLock.Lock()
+	transfers := []transfer{}
+	for _, t := range dir.transfers {
+		transfers = append(transfers, *t)
+	}
+	dir.transferLock.Unlock()
+	helper.WriteJson(w, transferResult{Transfers: transfers}, http.StatusOK)
+}
+
+func (dir *Directory) transferring(id uint32) bool {
+	dir.transferLock.Lock()
+	defer dir.transferLock.Unlock()
+	return dir.transfers[id] != nil
+}
+
+func (dir *Directory) setTransferStage(t *transfer, stage string) {
+	dir.transferLock.Lock()
+	t.Stage = stage
+	dir.transferLock.Unlock()
+}
+
+// startMove checks the move, picks the target store if needed,
+// and moves the volume in background
+func (dir *Directory) startMove(id uint32, from string, to string) (transfer, error) {
+	volIDIP, ok := dir.getVolIDIP(id)
+	if !ok || volIDIP.State == VolumeDeleted {
+		return transfer{}, fmt.Errorf("no volume %d", id)
+	}
+	if !containsStr(volIDIP.IP, from) {
+		return transfer{}, fmt.Errorf("volume %d is not on %s", id, from)
+	}
+	if dir.vacuuming(id) {
+		return transfer{}, fmt.Errorf("volume %d is being vacuumed", id)
+	}
+	if to == "" {
+		stores, err := dir.pickStoreServer("1", dir.maxSizeOf(volIDIP), volIDIP.IP...)
+		if err != nil {
+			return transfer{}, err
+		}
+		to = stores[0]
+	} else if containsStr(volIDIP.IP, to) {
+		return transfer{}, fmt.Errorf("volume %d is already on %s", id, to)
+	}
+	dir.transferLock.Lock()
+	if dir.transfers[id] != nil {
+		dir.transferLock.Unlock()
+		return transfer{}, fmt.Errorf("volume %d is being moved", id)
+	}
+	t := &transfer{ID: id, From: from, To: to, Stage: stageCopying}
+	dir.transfers[id] = t
+	dir.transferLock.Unlock()
+	go func() {
+		defer func() {
+			dir.transferLock.Lock()
+			delete(dir.transfers, id)
+			dir.transferLock.Unlock()
+		}()
+		if err := dir.moveVolume(t); err != nil {
+			log4go.Warn("move volume %d from %s to %s error: %s", id, from, to, err.Error())
+		} else {
+			log4go.Info("moved volume %d from %s to %s", id, from, to)
+		}
+	}()
+	return *t, nil
+}
+
+// moveVolume copies the volume to the target store, catches up on the
+// writes happened during the copy, then switches the volume's addresses
+// through raft. The volume is read-only only while switching.
+func (dir *Directory) moveVolume(t *transfer) (err error) {
+	volIDIP, ok := dir.getVolIDIP(t.ID)
+	if !ok {
+		return fmt.Errorf("no volume %d", t.ID)
+	}
+	source := ""
+	dir.statLock.RLock()
+	if dir.storeStatMap[t.From].IsAlive {
+		source = t.From
+	} else {
+		for _, store := range volIDIP.IP {
+			if dir.storeStatMap[store].IsAlive {
+				source = store
+				break
+			}
+		}
+	}
+	dir.statLock.RUnlock()
+	if source == "" {
+		return fmt.Errorf("no healthy replica left")
+	}
+	newVolIDIP := volIDIP
+	newVolIDIP.IP = []string{}
+	for _, store := range volIDIP.IP {
+		if store == t.From {
+			store = t.To
+		}
+		newVolIDIP.IP = append(newVolIDIP.IP, store)
+	}
+	if err = transferVolume(t.To, "copy", source, newVolIDIP, nil); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dropReplica(t.To, t.ID)
+		}
+	}()
+
+	dir.setTransferStage(t, stageCatchingUp)
+	for i := 0; i < maxCatchUpRounds; i++ {
+		var res syncVolumeResult
+		if err = transferVolume(t.To, "sync", source, newVolIDIP, &res); err != nil {
+			return err
+		}
+		if res.Fetched < catchUpThreshold {
+			break
+		}
+	}
+
+	dir.setTransferStage(t, stageSwitching)
+	// make every replica read-only, so nothing gets written during the last sync
+	frozen := volIDIP
+	frozen.State = VolumeSealed
+	for _, store := range volIDIP.IP {
+		if store != t.From || source == t.From {
+			if err = pushVolume(store, "update", frozen); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = transferVolume(t.To, "sync", source, newVolIDIP, nil)
+	}
+	if err == nil {
+		var v interface{}
+		if v, err = dir.raftServer.Do(&UpdateVolIPCommand{ID: t.ID, IP: newVolIDIP.IP}); err == nil {
+			newVolIDIP = v.(VolumeIDIP)
+		}
+	}
+	if err != nil {
+		// unfreeze the old replicas
+		for _, store := range volIDIP.IP {
+			pushVolume(store, "update", volIDIP)
+		}
+		return err
+	}
+	for _, store := range newVolIDIP.IP {
+		if perr := pushVolume(store, "update", newVolIDIP); perr != nil {
+			log4go.Warn("update volume %d on %s error: %s", t.ID, store, perr.Error())
+		}
+	}
+	if source == t.From {
+		if perr := dropReplica(t.From, t.ID); perr != nil {
+			log4go.Warn("delete volume %d on %s error: %s", t.ID, t.From, perr.Error())
+		}
+	}
+	return nil
+}
+
+// underReplicatedVolumes returns the volumes that lost some replicas,
+// along with the lost stores
+func (dir *Directory) underReplicatedVolumes() map[uint32][]string {
+	dir.statLock.RLock()
+	defer dir.statLock.RUnlock()
+	lost := map[uint32][]string{}
+	for _, volIDIP := range dir.volumes() {
+		if volIDIP.State == VolumeDeleted {
+			continue
+		}
+		for _, store := range volIDIP.IP {
+			if dir.storeLost(store) {
+				lost[volIDIP.ID] = append(lost[volIDIP.ID], store)
+			}
+		}
+	}
+	return lost
+}
+
+// repairVolumes moves the replicas on lost stores to new stores picked by
+// pickStoreServer, the data is copied from a healthy replica
+func (dir *Directory) repairVolumes() {
+	for id, lostStores := range dir.underReplicatedVolumes() {
+		if dir.transferring(id) {
+			continue
+		}
+		// one lost replica at a time, the others get repaired in next rounds
+		t, err := dir.startMove(id, lostStores[0], "")
+		if err != nil {
+			log4go.Warn("re-replicate volume %d lost on %s error: %s", id, lostStores[0], err.Error())
+			continue
+		}
+		log4go.Info("re-replicating volume %d lost on %s to %s", id, t.From, t.To)
+	}
+}
+
+// transferVolume asks the target store to copy or sync the volume
+// from the source store
+func transferVolume(target string, op string, source string, volIDIP VolumeIDIP, res interface{}) error {
+	reqBytes, err := json.Marshal(copyVolumeRequest{Volume: volIDIP, Source: source})
+	if err != nil {
+		return err
+	}
+	reply, err := postAndError(fmt.Sprintf("http://%s/vol/%s", target, op), "application/json", bytes.NewReader(reqBytes))
+	if err != nil || res == nil {
+		return err
+	}
+	return json.Unmarshal(reply, res)
+}
+
+// dropReplica deletes the replica of the volume the store holds no more,
+// e.g. after the volume moved away. The data lives on in the other replicas,
+// a held replica goes once the store finds itself out of the volume's
+// addresses on the directory.
+func dropReplica(store string, id uint32) error {
+	return pushVolume(store, "delete", VolumeIDIP{ID: id, State: VolumeDeleted})
+}
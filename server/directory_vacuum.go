@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+type vacuumResult struct {
+	Volumes []uint32 `json:"volumes,omitempty"` // volumes being vacuumed
+	Error   string   `json:"error,omitempty"`
+}
+
+// vacuumHandler vacuums the volume given by the volume parameter,
+// or every volume whose garbage ratio is over VacuumThreshold
+func (dir *Directory) vacuumHandler(w http.ResponseWriter, r *http.Request) {
+	if volStr := r.FormValue("volume"); volStr != "" {
+		id, err := newVolumeID(volStr)
+		if err == nil {
+			err = dir.startVacuum(id)
+		}
+		if err != nil {
+			helper.WriteJson(w, vacuumResult{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		dir.vacuumVolumes()
+	}
+	helper.WriteJson(w, vacuumResult{Volumes: dir.vacuumingVolumes()}, http.StatusOK)
+}
+
+func (dir *Directory) vacuuming(id uint32) bool {
+	dir.vacuumLock.Lock()
+	defer dir.vacuumLock.Unlock()
+	return dir.vacuums[id]
+}
+
+func (dir *Directory) vacuumingVolumes() []uint32 {
+	dir.vacuumLock.Lock()
+	defer dir.vacuumLock.Unlock()
+	ids := []uint32{}
+	for id := range dir.vacuums {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// tickVacuum vacuums the volumes with too much garbage, in the compaction
+// window if configured. Without VacuumThreshold, the stores compact
+// their volumes on their own.
+func (dir *Directory) tickVacuum() {
+	if dir.conf.VacuumThreshold <= 0 {
+		return
+	}
+	in, err := inWindow(dir.conf.CompactionWindow, time.Now())
+	if err != nil {
+		log4go.Warn("compaction window error: %s", err.Error())
+		return
+	}
+	if in {
+		dir.vacuumVolumes()
+	}
+}
+
+// vacuumVolumes starts vacuuming the volume with the most garbage over
+// VacuumThreshold, one volume at a time to limit the disk load
+func (dir *Directory) vacuumVolumes() {
+	if len(dir.vacuumingVolumes()) > 0 {
+		return
+	}
+	id, ratio := uint32(0), float32(0)
+	for volID, r := range dir.garbageRatios() {
+		// compaction would drop the expired files of a held volume
+		if volIDIP, ok := dir.getVolIDIP(volID); ok && volIDIP.Held() {
+			continue
+		}
+		if r > dir.conf.VacuumThreshold && r > ratio {
+			id, ratio = volID, r
+		}
+	}
+	if ratio == 0 {
+		return
+	}
+	if err := dir.startVacuum(id); err != nil {
+		log4go.Warn("vacuum volume %d error: %s", id, err.Error())
+	}
+}
+
+// garbageRatios returns the largest garbage ratio among the replicas
+// of every volume, as last reported by the stores
+func (dir *Directory) garbageRatios() map[uint32]float32 {
+	dir.statLock.RLock()
+	defer dir.statLock.RUnlock()
+	ratios := map[uint32]float32{}
+	for _, stat := range dir.storeStatMap {
+		for _, volInfo := range stat.VolsInfo {
+			if volInfo.Size == 0 {
+				continue
+			}
+			r := float32(volInfo.DeletedSize) / float32(volInfo.Size)
+			if r > ratios[volInfo.ID] {
+				ratios[volInfo.ID] = r
+			}
+		}
+	}
+	return ratios
+}
+
+// startVacuum checks the volume and vacuums it in background
+func (dir *Directory) startVacuum(id uint32) error {
+	volIDIP, ok := dir.getVolIDIP(id)
+	if !ok || volIDIP.State == VolumeDeleted {
+		return fmt.Errorf("no volume %d", id)
+	}
+	if dir.transferring(id) {
+		return fmt.Errorf("volume %d is being moved", id)
+	}
+	if volIDIP.Held() {
+		return storage.ErrHeld
+	}
+	dir.statLock.RLock()
+	alive := dir.allAlive(volIDIP.IP)
+	dir.statLock.RUnlock()
+	if !alive {
+		return fmt.Errorf("volume %d has unreachable replicas", id)
+	}
+	dir.vacuumLock.Lock()
+	if dir.vacuums[id] {
+		dir.vacuumLock.Unlock()
+		return fmt.Errorf("volume %d is being vacuumed", id)
+	}
+	dir.vacuums[id] = true
+	dir.vacuumLock.Unlock()
+	go func() {
+		defer func() {
+			dir.vacuumLock.Lock()
+			delete(dir.vacuums, id)
+			dir.vacuumLock.Unlock()
+		}()
+		if err := dir.vacuumVolume(volIDIP); err != nil {
+			log4go.Warn("vacuum volume %d error: %s", id, err.Error())
+		} else {
+			log4go.Info("vacuumed volume %d", id)
+		}
+	}()
+	return nil
+}
+
+// vacuumVolume compacts every replica of the volume at the same time.
+// The volume gets no file ids and its replicas refuse new files meanwhile,
+// so the replicas end up with the same needles in the same layout.
+func (dir *Directory) vacuumVolume(volIDIP VolumeIDIP) (err error) {
+	frozen := volIDIP
+	frozen.State = VolumeSealed
+	defer func() {
+		// back to the state in raft, the volume may have been sealed meanwhile
+		current, ok := dir.getVolIDIP(volIDIP.ID)
+		if !ok || current.State == VolumeDeleted {
+			return
+		}
+		for _, store := range current.IP {
+			if perr := pushVolume(store, "update", current); perr != nil {
+				log4go.Warn("update volume %d on %s error: %s", current.ID, store, perr.Error())
+			}
+		}
+	}()
+	for _, store := range volIDIP.IP {
+		if err = pushVolume(store, "update", frozen); err != nil {
+			return err
+		}
+	}
+	started := []string{}
+	for _, store := range volIDIP.IP {
+		if _, err = postAndError(fmt.Sprintf("http://%s/vol/compact?volume=%d", store, volIDIP.ID), "", nil); err != nil {
+			for _, s := range started {
+				postAndError(fmt.Sprintf("http://%s/vol/compact/cancel?volume=%d", s, volIDIP.ID), "", nil)
+			}
+			return err
+		}
+		started = append(started, store)
+	}
+	ticker := time.NewTicker(dir.pulse)
+	defer ticker.Stop()
+	for len(started) > 0 {
+		<-ticker.C
+		running := []string{}
+		for _, store := range started {
+			status, serr := compactionStatus(store, volIDIP.ID)
+			if serr != nil {
+				// the store may be restarting, keep polling until it's lost
+				dir.statLock.RLock()
+				lost := dir.storeLost(store)
+				dir.statLock.RUnlock()
+				if !lost {
+					running = append(running, store)
+				} else if err == nil {
+					err = serr
+				}
+				continue
+			}
+			if status.Status.Running {
+				running = append(running, store)
+			} else if status.Status.Error != "" && err == nil {
+				err = fmt.Errorf("compact on %s: %s", store, status.Status.Error)
+			}
+		}
+		started = running
+	}
+	return err
+}
+
+func compactionStatus(store string, id uint32) (compactResult, error) {
+	var res compactResult
+	body, err := getAndError(fmt.Sprintf("http://%s/vol/compact/status?volume=%d", store, id))
+	if err != nil {
+		return res, err
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&res)
+	return res, err
+}
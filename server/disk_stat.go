@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import "syscall"
+
+// diskSpace returns the free and total bytes of the filesystem holding path.
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), fs.Blocks * uint64(fs.Bsize), nil
+}
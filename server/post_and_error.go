@@ -20,3 +20,18 @@ func postAndError(target string, contentType string, b io.Reader) ([]byte, error
 	}
 	return reply, nil
 }
+
+// getAndError returns the response body of a GET request,
+// the caller should close it
+func getAndError(target string) (io.ReadCloser, error) {
+	resp, err := client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(string(reply))
+	}
+	return resp.Body, nil
+}
@@ -1,19 +1,34 @@
 package server
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/chrislusf/raft"
+	"github.com/lilwulin/rabbitfs/storage"
 )
 
 func init() {
 	raft.RegisterCommand(&CreateVolCommand{})
+	raft.RegisterCommand(&SetVolStateCommand{})
+	raft.RegisterCommand(&DeleteVolCommand{})
+	raft.RegisterCommand(&UpdateVolIPCommand{})
+	raft.RegisterCommand(&SetStoreStateCommand{})
+	raft.RegisterCommand(&SetCollectionCommand{})
+	raft.RegisterCommand(&SetHoldCommand{})
+	raft.RegisterCommand(&PutContentCommand{})
 }
 
 type CreateVolCommand struct {
 	ReplicateStr string
+	Collection   string
+	TTL          string
+	CreatedAt    int64
 }
 
 // CommandName implements goraft Command interface's CommandName function
@@ -26,6 +41,24 @@ func (c *CreateVolCommand) CommandName() string {
 // It puts a key-value pair in KVstore
 func (c *CreateVolCommand) Apply(server raft.Server) (interface{}, error) {
 	dir := server.Context().(*Directory)
+	maxSize := dir.volumeMaxSize
+	col := Collection{}
+	if c.Collection != "" {
+		var ok bool
+		if col, ok = dir.getCollection(c.Collection); !ok {
+			return nil, fmt.Errorf("no collection %s", c.Collection)
+		}
+		if col.MaxVolumeSize > 0 {
+			maxSize = col.MaxVolumeSize
+		}
+	}
+	storeIPs, err := dir.pickStoreServer(c.ReplicateStr, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	// pickStoreServer takes statLock, which is never taken inside volLock
+	dir.volLock.Lock()
+	defer dir.volLock.Unlock()
 	maxVolID := uint32(0)
 	for _, volidip := range dir.volIDIPs {
 		if volidip.ID > maxVolID {
@@ -33,18 +66,364 @@ func (c *CreateVolCommand) Apply(server raft.Server) (interface{}, error) {
 		}
 	}
 	maxVolID++
-	storeIPs, err := dir.pickStoreServer(c.ReplicateStr)
-	if err != nil {
-		return nil, err
-	}
 	volIDIP := VolumeIDIP{
-		ID: maxVolID,
-		IP: storeIPs,
+		ID:         maxVolID,
+		IP:         storeIPs,
+		State:      VolumeWritable,
+		MaxSize:    maxSize,
+		Collection: c.Collection,
+		TTL:        c.TTL,
+		CreatedAt:  c.CreatedAt,
+		// new volumes of a held collection are held too
+		ColRetainUntil: col.RetainUntil,
+		ColLegalHold:   col.LegalHold,
 	}
 	dir.volIDIPs = append(dir.volIDIPs, volIDIP)
-	bytes, err := json.Marshal(dir.volIDIPs)
-	if err = ioutil.WriteFile(filepath.Join(dir.confPath, "vol.conf.json"), bytes, 0644); err != nil {
+	if err = dir.saveVolIDIPs(); err != nil {
 		return nil, err
 	}
 	return volIDIP, nil
 }
+
+// SetVolStateCommand changes the state of a volume, e.g. seals it
+type SetVolStateCommand struct {
+	ID    uint32
+	State string
+	At    int64 // unix time in seconds
+}
+
+func (c *SetVolStateCommand) CommandName() string {
+	return "set.volume.state"
+}
+
+func (c *SetVolStateCommand) Apply(server raft.Server) (interface{}, error) {
+	dir := server.Context().(*Directory)
+	if c.State != VolumeWritable && c.State != VolumeSealed {
+		return nil, fmt.Errorf("illegal volume state %s", c.State)
+	}
+	dir.volLock.Lock()
+	defer dir.volLock.Unlock()
+	for i := range dir.volIDIPs {
+		if dir.volIDIPs[i].ID == c.ID {
+			if dir.volIDIPs[i].State == VolumeDeleted {
+				return nil, fmt.Errorf("volume %d is deleted", c.ID)
+			}
+			dir.volIDIPs[i].State = c.State
+			dir.volIDIPs[i].SealedAt = 0
+			if c.State == VolumeSealed {
+				dir.volIDIPs[i].SealedAt = c.At
+			}
+			if err := dir.saveVolIDIPs(); err != nil {
+				return nil, err
+			}
+			return dir.volIDIPs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no volume %d", c.ID)
+}
+
+// DeleteVolCommand marks a sealed volume deleted, unless it's held at the
+// time At. The volume is kept in the list so that its id never gets reused,
+// Apply returns the volume as it was before deleting so that the caller
+// knows its stores.
+type DeleteVolCommand struct {
+	ID uint32
+	At int64 // unix time in seconds
+}
+
+func (c *DeleteVolCommand) CommandName() string {
+	return "delete.volume"
+}
+
+func (c *DeleteVolCommand) Apply(server raft.Server) (interface{}, error) {
+	dir := server.Context().(*Directory)
+	dir.volLock.Lock()
+	defer dir.volLock.Unlock()
+	for i, volIDIP := range dir.volIDIPs {
+		if volIDIP.ID == c.ID {
+			if volIDIP.State != VolumeSealed {
+				return nil, fmt.Errorf("volume %d must be sealed before deleting", c.ID)
+			}
+			// every directory applies the same decision, on replay too
+			if volIDIP.HeldAt(c.At) {
+				return nil, storage.ErrHeld
+			}
+			dir.volIDIPs[i].State = VolumeDeleted
+			dir.volIDIPs[i].IP = nil
+			if err := dir.saveVolIDIPs(); err != nil {
+				return nil, err
+			}
+			// the files in the volume get a new volume when stored again
+			if err := dir.forgetContents(c.ID); err != nil {
+				return nil, err
+			}
+			return volIDIP, nil
+		}
+	}
+	return nil, fmt.Errorf("no volume %d", c.ID)
+}
+
+// UpdateVolIPCommand replaces the store addresses of a volume,
+// e.g. after a replica is copied to another store
+type UpdateVolIPCommand struct {
+	ID uint32
+	IP []string
+}
+
+func (c *UpdateVolIPCommand) CommandName() string {
+	return "update.volume.ip"
+}
+
+func (c *UpdateVolIPCommand) Apply(server raft.Server) (interface{}, error) {
+	dir := server.Context().(*Directory)
+	if len(c.IP) == 0 {
+		return nil, fmt.Errorf("volume %d must have at least one store", c.ID)
+	}
+	dir.volLock.Lock()
+	defer dir.volLock.Unlock()
+	for i := range dir.volIDIPs {
+		if dir.volIDIPs[i].ID == c.ID {
+			if dir.volIDIPs[i].State == VolumeDeleted {
+				return nil, fmt.Errorf("volume %d is deleted", c.ID)
+			}
+			dir.volIDIPs[i].IP = c.IP
+			if err := dir.saveVolIDIPs(); err != nil {
+				return nil, err
+			}
+			return dir.volIDIPs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no volume %d", c.ID)
+}
+
+// saveVolIDIPs must be called with volLock held
+func (dir *Directory) saveVolIDIPs() error {
+	bytes, err := json.Marshal(dir.volIDIPs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir.confPath, "vol.conf.json"), bytes, 0644)
+}
+
+// SetStoreStateCommand marks a store draining or active again
+type SetStoreStateCommand struct {
+	Store string
+	State string
+}
+
+func (c *SetStoreStateCommand) CommandName() string {
+	return "set.store.state"
+}
+
+func (c *SetStoreStateCommand) Apply(server raft.Server) (interface{}, error) {
+	dir := server.Context().(*Directory)
+	dir.statLock.Lock()
+	switch c.State {
+	case StoreActive:
+		delete(dir.storeStates, c.Store)
+	case StoreDraining:
+		dir.storeStates[c.Store] = c.State
+	default:
+		dir.statLock.Unlock()
+		return nil, fmt.Errorf("illegal store state %s", c.State)
+	}
+	bytes, err := json.Marshal(dir.storeStates)
+	dir.statLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir.confPath, "store.conf.json"), bytes, 0644); err != nil {
+		return nil, err
+	}
+	return c.State, nil
+}
+
+// SetCollectionCommand creates a collection or changes its defaults,
+// the hold of an existing collection is kept
+type SetCollectionCommand struct {
+	Collection Collection
+}
+
+func (c *SetCollectionCommand) CommandName() string {
+	return "set.collection"
+}
+
+func (c *SetCollectionCommand) Apply(server raft.Server) (interface{}, error) {
+	dir := server.Context().(*Directory)
+	dir.colLock.Lock()
+	defer dir.colLock.Unlock()
+	col := c.Collection
+	if old, ok := dir.collections[col.Name]; ok {
+		col.RetainUntil, col.LegalHold = old.RetainUntil, old.LegalHold
+	}
+	dir.collections[col.Name] = col
+	bytes, err := json.Marshal(dir.collections)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir.confPath, "collection.conf.json"), bytes, 0644); err != nil {
+		return nil, err
+	}
+	return col, nil
+}
+
+// SetHoldCommand sets the retention date and the legal hold of a volume,
+// or of a collection and every volume in it. A volume keeps its own hold
+// apart from its collection's. The retention date can only be pushed back.
+// Apply returns the volumes changed.
+type SetHoldCommand struct {
+	ID          uint32
+	Collection  string
+	RetainUntil int64 // unix time in seconds
+	LegalHold   bool
+}
+
+func (c *SetHoldCommand) CommandName() string {
+	return "set.hold"
+}
+
+func (c *SetHoldCommand) Apply(server raft.Server) (interface{}, error) {
+	dir := server.Context().(*Directory)
+	if c.Collection != "" {
+		dir.colLock.Lock()
+		col, ok := dir.collections[c.Collection]
+		if !ok {
+			dir.colLock.Unlock()
+			return nil, fmt.Errorf("no collection %s", c.Collection)
+		}
+		if c.RetainUntil < col.RetainUntil {
+			dir.colLock.Unlock()
+			return nil, fmt.Errorf("retention of collection %s can't be shortened", c.Collection)
+		}
+		col.RetainUntil, col.LegalHold = c.RetainUntil, c.LegalHold
+		dir.collections[c.Collection] = col
+		bytes, err := json.Marshal(dir.collections)
+		dir.colLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir.confPath, "collection.conf.json"), bytes, 0644); err != nil {
+			return nil, err
+		}
+	}
+	dir.volLock.Lock()
+	defer dir.volLock.Unlock()
+	changed := []VolumeIDIP{}
+	for i, volIDIP := range dir.volIDIPs {
+		if volIDIP.State == VolumeDeleted {
+			continue
+		}
+		if c.Collection != "" {
+			if volIDIP.Collection != c.Collection {
+				continue
+			}
+		} else if volIDIP.ID != c.ID {
+			continue
+		} else if c.RetainUntil < volIDIP.RetainUntil {
+			return nil, fmt.Errorf("retention of volume %d can't be shortened", c.ID)
+		}
+		if c.Collection != "" {
+			if c.RetainUntil > volIDIP.ColRetainUntil {
+				dir.volIDIPs[i].ColRetainUntil = c.RetainUntil
+			}
+			dir.volIDIPs[i].ColLegalHold = c.LegalHold
+		} else {
+			dir.volIDIPs[i].RetainUntil, dir.volIDIPs[i].LegalHold = c.RetainUntil, c.LegalHold
+		}
+		changed = append(changed, dir.volIDIPs[i])
+	}
+	if c.Collection == "" && len(changed) == 0 {
+		return nil, fmt.Errorf("no volume %d", c.ID)
+	}
+	if err := dir.saveVolIDIPs(); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// PutContentCommand maps the content of Sum to the volume ID, unless another
+// assign mapped it first. Old is the volume it was mapped to before, 0 for
+// none, it's replaced only if it's still the one mapped. Apply returns the
+// volume the content is mapped to in the end.
+type PutContentCommand struct {
+	Sum string // SHA-256 of the content in hex
+	ID  uint32
+	Old uint32
+}
+
+func (c *PutContentCommand) CommandName() string {
+	return "put.content"
+}
+
+func (c *PutContentCommand) Apply(server raft.Server) (interface{}, error) {
+	dir := server.Context().(*Directory)
+	dir.contentLock.Lock()
+	defer dir.contentLock.Unlock()
+	if id, ok := dir.contents[c.Sum]; ok && (id != c.Old || id == c.ID) {
+		return id, nil
+	}
+	dir.contents[c.Sum] = c.ID
+	return c.ID, dir.journalContent(c.Sum, c.ID)
+}
+
+// forgetContents drops the content addressed files of a deleted volume
+func (dir *Directory) forgetContents(id uint32) error {
+	dir.contentLock.Lock()
+	defer dir.contentLock.Unlock()
+	forgotten := false
+	for sum, volID := range dir.contents {
+		if volID == id {
+			delete(dir.contents, sum)
+			forgotten = true
+		}
+	}
+	if !forgotten {
+		return nil
+	}
+	return dir.saveContents()
+}
+
+// journalContent appends a mapping to content.log, so that a put doesn't
+// rewrite all of them. It must be called with contentLock held.
+func (dir *Directory) journalContent(sum string, id uint32) error {
+	f, err := os.OpenFile(filepath.Join(dir.confPath, "content.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(f, "%s %d\n", sum, id); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// saveContents rewrites content.log with one line per mapping left,
+// it must be called with contentLock held
+func (dir *Directory) saveContents() error {
+	lines := make([]string, 0, len(dir.contents))
+	for sum, id := range dir.contents {
+		lines = append(lines, fmt.Sprintf("%s %d\n", sum, id))
+	}
+	return ioutil.WriteFile(filepath.Join(dir.confPath, "content.log"), []byte(strings.Join(lines, "")), 0644)
+}
+
+// loadContents replays content.log, the later lines of a content replace the
+// earlier ones and a line cut short by a crash is skipped
+func loadContents(confPath string) (map[string]uint32, error) {
+	contents := map[string]uint32{}
+	logBytes, err := ioutil.ReadFile(filepath.Join(confPath, "content.log"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return contents, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(logBytes), "\n") {
+		var sum string
+		var id uint32
+		if n, _ := fmt.Sscanf(line, "%s %d", &sum, &id); n == 2 && len(sum) == 2*sha256.Size {
+			contents[sum] = id
+		}
+	}
+	return contents, nil
+}
@@ -2,6 +2,9 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,11 +12,20 @@ import (
 	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/chrislusf/raft"
+	"github.com/gorilla/mux"
 	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
 	"github.com/visionmedia/go-bench"
 )
 
@@ -163,6 +175,1119 @@ func TestDelete(t *testing.T) {
 	)
 }
 
+// fakeRaft applies the commands at once, like the leader of a cluster
+// with a single directory
+type fakeRaft struct {
+	raft.Server
+	dir *Directory
+}
+
+func (f *fakeRaft) Name() string         { return "fake" }
+func (f *fakeRaft) Leader() string       { return "fake" }
+func (f *fakeRaft) Context() interface{} { return f.dir }
+
+func (f *fakeRaft) Do(c raft.Command) (interface{}, error) {
+	return c.(interface {
+		Apply(raft.Server) (interface{}, error)
+	}).Apply(f)
+}
+
+// newTestDirectory returns a directory saving its state in confPath,
+// with stores only known through httptest servers
+func newTestDirectory(confPath string) *Directory {
+	os.MkdirAll(confPath, 0755)
+	dir := &Directory{
+		confPath:      confPath,
+		volumeMaxSize: 1024 * 1024,
+		pulse:         10 * time.Millisecond,
+		storeStatMap:  map[string]storeStat{},
+		storeLoadMap:  map[string]storeLoad{},
+		volInfoMap:    map[uint32]volumeInfo{},
+		volumeGroups:  map[volumeGroup]bool{},
+		storeSeenMap:  map[string]time.Time{},
+		transfers:     map[uint32]*transfer{},
+		storeStates:   map[string]string{},
+		collections:   map[string]Collection{},
+		vacuums:       map[uint32]bool{},
+		audit:         newAuditLog(filepath.Join(confPath, "audit.log")),
+		contents:      map[string]uint32{},
+	}
+	dir.raftServer = &RaftServer{Server: &fakeRaft{dir: dir}}
+	return dir
+}
+
+// fakeStore answers the directory like a store, through httptest. It
+// records the volume requests, like "copy 1" or "update 1 sealed", and
+// answers the catch-up rounds with the sizes in fetched. A compaction
+// keeps running for compactPolls status polls. The requests of the op
+// fail are answered with an error, and onRequest, if set, sees every
+// request before it's answered.
+type fakeStore struct {
+	*httptest.Server
+	lock         sync.Mutex
+	requests     []string
+	fetched      []int64
+	compactPolls int
+	fail         string
+	onRequest    func(op string)
+}
+
+func newFakeStore() *fakeStore {
+	s := &fakeStore{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeStore) addr() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func (s *fakeStore) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	op := strings.TrimPrefix(r.URL.Path, "/vol/")
+	if s.onRequest != nil {
+		s.onRequest(op)
+	}
+	if op == s.fail {
+		s.requests = append(s.requests, op+" failed")
+		http.Error(w, op+" failed", http.StatusInternalServerError)
+		return
+	}
+	switch op {
+	case "copy", "sync":
+		var req copyVolumeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		s.requests = append(s.requests, fmt.Sprintf("%s %d", op, req.Volume.ID))
+		res := syncVolumeResult{}
+		if op == "sync" && len(s.fetched) > 0 {
+			res.Fetched, s.fetched = s.fetched[0], s.fetched[1:]
+		}
+		helper.WriteJson(w, res, http.StatusOK)
+	case "update", "delete":
+		var volIDIP VolumeIDIP
+		json.NewDecoder(r.Body).Decode(&volIDIP)
+		s.requests = append(s.requests, fmt.Sprintf("%s %d %s", op, volIDIP.ID, volIDIP.State))
+		helper.WriteJson(w, volIDIP, http.StatusOK)
+	case "compact", "compact/cancel":
+		s.requests = append(s.requests, fmt.Sprintf("%s %s", op, r.FormValue("volume")))
+		helper.WriteJson(w, compactResult{}, http.StatusOK)
+	case "compact/status":
+		res := compactResult{}
+		if s.compactPolls > 0 {
+			s.compactPolls--
+			res.Status.Running = true
+		}
+		helper.WriteJson(w, res, http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// calls returns the requests recorded, starting with prefix
+func (s *fakeStore) calls(prefix string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	calls := []string{}
+	for _, req := range s.requests {
+		if strings.HasPrefix(req, prefix) {
+			calls = append(calls, req)
+		}
+	}
+	return calls
+}
+
+// aliveStores makes the fake stores the alive stores of dir
+func aliveStores(dir *Directory, stores ...*fakeStore) {
+	for _, s := range stores {
+		dir.conf.Stores = append(dir.conf.Stores, s.addr())
+		dir.storeStatMap[s.addr()] = storeStat{IsAlive: true, FreeSpace: 1 << 30, TotalSpace: 1 << 30}
+	}
+}
+
+// waitFor polls done until it's true, failing the test after 5 seconds
+func waitFor(t *testing.T, what string, done func() bool) {
+	for start := time.Now(); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestRepairVolumes(t *testing.T) {
+	defer helper.RemoveDirs("./TestRepairDir")
+	dir := newTestDirectory("./TestRepairDir")
+	s1, s2 := newFakeStore(), newFakeStore()
+	defer s1.Close()
+	defer s2.Close()
+	aliveStores(dir, s1, s2)
+	// volume 1 lost its replica on a store gone for an hour
+	lost := "127.0.0.1:1"
+	dir.conf.Stores = append(dir.conf.Stores, lost)
+	dir.storeStatMap[lost] = storeStat{IsAlive: false}
+	dir.storeSeenMap[lost] = time.Now().Add(-time.Hour)
+	dir.volIDIPs = []VolumeIDIP{{ID: 1, IP: []string{lost, s1.addr()}, State: VolumeWritable}}
+	dir.repairVolumes()
+	waitFor(t, "the repair of volume 1", func() bool { return !dir.transferring(1) })
+	volIDIP, _ := dir.getVolIDIP(1)
+	if len(volIDIP.IP) != 2 || volIDIP.IP[0] != s2.addr() || volIDIP.IP[1] != s1.addr() {
+		t.Fatalf("expect volume 1 on %s and %s, get %v", s2.addr(), s1.addr(), volIDIP.IP)
+	}
+	// copied from the healthy replica, which is read-only while switching
+	if calls := s2.calls("copy"); len(calls) != 1 {
+		t.Errorf("expect volume 1 copied to %s once, get %v", s2.addr(), calls)
+	}
+	if calls := s1.calls("update"); len(calls) != 2 || calls[0] != "update 1 sealed" || calls[1] != "update 1 writable" {
+		t.Errorf("expect the healthy replica frozen then thawed, get %v", calls)
+	}
+	if calls := s1.calls("delete"); len(calls) != 0 {
+		t.Errorf("expect the healthy replica kept, get %v", calls)
+	}
+	if lostVols := dir.underReplicatedVolumes(); len(lostVols) != 0 {
+		t.Errorf("expect no volume under-replicated, get %v", lostVols)
+	}
+
+	// a store just gone isn't lost yet
+	dir.storeStatMap[s2.addr()] = storeStat{IsAlive: false}
+	dir.storeSeenMap[s2.addr()] = time.Now()
+	dir.repairVolumes()
+	if dir.transferring(1) {
+		t.Error("expect no repair before ReReplicateDelay")
+	}
+}
+
+func TestMoveVolume(t *testing.T) {
+	defer helper.RemoveDirs("./TestMoveDir")
+	dir := newTestDirectory("./TestMoveDir")
+	s1, s2, s3 := newFakeStore(), newFakeStore(), newFakeStore()
+	defer s1.Close()
+	defer s2.Close()
+	defer s3.Close()
+	aliveStores(dir, s1, s2, s3)
+	dir.volIDIPs = []VolumeIDIP{{ID: 1, IP: []string{s1.addr(), s2.addr()}, State: VolumeWritable}}
+	group := volumeGroup{replicateCount: 2}
+	if vols, _ := dir.writableVolumes(group); len(vols) != 1 {
+		t.Fatalf("expect volume 1 writable, get %v", vols)
+	}
+	// two rounds fetch a lot, the third fetches little and ends catching up
+	s3.fetched = []int64{2 * catchUpThreshold, 2 * catchUpThreshold, 100}
+	stages := []string{}
+	assigned := false
+	s3.onRequest = func(op string) {
+		dir.transferLock.Lock()
+		stages = append(stages, op+" "+dir.transfers[1].Stage)
+		dir.transferLock.Unlock()
+		if vols, _ := dir.writableVolumes(group); len(vols) > 0 {
+			assigned = true
+		}
+	}
+	if _, err := dir.startMove(1, s1.addr(), s3.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.startMove(1, s1.addr(), s3.addr()); err == nil {
+		t.Error("expect moving a volume being moved to fail")
+	}
+	waitFor(t, "the move of volume 1", func() bool { return !dir.transferring(1) })
+	expect := []string{"copy copying", "sync catching up", "sync catching up", "sync catching up", "sync switching", "update switching"}
+	if strings.Join(stages, ",") != strings.Join(expect, ",") {
+		t.Errorf("expect the stages %v, get %v", expect, stages)
+	}
+	if assigned {
+		t.Error("expect volume 1 not writable while moving")
+	}
+	volIDIP, _ := dir.getVolIDIP(1)
+	if len(volIDIP.IP) != 2 || volIDIP.IP[0] != s3.addr() || volIDIP.IP[1] != s2.addr() {
+		t.Fatalf("expect volume 1 on %s and %s, get %v", s3.addr(), s2.addr(), volIDIP.IP)
+	}
+	if calls := s1.calls(""); len(calls) != 2 || calls[0] != "update 1 sealed" || calls[1] != "delete 1 deleted" {
+		t.Errorf("expect the old replica frozen then deleted, get %v", calls)
+	}
+	if calls := s2.calls("update"); len(calls) != 2 || calls[1] != "update 1 writable" {
+		t.Errorf("expect the other replica frozen then thawed, get %v", calls)
+	}
+
+	// a failed catch-up drops the new replica and leaves the volume as it was
+	s3.lock.Lock()
+	s3.onRequest = nil
+	s3.lock.Unlock()
+	s1.lock.Lock()
+	s1.requests, s1.fail = nil, "sync"
+	s1.lock.Unlock()
+	if _, err := dir.startMove(1, s3.addr(), s1.addr()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failed move of volume 1", func() bool { return !dir.transferring(1) })
+	if calls := s1.calls(""); len(calls) != 3 || calls[1] != "sync failed" || calls[2] != "delete 1 deleted" {
+		t.Errorf("expect the new replica dropped, get %v", calls)
+	}
+	if v, _ := dir.getVolIDIP(1); v.IP[0] != s3.addr() {
+		t.Errorf("expect volume 1 still on %s, get %v", s3.addr(), v.IP)
+	}
+}
+
+func TestDrainStore(t *testing.T) {
+	defer helper.RemoveDirs("./TestDrainDir")
+	dir := newTestDirectory("./TestDrainDir")
+	s1, s2, s3 := newFakeStore(), newFakeStore(), newFakeStore()
+	defer s1.Close()
+	defer s2.Close()
+	defer s3.Close()
+	aliveStores(dir, s1, s2, s3)
+	dir.volIDIPs = []VolumeIDIP{
+		{ID: 1, IP: []string{s1.addr(), s2.addr()}, State: VolumeWritable},
+		{ID: 2, IP: []string{s1.addr(), s3.addr()}, State: VolumeSealed},
+	}
+	setState := func(path string) drainStatus {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path+"?store="+s1.addr(), nil)
+		if path == "/store/drain" {
+			dir.drainStoreHandler(w, r)
+		} else {
+			dir.undrainStoreHandler(w, r)
+		}
+		var status drainStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %v %+v", path, w.Code, err, status)
+		}
+		return status
+	}
+	if status := setState("/store/drain"); status.State != StoreDraining || len(status.Volumes) != 2 || status.Done {
+		t.Fatalf("expect %s draining with 2 volumes, get %+v", s1.addr(), status)
+	}
+	// new volumes go to the other stores
+	for i := 0; i < 10; i++ {
+		v, err := dir.raftServer.Do(&CreateVolCommand{ReplicateStr: "2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if volIDIP := v.(VolumeIDIP); containsStr(volIDIP.IP, s1.addr()) {
+			t.Fatalf("expect no new volume on a draining store, get %v", volIDIP.IP)
+		}
+	}
+	moving := func() int {
+		dir.transferLock.Lock()
+		defer dir.transferLock.Unlock()
+		return len(dir.transfers)
+	}
+	// one volume at a time
+	for i := 0; i < 2; i++ {
+		dir.drainStores()
+		if n := moving(); n != 1 {
+			t.Fatalf("expect one volume moving off %s, get %d", s1.addr(), n)
+		}
+		waitFor(t, "the drain of "+s1.addr(), func() bool { return moving() == 0 })
+	}
+	status := dir.drainStatus(s1.addr())
+	if !status.Done || len(status.Volumes) != 0 {
+		t.Fatalf("expect %s drained, get %+v", s1.addr(), status)
+	}
+	v1, _ := dir.getVolIDIP(1)
+	v2, _ := dir.getVolIDIP(2)
+	if v1.IP[0] != s3.addr() || v2.IP[0] != s2.addr() {
+		t.Errorf("expect the volumes moved to the stores without a replica, get %v and %v", v1.IP, v2.IP)
+	}
+	if calls := s1.calls("delete"); len(calls) != 2 {
+		t.Errorf("expect both replicas deleted from %s, get %v", s1.addr(), calls)
+	}
+	if status = setState("/store/undrain"); status.State != StoreActive || status.Done {
+		t.Errorf("expect %s active again, get %+v", s1.addr(), status)
+	}
+}
+
+func TestCollectionQuota(t *testing.T) {
+	defer helper.RemoveDirs("./TestQuotaDir")
+	dir := newTestDirectory("./TestQuotaDir")
+	s1 := newFakeStore()
+	defer s1.Close()
+	aliveStores(dir, s1)
+	dir.collections["docs"] = Collection{Name: "docs", Replication: 1, QuotaSize: 1024 * 1024, QuotaFiles: 10}
+	dir.collections["logs"] = Collection{Name: "logs", Replication: 1}
+	dir.volIDIPs = []VolumeIDIP{
+		{ID: 1, IP: []string{s1.addr()}, State: VolumeWritable, Collection: "docs", MaxSize: 4 * 1024 * 1024},
+		{ID: 2, IP: []string{s1.addr()}, State: VolumeWritable, Collection: "logs"},
+	}
+	assign := func(collection string, usage volumeInfo) int {
+		usage.ID = 1
+		dir.volInfoMap[1] = usage
+		dir.volInfoMap[2] = usage
+		w := httptest.NewRecorder()
+		dir.assignFileIDHandler(w, httptest.NewRequest("GET", "/dir/assign?collection="+collection, nil))
+		return w.Code
+	}
+	if code := assign("docs", volumeInfo{Size: 1000, FileCount: 5}); code != http.StatusOK {
+		t.Errorf("expect assigning under the quota to succeed, get %d", code)
+	}
+	if code := assign("docs", volumeInfo{Size: 1000, FileCount: 10}); code != http.StatusForbidden {
+		t.Errorf("expect assigning over the file quota to be forbidden, get %d", code)
+	}
+	// only the live bytes count
+	if code := assign("docs", volumeInfo{Size: 2 * 1024 * 1024, DeletedSize: 1536 * 1024, FileCount: 5}); code != http.StatusOK {
+		t.Errorf("expect the deleted bytes not counted, get %d", code)
+	}
+	if code := assign("docs", volumeInfo{Size: 2 * 1024 * 1024, FileCount: 5}); code != http.StatusForbidden {
+		t.Errorf("expect assigning over the size quota to be forbidden, get %d", code)
+	}
+	if code := assign("logs", volumeInfo{Size: 1000, FileCount: 20}); code != http.StatusOK {
+		t.Errorf("expect a collection without quota unaffected, get %d", code)
+	}
+	dir.volInfoMap[1] = volumeInfo{ID: 1, Size: 2 * 1024 * 1024, FileCount: 5}
+	w := httptest.NewRecorder()
+	dir.usageHandler(w, httptest.NewRequest("GET", "/col/usage?name=docs", nil))
+	var res collectionUsageResult
+	json.NewDecoder(w.Body).Decode(&res)
+	if len(res.Usages) != 1 || res.Usages[0].Size != 2*1024*1024 || res.Usages[0].Files != 5 || res.Usages[0].QuotaFiles != 10 {
+		t.Errorf("expect the usage of docs, get %+v", res)
+	}
+}
+
+func TestVacuumVolumes(t *testing.T) {
+	defer helper.RemoveDirs("./TestVacuumDir")
+	dir := newTestDirectory("./TestVacuumDir")
+	dir.conf.VacuumThreshold = 0.3
+	s1, s2 := newFakeStore(), newFakeStore()
+	defer s1.Close()
+	defer s2.Close()
+	aliveStores(dir, s1, s2)
+	dir.volIDIPs = []VolumeIDIP{
+		{ID: 1, IP: []string{s1.addr(), s2.addr()}, State: VolumeWritable},
+		{ID: 2, IP: []string{s1.addr(), s2.addr()}, State: VolumeWritable},
+		{ID: 3, IP: []string{s1.addr(), s2.addr()}, State: VolumeWritable},
+	}
+	// the most garbage of any replica counts
+	stat := dir.storeStatMap[s1.addr()]
+	stat.VolsInfo = []volumeInfo{{ID: 1, Size: 100, DeletedSize: 10}, {ID: 2, Size: 100, DeletedSize: 40}, {ID: 3, Size: 100}}
+	dir.storeStatMap[s1.addr()] = stat
+	stat = dir.storeStatMap[s2.addr()]
+	stat.VolsInfo = []volumeInfo{{ID: 1, Size: 100, DeletedSize: 60}, {ID: 2, Size: 100, DeletedSize: 40}, {ID: 3, Size: 100}}
+	dir.storeStatMap[s2.addr()] = stat
+	s1.compactPolls, s2.compactPolls = 3, 5
+
+	dir.vacuumVolumes()
+	if ids := dir.vacuumingVolumes(); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("expect volume 1 vacuuming, get %v", ids)
+	}
+	// one volume at a time
+	dir.vacuumVolumes()
+	if ids := dir.vacuumingVolumes(); len(ids) != 1 {
+		t.Errorf("expect one volume vacuuming, get %v", ids)
+	}
+	if vols, _ := dir.writableVolumes(volumeGroup{replicateCount: 2}); len(vols) != 2 {
+		t.Errorf("expect volume 1 not writable while vacuuming, get %v", vols)
+	}
+	if _, err := dir.startMove(1, s1.addr(), ""); err == nil {
+		t.Error("expect moving a volume being vacuumed to fail")
+	}
+	waitFor(t, "the vacuum of volume 1", func() bool { return !dir.vacuuming(1) })
+	// every replica is frozen, compacted, polled until done, then thawed
+	for _, s := range []*fakeStore{s1, s2} {
+		calls := s.calls("")
+		if strings.Join(calls, ",") != "update 1 sealed,compact 1,update 1 writable" {
+			t.Errorf("expect volume 1 compacted on %s, get %v", s.addr(), calls)
+		}
+		s.lock.Lock()
+		polls := s.compactPolls
+		s.requests = nil
+		s.lock.Unlock()
+		if polls != 0 {
+			t.Errorf("expect the compaction on %s polled until done, %d polls left", s.addr(), polls)
+		}
+	}
+
+	// a replica failing to compact cancels the others
+	s2.lock.Lock()
+	s2.fail = "compact"
+	s2.lock.Unlock()
+	if err := dir.startVacuum(2); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the vacuum of volume 2", func() bool { return !dir.vacuuming(2) })
+	if calls := s1.calls(""); strings.Join(calls, ",") != "update 2 sealed,compact 2,compact/cancel 2,update 2 writable" {
+		t.Errorf("expect the compaction on %s cancelled, get %v", s1.addr(), calls)
+	}
+	if calls := s2.calls("update"); len(calls) != 2 || calls[1] != "update 2 writable" {
+		t.Errorf("expect volume 2 thawed on %s, get %v", s2.addr(), calls)
+	}
+}
+
+func TestPlanRebalance(t *testing.T) {
+	dir := &Directory{
+		conf:         configuration{Stores: []string{"s1", "s2", "s3"}},
+		storeStatMap: map[string]storeStat{},
+		storeStates:  map[string]string{},
+		transfers:    map[uint32]*transfer{},
+	}
+	for _, store := range dir.conf.Stores {
+		dir.storeStatMap[store] = storeStat{IsAlive: true, TotalSpace: 1000}
+	}
+	for i := uint32(1); i <= 6; i++ {
+		dir.volIDIPs = append(dir.volIDIPs, VolumeIDIP{ID: i, IP: []string{"s1"}})
+	}
+	moves := dir.planRebalance(10)
+	if len(moves) != 4 {
+		t.Fatalf("expect 4 moves but got %d: %v", len(moves), moves)
+	}
+	count := map[string]int{"s1": 6}
+	for _, m := range moves {
+		count[m.From]--
+		count[m.To]++
+	}
+	if count["s1"] != 2 || count["s2"] != 2 || count["s3"] != 2 {
+		t.Errorf("expect 2 volumes on every store but got %v", count)
+	}
+	if moves = dir.planRebalance(1); len(moves) != 1 {
+		t.Errorf("expect moves to be limited to 1 but got %d", len(moves))
+	}
+}
+
+func TestChunkManifest(t *testing.T) {
+	defer helper.RemoveDirs("./TestChunk")
+	os.MkdirAll("./TestChunk", 0755)
+	file, _ := os.OpenFile("./TestChunk/1.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := storage.NewVolume(1, file, "./TestChunk/1.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol.SetAutoCompact(false)
+	ss := &StoreServer{
+		Addr:          "127.0.0.1:8999",
+		volumeMap:     map[uint32]*storage.Volume{1: vol},
+		localVolIDIPs: []VolumeIDIP{{ID: 1, IP: []string{"127.0.0.1:8999"}}},
+	}
+	chunks := [][]byte{[]byte("hello, "), []byte("large "), []byte("file")}
+	m := ChunkManifest{Name: "large.txt", Size: 17}
+	for i, c := range chunks {
+		if err = vol.AppendNeedle(storage.NewNeedle(uint32(i), uint64(i), c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		m.Chunks = append(m.Chunks, ChunkInfo{FileID: fmt.Sprintf("1,%d,%d", i, i), Offset: int64(i * 7), Size: int64(len(c))})
+	}
+	m.Chunks[2].Offset = 13
+	data, _ := json.Marshal(m)
+	manifest, err := parseManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(newChunkReader(ss, manifest))
+	if err != nil {
+		t.Error(err)
+	} else if string(all) != "hello, large file" {
+		t.Errorf("expect the chunks joined but got %q", all)
+	}
+	// a range spanning two chunks
+	cr := newChunkReader(ss, manifest)
+	cr.Seek(4, io.SeekStart)
+	part := make([]byte, 6)
+	if _, err = io.ReadFull(cr, part); err != nil {
+		t.Error(err)
+	} else if string(part) != "o, lar" {
+		t.Errorf("expect \"o, lar\" but got %q", part)
+	}
+	// chunks must cover the file without gaps
+	m.Chunks[2].Offset = 14
+	data, _ = json.Marshal(m)
+	if _, err = parseManifest(data); err == nil {
+		t.Error("expect a manifest with a gap to fail")
+	}
+	if err = ss.deleteChunks(manifest); err != nil {
+		t.Error(err)
+	}
+	for i := range chunks {
+		if _, err = vol.GetNeedle(uint64(i), uint32(i)); err == nil {
+			t.Errorf("expect chunk %d to be deleted", i)
+		}
+	}
+	vol.Close()
+}
+
+func TestUploadSession(t *testing.T) {
+	defer helper.RemoveDirs("./TestSession")
+	os.MkdirAll("./TestSession", 0755)
+	file, _ := os.OpenFile("./TestSession/1.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := storage.NewVolume(1, file, "./TestSession/1.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	ss := &StoreServer{
+		volumeDir:  "./TestSession",
+		volumeMap:  map[uint32]*storage.Volume{1: vol},
+		completing: map[string]bool{},
+		conf:       configuration{MaxChunkSize: 1},
+	}
+	do := func(handler http.HandlerFunc, method string, target string, body []byte) sessionResult {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		var res sessionResult
+		json.NewDecoder(w.Body).Decode(&res)
+		return res
+	}
+	if res := do(ss.createSessionHandler, "POST", "/session/create?fileid=2,1,1", nil); res.Error == "" {
+		t.Error("expect a session of a volume not on the store to fail")
+	}
+	res := do(ss.createSessionHandler, "POST", "/session/create?fileid=1,1,1&name=big.bin", nil)
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	id := res.Session
+	// parts come in any order and can be uploaded again
+	do(ss.uploadPartHandler, "PUT", "/session/part?session="+id+"&part=3", []byte("ccc"))
+	do(ss.uploadPartHandler, "PUT", "/session/part?session="+id+"&part=1", []byte("a"))
+	do(ss.uploadPartHandler, "PUT", "/session/part?session="+id+"&part=1", []byte("aaa"))
+	if res = do(ss.uploadPartHandler, "PUT", "/session/part?session="+id+"&part=0", []byte("x")); res.Error == "" {
+		t.Error("expect part 0 to fail")
+	}
+	if res = do(ss.uploadPartHandler, "PUT", "/session/part?session="+id+"&part=2", make([]byte, 1024*1024+1)); res.Error == "" {
+		t.Error("expect a part over max_chunk_size to fail")
+	}
+	res = do(ss.sessionStatusHandler, "GET", "/session/status?session="+id, nil)
+	if fmt.Sprint(res.Parts) != "[1 3]" || res.Size != 6 {
+		t.Errorf("expect parts [1 3] of 6 bytes but got %v of %d bytes", res.Parts, res.Size)
+	}
+	session, err := ss.loadSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.completeSession(session); err == nil {
+		t.Error("expect completing with part 2 missing to fail")
+	}
+	if _, err = ss.loadSession("../TestSession"); err == nil {
+		t.Error("expect a session id out of the sessions directory to fail")
+	}
+	do(ss.abortSessionHandler, "POST", "/session/abort?session="+id, nil)
+	if _, err = os.Stat(ss.sessionDir(id)); !os.IsNotExist(err) {
+		t.Error("expect the aborted session to be removed")
+	}
+}
+
+func TestCompressedFile(t *testing.T) {
+	defer helper.RemoveDirs("./TestCompress")
+	os.MkdirAll("./TestCompress", 0755)
+	file, _ := os.OpenFile("./TestCompress/1.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := storage.NewVolume(1, file, "./TestCompress/1.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	ss := &StoreServer{volumeMap: map[uint32]*storage.Volume{1: vol}}
+	router := mux.NewRouter()
+	router.HandleFunc("/{fileID}", ss.uploadHandler).Methods("POST")
+	router.HandleFunc("/{fileID}", ss.getFileHandler).Methods("GET")
+	text := bytes.Repeat([]byte("compress me, "), 100)
+	upload := func(fileID string, filename string) {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, _ := mw.CreateFormFile("file", filename)
+		fw.Write(text)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/"+fileID, &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload %s: %s", filename, w.Body.String())
+		}
+	}
+	upload("1,1,1", "a.txt")
+	upload("1,2,2", "a.bin")
+	if n, _ := vol.GetNeedle(1, 1); n == nil || !n.IsGzipped() {
+		t.Error("expect the text file to be stored gzipped")
+	}
+	if n, _ := vol.GetNeedle(2, 2); n == nil || n.IsGzipped() {
+		t.Error("expect the binary file to be stored raw")
+	}
+	for _, gzipped := range []bool{true, false} {
+		req := httptest.NewRequest("GET", "/1,1,1", nil)
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		body := w.Body.Bytes()
+		if gzipped {
+			if w.Header().Get("Content-Encoding") != "gzip" {
+				t.Error("expect the gzipped bytes to be served as they are")
+			}
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(gr)
+		}
+		if !bytes.Equal(body, text) {
+			t.Errorf("expect the file back with gzip accepted %v", gzipped)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("expect text/plain but got %s", w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestVersionedFile(t *testing.T) {
+	defer helper.RemoveDirs("./TestVersion")
+	os.MkdirAll("./TestVersion", 0755)
+	file, _ := os.OpenFile("./TestVersion/1.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := storage.NewVolume(1, file, "./TestVersion/1.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	vol.SetVersions(2)
+	ss := &StoreServer{volumeMap: map[uint32]*storage.Volume{1: vol}}
+	router := mux.NewRouter()
+	router.HandleFunc("/{fileID}", ss.uploadHandler).Methods("POST")
+	router.HandleFunc("/{fileID}", ss.getFileHandler).Methods("GET")
+	router.HandleFunc("/ver/{fileID}", ss.versionsHandler).Methods("GET")
+	get := func(url string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("get %s: %s", url, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	for _, content := range []string{"first", "second"} {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, _ := mw.CreateFormFile("file", "a.bin")
+		fw.Write([]byte(content))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/1,1,1", &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload %s: %s", content, w.Body.String())
+		}
+	}
+	if body := get("/1,1,1"); body != "second" {
+		t.Errorf("expect the latest version, get %s", body)
+	}
+	if body := get("/1,1,1?version=1"); body != "first" {
+		t.Errorf("expect version 1, get %s", body)
+	}
+	if body := get("/ver/1,1,1"); !strings.Contains(body, `"versions":[1,2]`) {
+		t.Errorf("expect versions 1 and 2, get %s", body)
+	}
+}
+
+func TestHeldVolume(t *testing.T) {
+	defer helper.RemoveDirs("./TestHold")
+	os.MkdirAll("./TestHold", 0755)
+	file, _ := os.OpenFile("./TestHold/1.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := storage.NewVolume(1, file, "./TestHold/1.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	vol.SetVersions(2)
+	file2, _ := os.OpenFile("./TestHold/2.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol2, err := storage.NewVolume(2, file2, "./TestHold/2.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyVolumeState(vol2, VolumeIDIP{ID: 2, State: VolumeSealed, LegalHold: true})
+	// the directory moved volume 2 away from the store
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ips := map[string][]string{"1": {"127.0.0.1:8999"}, "2": {"127.0.0.1:8998"}}
+		helper.WriteJson(w, VolumeIDIP{IP: ips[r.FormValue("volume")]}, http.StatusOK)
+	}))
+	defer directory.Close()
+	ss := &StoreServer{
+		Addr:      "127.0.0.1:8999",
+		volumeDir: "./TestHold",
+		volumeMap: map[uint32]*storage.Volume{1: vol, 2: vol2},
+		conf:      configuration{Directories: []string{strings.TrimPrefix(directory.URL, "http://")}},
+		audit:     newAuditLog("./TestHold/audit.log"),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/{fileID}", ss.uploadHandler).Methods("POST")
+	router.HandleFunc("/del/{fileID}", ss.deleteFileHandler)
+	router.HandleFunc("/vol/delete", ss.deleteVolumeHandler).Methods("POST")
+	upload := func() int {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, _ := mw.CreateFormFile("file", "a.bin")
+		fw.Write([]byte("record"))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/1,1,1", &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := upload(); code != http.StatusOK {
+		t.Fatalf("upload: %d", code)
+	}
+	applyVolumeState(vol, VolumeIDIP{ID: 1, State: VolumeWritable, LegalHold: true})
+	if code := upload(); code != http.StatusForbidden {
+		t.Errorf("expect overwriting a held file to be forbidden, get %d", code)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/del/1,1,1", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expect deleting a held file to be forbidden, get %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	// the store asks the directory, not the request
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/vol/delete?moved=true", strings.NewReader(`{"id":1,"state":"sealed"}`)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expect deleting a held volume to be forbidden, get %d", w.Code)
+	}
+	// a held replica the directory moved away can go
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/vol/delete", strings.NewReader(`{"id":2,"state":"deleted"}`)))
+	if w.Code != http.StatusOK || ss.getVolume(2) != nil {
+		t.Errorf("expect the moved replica dropped, get %d %s", w.Code, w.Body.String())
+	}
+	audit, _ := ioutil.ReadFile("./TestHold/audit.log")
+	for _, action := range []string{"overwrite file", "delete file", "delete volume", "drop moved replica"} {
+		if !strings.Contains(string(audit), `"action":"`+action+`"`) {
+			t.Errorf("expect %s audited, get %s", action, audit)
+		}
+	}
+}
+
+func TestSetHoldCommand(t *testing.T) {
+	defer helper.RemoveDirs("./TestHoldDir")
+	dir := newTestDirectory("./TestHoldDir")
+	dir.collections["docs"] = Collection{Name: "docs"}
+	dir.volIDIPs = []VolumeIDIP{{ID: 1, Collection: "docs", State: VolumeSealed}, {ID: 2, Collection: "docs", State: VolumeSealed}}
+	if _, err := dir.raftServer.Do(&SetHoldCommand{ID: 1, LegalHold: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.raftServer.Do(&SetHoldCommand{Collection: "docs", LegalHold: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.raftServer.Do(&SetHoldCommand{Collection: "docs", LegalHold: false}); err != nil {
+		t.Fatal(err)
+	}
+	// lifting the hold of the collection leaves the hold of volume 1
+	if v, _ := dir.getVolIDIP(1); !v.Held() {
+		t.Error("expect volume 1 still held")
+	}
+	if v, _ := dir.getVolIDIP(2); v.Held() {
+		t.Error("expect volume 2 released")
+	}
+	until := time.Now().Add(time.Hour).Unix()
+	if _, err := dir.raftServer.Do(&SetHoldCommand{Collection: "docs", RetainUntil: until}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.raftServer.Do(&SetHoldCommand{Collection: "docs", RetainUntil: until - 1}); err == nil {
+		t.Error("expect shortening the retention of a collection to fail")
+	}
+	if _, err := dir.raftServer.Do(&DeleteVolCommand{ID: 2, At: time.Now().Unix()}); err != storage.ErrHeld {
+		t.Errorf("expect deleting a held volume to fail with ErrHeld, get %v", err)
+	}
+	// the hold is checked at the time in the command, not when it's applied
+	if _, err := dir.raftServer.Do(&DeleteVolCommand{ID: 2, At: until}); err != nil {
+		t.Errorf("expect deleting a volume whose retention ended to succeed, get %v", err)
+	}
+	// a new volume of the collection is held by the collection
+	dir.conf.Stores = []string{"s1"}
+	dir.storeStatMap["s1"] = storeStat{IsAlive: true, FreeSpace: 1 << 30, TotalSpace: 1 << 30}
+	v, err := dir.raftServer.Do(&CreateVolCommand{Collection: "docs", ReplicateStr: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volIDIP := v.(VolumeIDIP); volIDIP.ColRetainUntil != until || volIDIP.RetainUntil != 0 || !volIDIP.Held() {
+		t.Errorf("expect the new volume held by its collection, get %+v", volIDIP)
+	}
+}
+
+func TestContentAddressedFile(t *testing.T) {
+	defer helper.RemoveDirs("./TestHash")
+	os.MkdirAll("./TestHash", 0755)
+	file, _ := os.OpenFile("./TestHash/1.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := storage.NewVolume(1, file, "./TestHash/1.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	ss := &StoreServer{volumeMap: map[uint32]*storage.Volume{1: vol}}
+	router := mux.NewRouter()
+	router.HandleFunc("/{fileID}", ss.uploadHandler).Methods("POST")
+	router.HandleFunc("/{fileID}", ss.getFileHandler).Methods("GET")
+	data := []byte("immutable content")
+	sum := sha256.Sum256(data)
+	needleID, cookie := hashFileKey(sum[:])
+	fid := fmt.Sprintf("1,%d,%d", needleID, cookie)
+	// uploading the same bytes again is idempotent
+	for i := 0; i < 2; i++ {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, _ := mw.CreateFormFile("file", "a.bin")
+		fw.Write(data)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/"+fid, &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload %d: %s", i, w.Body.String())
+		}
+	}
+	if count := vol.FileCount(); count != 1 {
+		t.Errorf("expect 1 file, get %d", count)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/"+fid, nil))
+	if w.Header().Get("X-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		t.Errorf("expect the hash of the content but got %q", w.Header().Get("X-Content-Sha256"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("expect the file back")
+	}
+	// a needle not holding the content of its file id fails to verify
+	n := storage.NewNeedle(cookie, needleID, []byte("tampered content"), nil)
+	n.SetContentAddressed()
+	if _, _, err = verifyContent(n, needleID, cookie); err == nil {
+		t.Error("expect tampered content to fail verifying")
+	}
+}
+
+func TestSyncVolumeAfterCompaction(t *testing.T) {
+	defer helper.RemoveDirs("./TestSyncSource", "./TestSyncTarget")
+	os.MkdirAll("./TestSyncSource", 0755)
+	os.MkdirAll("./TestSyncTarget", 0755)
+	file, _ := os.OpenFile("./TestSyncSource/1.vol", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := storage.NewVolume(1, file, "./TestSyncSource/1.map", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	vol.SetAutoCompact(false)
+	for i := 1; i <= 4; i++ {
+		if err = vol.AppendNeedle(storage.NewNeedle(uint32(i), uint64(i), []byte(fmt.Sprintf("file %d", i)), nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := &StoreServer{volumeMap: map[uint32]*storage.Volume{1: vol}}
+	router := mux.NewRouter()
+	router.HandleFunc("/vol/data", source.volumeDataHandler).Methods("GET")
+	router.HandleFunc("/vol/index", source.volumeIndexHandler).Methods("GET")
+	router.HandleFunc("/vol/keys", source.volumeKeysHandler).Methods("GET")
+	server := httptest.NewServer(router)
+	defer server.Close()
+	sourceAddr := strings.TrimPrefix(server.URL, "http://")
+
+	target := &StoreServer{volumeDir: "./TestSyncTarget", volumeMap: map[uint32]*storage.Volume{}}
+	volIDIP := VolumeIDIP{ID: 1, State: VolumeWritable, IP: []string{"127.0.0.1:8999"}}
+	if err = target.copyVolume(volIDIP, sourceAddr); err != nil {
+		t.Fatal(err)
+	}
+	// the source compacts the volume during the move
+	for i := 1; i <= 2; i++ {
+		if err = vol.DelNeedle(uint64(i), uint32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = vol.AppendNeedle(storage.NewNeedle(5, 5, []byte("file 5"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = target.syncVolume(volIDIP, sourceAddr); err != nil {
+		t.Fatal(err)
+	}
+	copied := target.getVolume(1)
+	if copied == nil || copied.Generation() != vol.Generation() {
+		t.Fatal("expect the volume copied again")
+	}
+	sourceSize, _ := vol.Size()
+	if size, _ := copied.Size(); size != sourceSize {
+		t.Errorf("expect the copy to be %d bytes, get %d", sourceSize, size)
+	}
+	for i := 1; i <= 5; i++ {
+		n, err := copied.GetNeedle(uint64(i), uint32(i))
+		if i <= 2 {
+			if err == nil {
+				t.Errorf("expect file %d deleted in the copy", i)
+			}
+			continue
+		}
+		if err != nil || string(n.Data) != fmt.Sprintf("file %d", i) {
+			t.Errorf("expect file %d in the copy, get %v", i, err)
+		}
+	}
+	// nothing changed since, the next catch-up fetches nothing
+	if fetched, err := target.syncVolume(volIDIP, sourceAddr); err != nil || fetched != 0 {
+		t.Errorf("expect nothing fetched, get %d %v", fetched, err)
+	}
+	copied.Close()
+}
+
+func TestSubmitSameContent(t *testing.T) {
+	defer helper.RemoveDirs("./TestContentDir")
+	uploads := int32(0)
+	var storedLock sync.Mutex
+	stored := map[string]bool{}
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storedLock.Lock()
+		defer storedLock.Unlock()
+		if r.Method == "GET" {
+			if !stored[r.URL.Path] {
+				http.NotFound(w, r)
+			}
+			return
+		}
+		atomic.AddInt32(&uploads, 1)
+		stored[r.URL.Path] = true
+		helper.WriteJson(w, result{}, http.StatusOK)
+	}))
+	defer store.Close()
+	storeAddr := strings.TrimPrefix(store.URL, "http://")
+	dir := newTestDirectory("./TestContentDir")
+	dir.storeStatMap[storeAddr] = storeStat{IsAlive: true}
+	for id := uint32(1); id <= 4; id++ {
+		dir.volIDIPs = append(dir.volIDIPs, VolumeIDIP{ID: id, State: VolumeWritable, IP: []string{storeAddr}})
+	}
+	submit := func() assignFileIDResult {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		fw.Write([]byte("the same bytes"))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/dir/submit", &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		dir.submitHandler(w, req)
+		var res assignFileIDResult
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if w.Code != http.StatusOK {
+			t.Fatalf("submit: %d %s", w.Code, res.Error)
+		}
+		return res
+	}
+	first := submit()
+	for i := 0; i < 10; i++ {
+		if fid := submit().FID; fid != first.FID {
+			t.Fatalf("expect the same bytes to get file id %s, get %s", first.FID, fid)
+		}
+	}
+	if n := atomic.LoadInt32(&uploads); n != 11 {
+		t.Errorf("expect every submit uploaded, get %d uploads", n)
+	}
+	// assigning by the hash gives the same file id
+	sum := sha256.Sum256([]byte("the same bytes"))
+	w := httptest.NewRecorder()
+	dir.assignFileIDHandler(w, httptest.NewRequest("GET", "/dir/assign?sha256="+hex.EncodeToString(sum[:]), nil))
+	var res assignFileIDResult
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if res.FID != first.FID {
+		t.Errorf("expect assign to give file id %s, get %s %s", first.FID, res.FID, res.Error)
+	}
+	// the content stays in its volume once sealed
+	volID, _, _, _ := newFileID(first.FID)
+	if _, err := dir.raftServer.Do(&SetVolStateCommand{ID: volID, State: VolumeSealed}); err != nil {
+		t.Fatal(err)
+	}
+	if fid := submit().FID; fid != first.FID {
+		t.Errorf("expect the sealed volume to keep file id %s, get %s", first.FID, fid)
+	}
+	// content assigned but never uploaded goes to another volume once sealed
+	other := sha256.Sum256([]byte("other bytes"))
+	w = httptest.NewRecorder()
+	dir.assignFileIDHandler(w, httptest.NewRequest("GET", "/dir/assign?sha256="+hex.EncodeToString(other[:]), nil))
+	json.Unmarshal(w.Body.Bytes(), &res)
+	otherVolID, _, _, _ := newFileID(res.FID)
+	if _, err := dir.raftServer.Do(&SetVolStateCommand{ID: otherVolID, State: VolumeSealed}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	dir.assignFileIDHandler(w, httptest.NewRequest("GET", "/dir/assign?sha256="+hex.EncodeToString(other[:]), nil))
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if id, _, _, _ := newFileID(res.FID); id == otherVolID || res.Error != "" {
+		t.Errorf("expect a writable volume for the content never uploaded, get %s %s", res.FID, res.Error)
+	}
+	// concurrent assigns of new content agree on its volume
+	racing := sha256.Sum256([]byte("racing bytes"))
+	fids := make(chan string, 8)
+	for i := 0; i < cap(fids); i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			dir.assignFileIDHandler(w, httptest.NewRequest("GET", "/dir/assign?sha256="+hex.EncodeToString(racing[:]), nil))
+			var res assignFileIDResult
+			json.Unmarshal(w.Body.Bytes(), &res)
+			fids <- res.FID
+		}()
+	}
+	racingFID := <-fids
+	for i := 1; i < cap(fids); i++ {
+		if fid := <-fids; fid != racingFID {
+			t.Errorf("expect concurrent assigns to give file id %s, get %s", racingFID, fid)
+		}
+	}
+	// a put loses to the mapping it doesn't replace
+	racingVolID, _, _, _ := newFileID(racingFID)
+	if v, err := dir.raftServer.Do(&PutContentCommand{Sum: hex.EncodeToString(racing[:]), ID: 99}); err != nil || v.(uint32) != racingVolID {
+		t.Errorf("expect the put to keep volume %d, get %v %v", racingVolID, v, err)
+	}
+	// the journal replays to the same mappings
+	if contents, err := loadContents("./TestContentDir"); err != nil || !reflect.DeepEqual(contents, dir.contents) {
+		t.Errorf("expect the journal to replay to %v, get %v %v", dir.contents, contents, err)
+	}
+	// the content goes to another volume once its volume is deleted
+	if _, err := dir.raftServer.Do(&DeleteVolCommand{ID: volID, At: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dir.contents[hex.EncodeToString(sum[:])]; ok {
+		t.Error("expect the content of the deleted volume forgotten")
+	}
+	if contents, _ := loadContents("./TestContentDir"); !reflect.DeepEqual(contents, dir.contents) {
+		t.Errorf("expect the journal rewritten to %v, get %v", dir.contents, contents)
+	}
+	if fid := submit().FID; fid == first.FID {
+		t.Errorf("expect a new volume for file id %s", fid)
+	}
+}
+
+func TestUpdateCollection(t *testing.T) {
+	defer helper.RemoveDirs("./TestCollectionDir")
+	dir := newTestDirectory("./TestCollectionDir")
+	set := func(query string) {
+		w := httptest.NewRecorder()
+		dir.createCollectionHandler(w, httptest.NewRequest("GET", "/col/create?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("set collection %s: %d %s", query, w.Code, w.Body.String())
+		}
+	}
+	set("name=docs&replication=2&ttl=7d&max_volume_size=100")
+	if _, err := dir.raftServer.Do(&SetHoldCommand{Collection: "docs", LegalHold: true}); err != nil {
+		t.Fatal(err)
+	}
+	// only the quota is given, the other defaults and the hold stay
+	set("name=docs&quota_files=1000")
+	col, _ := dir.getCollection("docs")
+	if col.Replication != 2 || col.TTL != "7d" || col.MaxVolumeSize != 100*1024*1024 || col.QuotaFiles != 1000 || !col.LegalHold {
+		t.Errorf("expect the defaults not given kept, get %+v", col)
+	}
+	// a default given empty is cleared
+	set("name=docs&ttl=")
+	if col, _ = dir.getCollection("docs"); col.TTL != "" || col.Replication != 2 {
+		t.Errorf("expect the ttl cleared only, get %+v", col)
+	}
+}
+
+func TestCreateVolumeFreeSpace(t *testing.T) {
+	defer helper.RemoveDirs("./TestFreeSpaceDir")
+	dir := newTestDirectory("./TestFreeSpaceDir")
+	dir.collections["small"] = Collection{Name: "small", MaxVolumeSize: 64 * 1024}
+	// s1 has room for a volume of the collection but not for a default one
+	dir.conf.Stores = []string{"s1"}
+	dir.storeStatMap["s1"] = storeStat{IsAlive: true, FreeSpace: 512 * 1024, TotalSpace: 1 << 30}
+	if _, err := dir.raftServer.Do(&CreateVolCommand{ReplicateStr: "1"}); err == nil {
+		t.Error("expect no store for a volume of the default max size")
+	}
+	v, err := dir.raftServer.Do(&CreateVolCommand{Collection: "small", ReplicateStr: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volIDIP := v.(VolumeIDIP); volIDIP.MaxSize != 64*1024 || volIDIP.IP[0] != "s1" {
+		t.Errorf("expect a volume of the collection on s1, get %+v", volIDIP)
+	}
+}
+
 func BenchmarkAssign(b *testing.B) {
 	ops := 10000
 	ben := bench.Start("Assign")
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/log4go"
@@ -17,6 +18,7 @@ import (
 )
 
 type StoreServer struct {
+	writtenBytes     uint64 // accessed atomically, keep it 64-bit aligned
 	router           *mux.Router
 	volumeMap        map[uint32]*storage.Volume
 	garbageThreshold float32
@@ -24,7 +26,12 @@ type StoreServer struct {
 	Addr             string
 	timeout          time.Duration
 	localVolIDIPs    []VolumeIDIP
+	volLock          sync.RWMutex // protects volumeMap and localVolIDIPs
 	conf             configuration
+	completing       map[string]bool // the upload sessions being completed
+	sessionLock      sync.Mutex      // protects completing
+	masterKey        []byte          // wraps the data keys of the volumes, nil if not encrypting
+	audit            *auditLog       // the attempts to delete held data
 }
 
 func NewStoreServer(
@@ -41,6 +48,8 @@ func NewStoreServer(
 		volumeDir:        volumeDir,
 		Addr:             Addr,
 		timeout:          timeout,
+		completing:       map[string]bool{},
+		audit:            newAuditLog(filepath.Join(volumeDir, "audit.log")),
 	}
 
 	// read configuration file
@@ -57,6 +66,33 @@ func NewStoreServer(
 	if err = json.Unmarshal(confBytes, &ss.conf); err != nil {
 		return nil, err
 	}
+	switch ss.conf.Fsync {
+	case "":
+		ss.conf.Fsync = storage.SyncNone
+	case storage.SyncNone, storage.SyncInterval, storage.SyncAlways:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %s", ss.conf.Fsync)
+	}
+	if ss.conf.FsyncInterval <= 0 {
+		ss.conf.FsyncInterval = 1000
+	}
+	if ss.conf.UploadSessionTimeout <= 0 {
+		ss.conf.UploadSessionTimeout = 86400
+	}
+	if ss.conf.MaxChunkSize <= 0 {
+		ss.conf.MaxChunkSize = 64
+	}
+	if ss.conf.Versions < 0 {
+		return nil, fmt.Errorf("versions can't be negative")
+	}
+	if ss.conf.SoftDeleteWindow < 0 {
+		return nil, fmt.Errorf("soft delete window can't be negative")
+	}
+	if ss.conf.MasterKeyFile != "" {
+		if ss.masterKey, err = storage.ReadMasterKey(ss.conf.MasterKeyFile); err != nil {
+			return nil, err
+		}
+	}
 
 	if err = ss.loadVolumes(volumeDir); err != nil {
 		return nil, err
@@ -75,6 +111,11 @@ func NewStoreServer(
 			return nil, err
 		}
 	}
+	for _, volIDIP := range ss.localVolIDIPs {
+		if v := ss.volumeMap[volIDIP.ID]; v != nil {
+			applyVolumeState(v, volIDIP)
+		}
+	}
 
 	// ss.keepSendingHearbeats()
 
@@ -82,8 +123,31 @@ func NewStoreServer(
 	ss.router.HandleFunc("/{fileID}", ss.getFileHandler).Methods("GET")
 	ss.router.HandleFunc("/replicate/{fileID}", ss.replicateUploadHandler).Methods("POST")
 	ss.router.HandleFunc("/del/{fileID}", ss.deleteFileHandler)
+	ss.router.HandleFunc("/undelete/{fileID}", ss.undeleteFileHandler)
+	ss.router.HandleFunc("/ver/{fileID}", ss.versionsHandler).Methods("GET")
 	ss.router.HandleFunc("/vol/create", ss.createVolumeHandler).Methods("POST")
+	ss.router.HandleFunc("/vol/update", ss.updateVolumeHandler).Methods("POST")
+	ss.router.HandleFunc("/vol/delete", ss.deleteVolumeHandler).Methods("POST")
+	ss.router.HandleFunc("/vol/copy", ss.copyVolumeHandler).Methods("POST")
+	ss.router.HandleFunc("/vol/sync", ss.syncVolumeHandler).Methods("POST")
+	ss.router.HandleFunc("/vol/data", ss.volumeDataHandler).Methods("GET")
+	ss.router.HandleFunc("/vol/index", ss.volumeIndexHandler).Methods("GET")
+	ss.router.HandleFunc("/vol/keys", ss.volumeKeysHandler).Methods("GET")
+	ss.router.HandleFunc("/vol/compact", ss.compactVolumeHandler).Methods("POST")
+	ss.router.HandleFunc("/vol/compact/status", ss.compactStatusHandler).Methods("GET")
+	ss.router.HandleFunc("/vol/compact/cancel", ss.cancelCompactHandler).Methods("POST")
+	ss.router.HandleFunc("/session/create", ss.createSessionHandler).Methods("POST")
+	ss.router.HandleFunc("/session/part", ss.uploadPartHandler).Methods("PUT")
+	ss.router.HandleFunc("/session/status", ss.sessionStatusHandler).Methods("GET")
+	ss.router.HandleFunc("/session/complete", ss.completeSessionHandler).Methods("POST")
+	ss.router.HandleFunc("/session/abort", ss.abortSessionHandler).Methods("POST")
 	ss.router.HandleFunc("/store/stat", ss.getStatHandler)
+	go ss.tickerCompactVolumes()
+	go ss.tickerCleanSessions()
+	go ss.tickerPurgeDeleted()
+	if ss.conf.Fsync == storage.SyncInterval {
+		go ss.tickerSyncVolumes()
+	}
 	return
 }
 
@@ -108,18 +172,12 @@ func (ss *StoreServer) loadVolumes(volumeDir string) error {
 	for _, dir := range dirs {
 		volName := dir.Name()
 		if !dir.IsDir() && strings.HasSuffix(volName, ".vol") {
-			volPath := filepath.Join(ss.volumeDir, volName)
-			file, err := os.OpenFile(volPath, os.O_RDWR|os.O_CREATE, 0644)
-			if err != nil {
-				return err
-			}
 			idStr := volName[:len(volName)-len(".vol")]
 			id, err := newVolumeID(idStr)
 			if err != nil {
 				return err
 			}
-			needleMapPath := filepath.Join(ss.volumeDir, fmt.Sprintf("needle_map_vol%d", id))
-			v, err := storage.NewVolume(id, file, needleMapPath, ss.garbageThreshold)
+			v, err := ss.openVolume(id)
 			if err != nil {
 				return err
 			}
@@ -128,3 +186,114 @@ func (ss *StoreServer) loadVolumes(volumeDir string) error {
 	}
 	return nil
 }
+
+func (ss *StoreServer) volumePath(id uint32) string {
+	return filepath.Join(ss.volumeDir, fmt.Sprintf("%d.vol", id))
+}
+
+func (ss *StoreServer) needleMapPath(id uint32) string {
+	return filepath.Join(ss.volumeDir, fmt.Sprintf("needle_map_vol%d", id))
+}
+
+// openVolume opens the volume with id under volumeDir, creates it if not exists
+func (ss *StoreServer) openVolume(id uint32) (*storage.Volume, error) {
+	file, err := os.OpenFile(ss.volumePath(id), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	v, err := storage.NewVolume(id, file, ss.needleMapPath(id), ss.garbageThreshold)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = ss.setupVolume(v); err != nil {
+		v.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// setupVolume applies the store configuration to a volume opened or copied,
+// the state the directory decided is applied by applyVolumeState
+func (ss *StoreServer) setupVolume(v *storage.Volume) error {
+	// compactions are scheduled by tickerCompactVolumes
+	v.SetAutoCompact(false)
+	// the policy is checked in NewStoreServer
+	v.SetSyncPolicy(ss.conf.Fsync)
+	v.SetDedup(ss.conf.Dedup)
+	v.SetVersions(ss.conf.Versions)
+	v.SetSoftDelete(time.Duration(ss.conf.SoftDeleteWindow) * time.Second)
+	return v.SetMasterKey(ss.masterKey)
+}
+
+// tickerSyncVolumes syncs every volume to disk every FsyncInterval
+func (ss *StoreServer) tickerSyncVolumes() {
+	ticker := time.NewTicker(time.Duration(ss.conf.FsyncInterval) * time.Millisecond)
+	for range ticker.C {
+		ss.volLock.RLock()
+		vols := []*storage.Volume{}
+		for _, vol := range ss.volumeMap {
+			vols = append(vols, vol)
+		}
+		ss.volLock.RUnlock()
+		for _, vol := range vols {
+			if err := vol.Sync(); err != nil {
+				log4go.Warn("sync volume %d error: %s", vol.ID, err.Error())
+			}
+		}
+	}
+}
+
+func (ss *StoreServer) getVolume(id uint32) *storage.Volume {
+	ss.volLock.RLock()
+	defer ss.volLock.RUnlock()
+	return ss.volumeMap[id]
+}
+
+func (ss *StoreServer) getVolIDIP(id uint32) (VolumeIDIP, bool) {
+	ss.volLock.RLock()
+	defer ss.volLock.RUnlock()
+	for _, volIDIP := range ss.localVolIDIPs {
+		if volIDIP.ID == id {
+			return volIDIP, true
+		}
+	}
+	return VolumeIDIP{}, false
+}
+
+// removeVolume destroys v and forgets it, unless it was replaced meanwhile
+func (ss *StoreServer) removeVolume(v *storage.Volume) error {
+	ss.volLock.Lock()
+	defer ss.volLock.Unlock()
+	if ss.volumeMap[v.ID] != v {
+		return nil
+	}
+	if err := v.Destroy(); err != nil {
+		return err
+	}
+	delete(ss.volumeMap, v.ID)
+	for i := range ss.localVolIDIPs {
+		if ss.localVolIDIPs[i].ID == v.ID {
+			ss.localVolIDIPs = append(ss.localVolIDIPs[:i], ss.localVolIDIPs[i+1:]...)
+			break
+		}
+	}
+	return ss.saveLocalVolIDIPs()
+}
+
+// saveLocalVolIDIPs must be called with volLock held
+func (ss *StoreServer) saveLocalVolIDIPs() error {
+	bytes, err := json.Marshal(ss.localVolIDIPs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(ss.volumeDir, "volIDIPs.json"), bytes, 0644)
+}
+
+// applyVolumeState makes v enforce the state the directory decided
+func applyVolumeState(v *storage.Volume, volIDIP VolumeIDIP) {
+	v.SetReadOnly(!volIDIP.Writable())
+	v.SetMaxSize(volIDIP.MaxSize)
+	retainUntil, legalHold := volIDIP.hold()
+	v.SetRetention(time.Unix(retainUntil, 0), legalHold)
+}
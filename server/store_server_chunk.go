@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+// ChunkInfo is a chunk of a large file, stored under its own file id
+type ChunkInfo struct {
+	FileID string `json:"fid"`
+	Offset int64  `json:"offset"` // where the chunk starts in the large file
+	Size   int64  `json:"size"`
+}
+
+// ChunkManifest lists the chunks of a large file. It's uploaded
+// with manifest=true once every chunk is uploaded.
+type ChunkManifest struct {
+	Name   string      `json:"name,omitempty"`
+	Mime   string      `json:"mime,omitempty"`
+	Size   int64       `json:"size"`
+	Chunks []ChunkInfo `json:"chunks"`
+}
+
+type byOffset []ChunkInfo
+
+func (c byOffset) Len() int           { return len(c) }
+func (c byOffset) Less(i, j int) bool { return c[i].Offset < c[j].Offset }
+func (c byOffset) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// parseManifest parses the manifest and checks that
+// its chunks cover the large file without gaps
+func parseManifest(data []byte) (*ChunkManifest, error) {
+	var m ChunkManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	sort.Sort(byOffset(m.Chunks))
+	end := int64(0)
+	for _, c := range m.Chunks {
+		if _, _, _, err := newFileID(c.FileID); err != nil {
+			return nil, err
+		}
+		if c.Offset != end || c.Size <= 0 {
+			return nil, fmt.Errorf("chunk %s at %d doesn't follow the previous chunk", c.FileID, c.Offset)
+		}
+		end += c.Size
+	}
+	if m.Size != end {
+		return nil, fmt.Errorf("the chunks take %d bytes, not %d", end, m.Size)
+	}
+	return &m, nil
+}
+
+// lookupStores returns the stores holding the volume, asking
+// the directory about the volumes that aren't on this store
+func (ss *StoreServer) lookupStores(volID uint32) ([]string, error) {
+	if volIDIP, ok := ss.getVolIDIP(volID); ok {
+		return volIDIP.IP, nil
+	}
+	err := errors.New("no directory")
+	for _, dir := range ss.conf.Directories {
+		var body io.ReadCloser
+		body, err = getAndError(fmt.Sprintf("http://%s/vol/lookup?volume=%d", dir, volID))
+		if err != nil {
+			continue
+		}
+		var volIDIP VolumeIDIP
+		err = json.NewDecoder(body).Decode(&volIDIP)
+		body.Close()
+		if err == nil {
+			return volIDIP.IP, nil
+		}
+	}
+	return nil, err
+}
+
+// replicaDropped asks the directory whether the volume has no replica
+// on this store anymore, because it moved away or got deleted
+func (ss *StoreServer) replicaDropped(volID uint32) (bool, error) {
+	err := errors.New("no directory")
+	for _, dir := range ss.conf.Directories {
+		var resp *http.Response
+		resp, err = client.Get(fmt.Sprintf("http://%s/vol/lookup?volume=%d", dir, volID))
+		if err != nil {
+			continue
+		}
+		var volIDIP VolumeIDIP
+		err = json.NewDecoder(resp.Body).Decode(&volIDIP)
+		resp.Body.Close()
+		// the directory only deletes the volumes not held
+		if resp.StatusCode == http.StatusNotFound {
+			return true, nil
+		}
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("lookup volume %d on %s: %s", volID, dir, resp.Status)
+		}
+		if err == nil {
+			return !containsStr(volIDIP.IP, ss.Addr), nil
+		}
+	}
+	return false, err
+}
+
+// readChunk reads the chunk from this store if it has the volume,
+// otherwise from the first replica answering
+func (ss *StoreServer) readChunk(c ChunkInfo) ([]byte, error) {
+	volID, needleID, cookie, err := newFileID(c.FileID)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if vol := ss.getVolume(volID); vol != nil {
+		var n *storage.Needle
+		if n, err = vol.GetNeedle(needleID, cookie); err == nil {
+			if n.Expired() {
+				return nil, fmt.Errorf("chunk %s expired", c.FileID)
+			}
+			data, _, err = verifyContent(n, needleID, cookie)
+		}
+	} else {
+		var stores []string
+		if stores, err = ss.lookupStores(volID); err != nil {
+			return nil, err
+		}
+		for _, store := range stores {
+			var body io.ReadCloser
+			if body, err = getAndError(fmt.Sprintf("http://%s/%s", store, c.FileID)); err != nil {
+				continue
+			}
+			data, err = ioutil.ReadAll(body)
+			body.Close()
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != c.Size {
+		return nil, fmt.Errorf("chunk %s has %d bytes, not %d", c.FileID, len(data), c.Size)
+	}
+	return data, nil
+}
+
+// deleteChunks deletes the chunks of the manifest from every replica
+func (ss *StoreServer) deleteChunks(m *ChunkManifest) error {
+	return ss.eachChunkReplica(m, "del", func(vol *storage.Volume, key uint64, cookie uint32) error {
+		err := vol.DelNeedle(key, cookie)
+		if err == storage.ErrHeld {
+			ss.audit.record(auditEntry{Action: "delete chunk", Volume: vol.ID, FileID: fmt.Sprintf("%d,%d,%d", vol.ID, key, cookie), Error: err.Error()})
+		}
+		return err
+	})
+}
+
+// undeleteChunks undeletes the chunks of the manifest on every replica
+func (ss *StoreServer) undeleteChunks(m *ChunkManifest) error {
+	return ss.eachChunkReplica(m, "undelete", (*storage.Volume).Undelete)
+}
+
+// eachChunkReplica applies action to every replica of the chunks of the
+// manifest, with local on this store and through /<path>/<fid> on the others
+func (ss *StoreServer) eachChunkReplica(m *ChunkManifest, path string, local func(*storage.Volume, uint64, uint32) error) error {
+	for _, c := range m.Chunks {
+		volID, needleID, cookie, err := newFileID(c.FileID)
+		if err != nil {
+			return err
+		}
+		stores, err := ss.lookupStores(volID)
+		if err != nil {
+			return err
+		}
+		for _, store := range stores {
+			if vol := ss.getVolume(volID); store == ss.Addr && vol != nil {
+				err = local(vol, needleID, cookie)
+			} else {
+				var body io.ReadCloser
+				if body, err = getAndError(fmt.Sprintf("http://%s/%s/%s", store, path, c.FileID)); err == nil {
+					body.Close()
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("%s chunk %s on %s: %s", path, c.FileID, store, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// chunkReader reads the large file of a manifest, it reads one
+// chunk at a time and only the chunks being read
+type chunkReader struct {
+	ss       *StoreServer
+	manifest *ChunkManifest
+	pos      int64
+	chunk    int    // the index of the chunk in data
+	data     []byte // nil if no chunk is read yet
+}
+
+func newChunkReader(ss *StoreServer, m *ChunkManifest) *chunkReader {
+	return &chunkReader{ss: ss, manifest: m}
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.pos >= cr.manifest.Size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(cr.manifest.Chunks), func(i int) bool {
+		c := cr.manifest.Chunks[i]
+		return c.Offset+c.Size > cr.pos
+	})
+	c := cr.manifest.Chunks[i]
+	if cr.data == nil || cr.chunk != i {
+		data, err := cr.ss.readChunk(c)
+		if err != nil {
+			return 0, err
+		}
+		cr.chunk, cr.data = i, data
+	}
+	n := copy(p, cr.data[cr.pos-c.Offset:])
+	cr.pos += int64(n)
+	return n, nil
+}
+
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.pos
+	case io.SeekEnd:
+		offset += cr.manifest.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	cr.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+// compactCheckInterval is how often the store looks for volumes to compact
+const compactCheckInterval = time.Minute
+
+type compactResult struct {
+	ID     uint32                   `json:"id,omitempty"`
+	Status storage.CompactionStatus `json:"status"`
+	Error  string                   `json:"error,omitempty"`
+}
+
+// compactVolumeHandler starts compacting the volume in background
+func (ss *StoreServer) compactVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	vol, err := ss.volumeFromForm(r)
+	if err != nil {
+		helper.WriteJson(w, compactResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	done, err := vol.StartCompaction()
+	if err == storage.ErrHeld {
+		ss.audit.record(auditEntry{Action: "compact volume", Volume: vol.ID, Remote: r.RemoteAddr, Error: err.Error()})
+		helper.WriteJson(w, compactResult{ID: vol.ID, Error: err.Error()}, http.StatusForbidden)
+		return
+	} else if err != nil {
+		helper.WriteJson(w, compactResult{ID: vol.ID, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		if err := <-done; err != nil && err != storage.ErrCompactionCanceled {
+			log4go.Warn("compact volume %d error: %s", vol.ID, err.Error())
+		}
+	}()
+	helper.WriteJson(w, compactResult{ID: vol.ID, Status: vol.CompactionStatus()}, http.StatusOK)
+}
+
+// compactStatusHandler shows the progress of the running or last compaction
+func (ss *StoreServer) compactStatusHandler(w http.ResponseWriter, r *http.Request) {
+	vol, err := ss.volumeFromForm(r)
+	if err != nil {
+		helper.WriteJson(w, compactResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, compactResult{ID: vol.ID, Status: vol.CompactionStatus()}, http.StatusOK)
+}
+
+// cancelCompactHandler stops the running compaction, the volume stays as it was
+func (ss *StoreServer) cancelCompactHandler(w http.ResponseWriter, r *http.Request) {
+	vol, err := ss.volumeFromForm(r)
+	if err != nil {
+		helper.WriteJson(w, compactResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if err = vol.CancelCompaction(); err != nil {
+		helper.WriteJson(w, compactResult{ID: vol.ID, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, compactResult{ID: vol.ID, Status: vol.CompactionStatus()}, http.StatusOK)
+}
+
+func (ss *StoreServer) compactVolume(vol *storage.Volume) {
+	if err := vol.Compact(); err != nil && err != storage.ErrCompactionCanceled {
+		log4go.Warn("compact volume %d error: %s", vol.ID, err.Error())
+	}
+}
+
+// tickerCompactVolumes compacts the volumes whose garbage ratio is over the
+// threshold, one at a time and only in the compaction window if configured.
+// With VacuumThreshold configured, the directory triggers the compactions instead.
+func (ss *StoreServer) tickerCompactVolumes() {
+	ticker := time.NewTicker(compactCheckInterval)
+	for range ticker.C {
+		if ss.conf.VacuumThreshold > 0 {
+			continue
+		}
+		in, err := inWindow(ss.conf.CompactionWindow, time.Now())
+		if err != nil {
+			log4go.Warn("compaction window error: %s", err.Error())
+			continue
+		}
+		if !in {
+			continue
+		}
+		ss.volLock.RLock()
+		vols := []*storage.Volume{}
+		for _, vol := range ss.volumeMap {
+			vols = append(vols, vol)
+		}
+		ss.volLock.RUnlock()
+		for _, vol := range vols {
+			ratio, err := vol.GarbageRatio()
+			if err != nil {
+				log4go.Warn("get garbage ratio of volume %d error: %s", vol.ID, err.Error())
+				continue
+			}
+			// compaction would drop the expired files of a held volume
+			if ratio > ss.garbageThreshold && !vol.Held() {
+				ss.compactVolume(vol)
+			}
+		}
+	}
+}
+
+// inWindow reports whether t is in the window, which is like "22:00-06:00"
+// in local time and may span midnight. An empty window means any time.
+func inWindow(window string, t time.Time) (bool, error) {
+	if window == "" {
+		return true, nil
+	}
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return false, fmt.Errorf("invalid window %s", window)
+	}
+	start, err := minuteOfDay(bounds[0])
+	if err != nil {
+		return false, err
+	}
+	end, err := minuteOfDay(bounds[1])
+	if err != nil {
+		return false, err
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end, nil
+	}
+	return now >= start || now < end, nil
+}
+
+func minuteOfDay(hhmm string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(hhmm), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %s", hhmm)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("invalid time %s", hhmm)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time %s", hhmm)
+	}
+	return h*60 + m, nil
+}
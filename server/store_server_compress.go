@@ -0,0 +1,76 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+// compressibleTypes are the MIME types compressed on upload by default,
+// a type ending with "/" stands for every subtype
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/x-yaml",
+	"application/csv",
+	"image/svg+xml",
+}
+
+// compressible reports whether files of the MIME type are worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range compressibleTypes {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldCompress decides whether to gzip the file uploaded to vol:
+// compress=true or compress=false in the query decides, otherwise the
+// files of compressible types are compressed
+func shouldCompress(r *http.Request, vol *storage.Volume, filename string) bool {
+	if vol.Version() < storage.Version2 {
+		return false // no needle flags to mark the data gzipped
+	}
+	switch r.URL.Query().Get("compress") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return compressible(mime.TypeByExtension(filepath.Ext(filename)))
+}
+
+// acceptsGzip reports whether the client takes gzipped responses
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+type copyVolumeRequest struct {
+	Volume VolumeIDIP `json:"volume"`
+	Source string     `json:"source"`
+}
+
+// volumeDataHandler streams the volume file from the offset parameter.
+// A replica catching up sends the compaction generation of its copy too,
+// and gets StatusConflict if the volume was compacted since.
+func (ss *StoreServer) volumeDataHandler(w http.ResponseWriter, r *http.Request) {
+	vol, err := ss.volumeFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	offset := int64(0)
+	if offsetStr := r.FormValue("offset"); offsetStr != "" {
+		if offset, err = strconv.ParseInt(offsetStr, 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	var n int64
+	if generationStr := r.FormValue("generation"); generationStr != "" {
+		generation, perr := strconv.ParseUint(generationStr, 10, 32)
+		if perr != nil {
+			http.Error(w, perr.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, err = vol.WriteChangesTo(w, offset, uint32(generation))
+	} else {
+		n, err = vol.WriteDataTo(w, offset)
+	}
+	if err == storage.ErrCompacted {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else if err != nil && n == 0 {
+		// nothing is sent yet, e.g. the volume is compacting
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if err != nil {
+		log4go.Error("send data of volume %d error: %s", vol.ID, err.Error())
+	}
+}
+
+// volumeIndexHandler streams the needle index of the volume
+func (ss *StoreServer) volumeIndexHandler(w http.ResponseWriter, r *http.Request) {
+	vol, err := ss.volumeFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err = vol.WriteIndexTo(w); err != nil {
+		log4go.Error("send index of volume %d error: %s", vol.ID, err.Error())
+	}
+}
+
+// copyVolumeHandler copies a volume from the source store to this store
+func (ss *StoreServer) copyVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	var req copyVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ss.copyVolume(req.Volume, req.Source); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (ss *StoreServer) copyVolume(volIDIP VolumeIDIP, source string) (err error) {
+	id := volIDIP.ID
+	if ss.getVolume(id) != nil {
+		return fmt.Errorf("volume %d already exists", id)
+	}
+	log4go.Info("copying volume %d from %s", id, source)
+	// leftovers of a failed copy
+	if err = os.RemoveAll(ss.needleMapPath(id)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(ss.volumePath(id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(ss.volumePath(id))
+			os.RemoveAll(ss.needleMapPath(id))
+		}
+	}()
+	// the volume is opened empty, opening copied data without its index
+	// would truncate the data as if written before a crash
+	v, err := storage.NewVolume(id, file, ss.needleMapPath(id), ss.garbageThreshold)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = ss.setupVolume(v); err != nil {
+		v.Destroy()
+		return err
+	}
+	data, err := getAndError(fmt.Sprintf("http://%s/vol/data?volume=%d", source, id))
+	if err != nil {
+		v.Destroy()
+		return err
+	}
+	_, err = v.AppendData(data)
+	data.Close()
+	if err != nil {
+		v.Destroy()
+		return err
+	}
+	if err = ss.fetchDataKeys(v, source); err != nil {
+		v.Destroy()
+		return err
+	}
+	index, err := getAndError(fmt.Sprintf("http://%s/vol/index?volume=%d", source, id))
+	if err != nil {
+		v.Destroy()
+		return err
+	}
+	err = v.ReadIndexFrom(index)
+	index.Close()
+	if err != nil {
+		v.Destroy()
+		return err
+	}
+	applyVolumeState(v, volIDIP)
+	ss.volLock.Lock()
+	defer ss.volLock.Unlock()
+	ss.volumeMap[id] = v
+	ss.localVolIDIPs = append(ss.localVolIDIPs, volIDIP)
+	return ss.saveLocalVolIDIPs()
+}
+
+// syncVolumeHandler catches up on the needles written to and deleted from
+// the source store since the volume was copied
+func (ss *StoreServer) syncVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	var req copyVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	fetched, err := ss.syncVolume(req.Volume, req.Source)
+	if err != nil {
+		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, syncVolumeResult{Fetched: fetched}, http.StatusOK)
+}
+
+// syncVolume fetches the bytes appended to the volume on the source since
+// the last sync. If the source compacted the volume meanwhile, the bytes
+// copied so far are not the source's anymore, and the volume is copied again.
+func (ss *StoreServer) syncVolume(volIDIP VolumeIDIP, source string) (int64, error) {
+	id := volIDIP.ID
+	vol := ss.getVolume(id)
+	if vol == nil {
+		return 0, fmt.Errorf("no volume %d", id)
+	}
+	size, err := vol.Size()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Get(fmt.Sprintf("http://%s/vol/data?volume=%d&offset=%d&generation=%d",
+		source, id, size, vol.Generation()))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		log4go.Info("volume %d was compacted on %s, copying it again", id, source)
+		if err = ss.removeVolume(vol); err != nil {
+			return 0, err
+		}
+		if err = ss.copyVolume(volIDIP, source); err != nil {
+			return 0, err
+		}
+		if vol = ss.getVolume(id); vol == nil {
+			return 0, fmt.Errorf("no volume %d", id)
+		}
+		return vol.Size()
+	}
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return 0, errors.New(string(reply))
+	}
+	fetched, err := vol.AppendData(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	// the source may have rotated its data key by compacting
+	if err = ss.fetchDataKeys(vol, source); err != nil {
+		return 0, err
+	}
+	index, err := getAndError(fmt.Sprintf("http://%s/vol/index?volume=%d", source, id))
+	if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+	return fetched, vol.ReadIndexFrom(index)
+}
+
+type volumeKeysResult struct {
+	Keys  map[uint32]string `json:"keys,omitempty"` // data key id -> data key wrapped by the master key, in hex
+	Error string            `json:"error,omitempty"`
+}
+
+// volumeKeysHandler returns the data keys of an encrypted volume wrapped
+// by the master key, so that the stores copying the volume, which share
+// the master key, can read its needles
+func (ss *StoreServer) volumeKeysHandler(w http.ResponseWriter, r *http.Request) {
+	vol, err := ss.volumeFromForm(r)
+	if err != nil {
+		helper.WriteJson(w, volumeKeysResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	keys, err := vol.WrappedDataKeys()
+	if err != nil {
+		helper.WriteJson(w, volumeKeysResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	res := volumeKeysResult{Keys: map[uint32]string{}}
+	for id, key := range keys {
+		res.Keys[id] = hex.EncodeToString(key)
+	}
+	helper.WriteJson(w, res, http.StatusOK)
+}
+
+// fetchDataKeys adds the data keys of the volume on the source store to vol
+func (ss *StoreServer) fetchDataKeys(vol *storage.Volume, source string) error {
+	body, err := getAndError(fmt.Sprintf("http://%s/vol/keys?volume=%d", source, vol.ID))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	var res volumeKeysResult
+	if err = json.NewDecoder(body).Decode(&res); err != nil {
+		return err
+	}
+	keys := map[uint32][]byte{}
+	for id, key := range res.Keys {
+		if keys[id], err = hex.DecodeString(key); err != nil {
+			return err
+		}
+	}
+	return vol.AddWrappedDataKeys(keys)
+}
+
+func (ss *StoreServer) volumeFromForm(r *http.Request) (*storage.Volume, error) {
+	id, err := newVolumeID(r.FormValue("volume"))
+	if err != nil {
+		return nil, err
+	}
+	vol := ss.getVolume(id)
+	if vol == nil {
+		return nil, fmt.Errorf("no volume %d", id)
+	}
+	return vol, nil
+}
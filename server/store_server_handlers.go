@@ -2,16 +2,20 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"code.google.com/p/log4go"
 
@@ -35,27 +39,66 @@ func (ss *StoreServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
 		return
 	}
-	if ss.volumeMap[volID] == nil {
+	vol := ss.getVolume(volID)
+	if vol == nil {
 		helper.WriteJson(w, result{Error: fmt.Sprintf("no volume %d", volID)}, http.StatusInternalServerError)
 		return
 	}
+	// read the query only, r.FormValue would consume the multipart body
+	expiresAt, err := ss.expiryOf(volID, r.URL.Query().Get("ttl"))
+	if err != nil {
+		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
 	data, name, err := parseUpload(r)
 	if err != nil {
 		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
 		return
 	}
 	n := storage.NewNeedle(cookie, needleID, data, name)
-	if err = ss.volumeMap[volID].AppendNeedle(n); err != nil {
+	replicateQuery := url.Values{}
+	if !expiresAt.IsZero() {
+		n.SetExpiresAt(expiresAt)
+		// replicas expire the file at the same time
+		replicateQuery.Set("expires", strconv.FormatUint(n.ExpiresAt, 10))
+	}
+	if r.URL.Query().Get("manifest") == "true" {
+		if _, err = parseManifest(data); err != nil {
+			helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		n.SetManifest()
+		replicateQuery.Set("manifest", "true")
+	} else {
+		if sum := sha256.Sum256(data); isHashFileKey(needleID, cookie, sum[:]) && vol.Version() >= storage.Version2 {
+			n.SetContentAddressed()
+			replicateQuery.Set("content_addressed", "true")
+		}
+		if shouldCompress(r, vol, string(name)) {
+			if err = n.Gzip(); err != nil {
+				helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+				return
+			}
+			if n.IsGzipped() {
+				// replicas store the gzipped data as is
+				replicateQuery.Set("gzipped", "true")
+			}
+		}
+	}
+	appended, err := appendFile(vol, n)
+	if err == storage.ErrHeld {
+		ss.audit.record(auditEntry{Action: "overwrite file", Volume: volID, FileID: fileIDStr, Remote: r.RemoteAddr, Error: err.Error()})
+		helper.WriteJson(w, result{Error: err.Error()}, http.StatusForbidden)
+		return
+	} else if err != nil {
 		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
 		return
 	}
-
-	fi, _ := ss.volumeMap[volID].StoreFile.Stat()
-	vi := volumeInfo{
-		ID:   volID,
-		Size: fi.Size(),
+	if appended {
+		atomic.AddUint64(&ss.writtenBytes, uint64(len(data)))
 	}
-	viBytes, _ := json.Marshal(vi)
+
+	viBytes, _ := json.Marshal(newVolumeInfo(vol))
 	for i := range ss.conf.Directories { // send volume information to directory server
 		var b bytes.Buffer
 		b.Write(viBytes)
@@ -66,17 +109,14 @@ func (ss *StoreServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 			log4go.Warn("send volumeInfo to directory get err: %s", err.Error())
 		}
 	}
-	for _, localVolIDIP := range ss.localVolIDIPs {
-		if localVolIDIP.ID == volID {
-			for _, ip := range localVolIDIP.IP {
-				if ip != ss.Addr {
-					if err = replicateUpload(fmt.Sprintf("http://%s/replicate/%s", ip, fileIDStr), string(name), data); err != nil {
-						helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
-						return
-					}
+	if localVolIDIP, ok := ss.getVolIDIP(volID); ok {
+		for _, ip := range localVolIDIP.IP {
+			if ip != ss.Addr {
+				if err = postUpload(fmt.Sprintf("http://%s/replicate/%s?%s", ip, fileIDStr, replicateQuery.Encode()), string(name), n.Data); err != nil {
+					helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+					return
 				}
 			}
-			break
 		}
 	}
 	res := result{
@@ -87,10 +127,11 @@ func (ss *StoreServer) uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func replicateUpload(url string, filename string, data []byte) error {
+// postUpload uploads data as a multipart file to url
+func postUpload(url string, filename string, data []byte) error {
 	var b bytes.Buffer
 	mw := multipart.NewWriter(&b)
-	f, _ := mw.CreateFormFile("replicate", filename)
+	f, _ := mw.CreateFormFile("file", filename)
 	_, err := f.Write(data)
 	if err != nil {
 		return err
@@ -109,8 +150,9 @@ func (ss *StoreServer) replicateUploadHandler(w http.ResponseWriter, r *http.Req
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if ss.volumeMap[volID] == nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	vol := ss.getVolume(volID)
+	if vol == nil {
+		http.Error(w, fmt.Sprintf("no volume %d", volID), http.StatusInternalServerError)
 		return
 	}
 	data, name, err := parseUpload(r)
@@ -119,10 +161,48 @@ func (ss *StoreServer) replicateUploadHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 	n := storage.NewNeedle(cookie, needleID, data, name)
-	if err = ss.volumeMap[volID].AppendNeedle(n); err != nil {
+	if expires := r.URL.Query().Get("expires"); expires != "" {
+		sec, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n.SetExpiresAt(time.Unix(sec, 0))
+	}
+	if r.URL.Query().Get("manifest") == "true" {
+		n.SetManifest()
+	}
+	if r.URL.Query().Get("gzipped") == "true" {
+		n.SetGzipped(data)
+	}
+	if r.URL.Query().Get("content_addressed") == "true" {
+		n.SetContentAddressed()
+	}
+	appended, err := appendFile(vol, n)
+	if err == storage.ErrHeld {
+		ss.audit.record(auditEntry{Action: "overwrite file", Volume: volID, FileID: fileIDStr, Remote: r.RemoteAddr, Error: err.Error()})
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if appended {
+		atomic.AddUint64(&ss.writtenBytes, uint64(len(data)))
+	}
+}
+
+// appendFile appends n to vol, and reports whether it's appended.
+// Uploading a content addressed file again succeeds without appending.
+func appendFile(vol *storage.Volume, n *storage.Needle) (bool, error) {
+	if n.IsContentAddressed() {
+		if old, err := vol.GetNeedle(n.Key, n.Cookie); err == nil {
+			if data, err := n.Content(); err == nil && sameContent(old, data) {
+				return false, nil
+			}
+		}
+	}
+	return true, vol.AppendNeedle(n)
 }
 
 func (ss *StoreServer) deleteFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -133,16 +213,42 @@ func (ss *StoreServer) deleteFileHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if ss.volumeMap[volID] == nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	vol := ss.getVolume(volID)
+	if vol == nil {
+		http.Error(w, fmt.Sprintf("no volume %d", volID), http.StatusInternalServerError)
 		return
 	}
-	if err = ss.volumeMap[volID].DelNeedle(needleID, cookie); err != nil {
+	// a held manifest keeps its chunks too
+	if vol.Held() {
+		ss.refuseHeld(w, r, "delete file", volID, fileIDStr)
+		return
+	}
+	// the chunks go first, so a failed delete can be retried
+	if n, err := vol.GetNeedle(needleID, cookie); err == nil && n.IsManifest() {
+		m, err := parseManifest(n.Data)
+		if err == nil {
+			err = ss.deleteChunks(m)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = vol.DelNeedle(needleID, cookie); err == storage.ErrHeld {
+		ss.refuseHeld(w, r, "delete file", volID, fileIDStr)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// refuseHeld refuses the action on the held volume, and audits the attempt
+func (ss *StoreServer) refuseHeld(w http.ResponseWriter, r *http.Request, action string, volID uint32, fileID string) {
+	ss.audit.record(auditEntry{Action: action, Volume: volID, FileID: fileID, Remote: r.RemoteAddr, Error: storage.ErrHeld.Error()})
+	http.Error(w, storage.ErrHeld.Error(), http.StatusForbidden)
+}
+
 func (ss *StoreServer) getFileHandler(w http.ResponseWriter, r *http.Request) {
 	fileIDStr := mux.Vars(r)["fileID"]
 	if li := strings.LastIndex(fileIDStr, "."); li != -1 {
@@ -153,32 +259,118 @@ func (ss *StoreServer) getFileHandler(w http.ResponseWriter, r *http.Request) {
 		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
 		return
 	}
-	if ss.volumeMap[volID] == nil {
+	vol := ss.getVolume(volID)
+	if vol == nil {
 		helper.WriteJson(w, result{Error: fmt.Sprintf("no volume %d", volID)}, http.StatusInternalServerError)
 		return
 	}
-	n, err := ss.volumeMap[volID].GetNeedle(needleID, cookie)
+	var n *storage.Needle
+	if versionStr := r.URL.Query().Get("version"); versionStr != "" {
+		// an older version of the file
+		version, err := strconv.ParseUint(versionStr, 10, 32)
+		if err != nil {
+			helper.WriteJson(w, result{Error: "invalid version " + versionStr}, http.StatusBadRequest)
+			return
+		}
+		n, err = vol.GetNeedleVersion(needleID, cookie, uint32(version))
+	} else {
+		n, err = vol.GetNeedle(needleID, cookie)
+	}
 	if err != nil {
 		helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+	if n.Expired() {
+		helper.WriteJson(w, result{Error: "not found"}, http.StatusNotFound)
+		return
+	}
 	filename := string(n.Name)
-	dotIndex := strings.LastIndex(filename, ".")
+	var content io.ReadSeeker = bytes.NewReader(n.Data)
+	var data []byte // the content, once decompressed or verified
+	if n.IsContentAddressed() {
+		var hash string
+		if data, hash, err = verifyContent(n, needleID, cookie); err != nil {
+			helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		// clients can check the content end-to-end
+		w.Header().Set("X-Content-Sha256", hash)
+	}
 	contentType := ""
-	if dotIndex > 0 {
+	if n.IsManifest() {
+		// stream the chunks of the large file
+		m, err := parseManifest(n.Data)
+		if err != nil {
+			helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		if m.Name != "" {
+			filename = m.Name
+		}
+		contentType = m.Mime
+		content = newChunkReader(ss, m)
+	}
+	dotIndex := strings.LastIndex(filename, ".")
+	if dotIndex > 0 && contentType == "" {
 		ext := filename[dotIndex:]
 		contentType = mime.TypeByExtension(ext)
 	}
+	if n.IsGzipped() {
+		w.Header().Add("Vary", "Accept-Encoding")
+		gzipped := acceptsGzip(r)
+		if data == nil && (!gzipped || contentType == "") {
+			if data, err = n.Content(); err != nil {
+				helper.WriteJson(w, result{Error: err.Error()}, http.StatusInternalServerError)
+				return
+			}
+		}
+		if data != nil {
+			if contentType == "" {
+				// ServeContent would sniff the gzipped bytes
+				contentType = http.DetectContentType(data)
+			}
+			if !gzipped {
+				content = bytes.NewReader(data)
+			}
+		}
+		if gzipped {
+			// the stored bytes are sent as they are
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
 	if contentType != "" {
 		w.Header().Set("Content-Type", contentType)
 	}
 	// TODO: Add ETAG
 	w.Header().Set("Content-Disposition", fmt.Sprintf("filename=\"%s\"", filename))
-	w.Header().Set("Content-Length", strconv.Itoa(len(n.Data)))
-	_, err = w.Write(n.Data)
+	// ServeContent handles Range requests and sets Content-Length
+	http.ServeContent(w, r, filename, time.Time{}, content)
+}
+
+type versionsResult struct {
+	Versions []uint32 `json:"versions,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// versionsHandler lists the versions kept of a file, the last one is
+// the latest, served without ?version=
+func (ss *StoreServer) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	volID, needleID, cookie, err := newFileID(mux.Vars(r)["fileID"])
 	if err != nil {
-		log4go.Error(err.Error())
+		helper.WriteJson(w, versionsResult{Error: err.Error()}, http.StatusBadRequest)
+		return
 	}
+	vol := ss.getVolume(volID)
+	if vol == nil {
+		helper.WriteJson(w, versionsResult{Error: fmt.Sprintf("no volume %d", volID)}, http.StatusInternalServerError)
+		return
+	}
+	versions, err := vol.Versions(needleID, cookie)
+	if err != nil {
+		helper.WriteJson(w, versionsResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, versionsResult{Versions: versions}, http.StatusOK)
 }
 
 func (ss *StoreServer) createVolumeHandler(w http.ResponseWriter, r *http.Request) {
@@ -193,38 +385,112 @@ func (ss *StoreServer) createVolumeHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	id := volIDIP.ID
-	volIDStr := fmt.Sprintf("%d", id)
-	volPath := filepath.Join(ss.volumeDir, volIDStr+".vol")
-	needleMapPath := filepath.Join(ss.volumeDir, fmt.Sprintf("needle_map_vol%d", id))
-	file, err := os.OpenFile(volPath, os.O_RDWR|os.O_CREATE, 0644)
+	v, err := ss.openVolume(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	v, err := storage.NewVolume(id, file, needleMapPath, ss.garbageThreshold)
-	if err != nil {
+	applyVolumeState(v, volIDIP)
+	ss.volLock.Lock()
+	defer ss.volLock.Unlock()
+	ss.localVolIDIPs = append(ss.localVolIDIPs, volIDIP)
+	if err = ss.saveLocalVolIDIPs(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	ss.volumeMap[id] = v
+}
+
+// updateVolumeHandler applies the volume state and addresses
+// the directory has changed
+func (ss *StoreServer) updateVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	var volIDIP VolumeIDIP
+	if err := json.NewDecoder(r.Body).Decode(&volIDIP); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	ss.localVolIDIPs = append(ss.localVolIDIPs, volIDIP)
-	bytes, err := json.Marshal(ss.localVolIDIPs)
-	if err = ioutil.WriteFile(filepath.Join(ss.volumeDir, "volIDIPs.json"), bytes, 0644); err != nil {
+	ss.volLock.Lock()
+	defer ss.volLock.Unlock()
+	v := ss.volumeMap[volIDIP.ID]
+	if v == nil {
+		http.Error(w, fmt.Sprintf("no volume %d", volIDIP.ID), http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for i := range ss.localVolIDIPs {
+		if ss.localVolIDIPs[i].ID == volIDIP.ID {
+			// like the volume, the retention dates can only be pushed back
+			if ss.localVolIDIPs[i].RetainUntil > volIDIP.RetainUntil {
+				volIDIP.RetainUntil = ss.localVolIDIPs[i].RetainUntil
+			}
+			if ss.localVolIDIPs[i].ColRetainUntil > volIDIP.ColRetainUntil {
+				volIDIP.ColRetainUntil = ss.localVolIDIPs[i].ColRetainUntil
+			}
+			ss.localVolIDIPs[i] = volIDIP
+			found = true
+			break
+		}
+	}
+	if !found {
+		ss.localVolIDIPs = append(ss.localVolIDIPs, volIDIP)
+	}
+	applyVolumeState(v, volIDIP)
+	if err := ss.saveLocalVolIDIPs(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (ss *StoreServer) deleteVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	var volIDIP VolumeIDIP
+	if err := json.NewDecoder(r.Body).Decode(&volIDIP); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v := ss.getVolume(volIDIP.ID)
+	if v == nil {
+		return
+	}
+	if volIDIP.Writable() {
+		http.Error(w, fmt.Sprintf("volume %d must be sealed before deleting", volIDIP.ID), http.StatusInternalServerError)
+		return
+	}
+	// a held replica only goes once the directory has moved the volume
+	// away from this store, the data lives on in the other replicas
+	if v.Held() {
+		dropped, err := ss.replicaDropped(volIDIP.ID)
+		if err != nil || !dropped {
+			if err == nil {
+				err = storage.ErrHeld
+			}
+			ss.audit.record(auditEntry{Action: "delete volume", Volume: volIDIP.ID, Remote: r.RemoteAddr, Error: err.Error()})
+			http.Error(w, storage.ErrHeld.Error(), http.StatusForbidden)
+			return
+		}
+		ss.audit.record(auditEntry{Action: "drop moved replica", Volume: volIDIP.ID, Remote: r.RemoteAddr})
+	}
+	if err := ss.removeVolume(v); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	ss.volumeMap[id] = v
 }
 
 func (ss *StoreServer) getStatHandler(w http.ResponseWriter, r *http.Request) {
 	volsInfo := []volumeInfo{}
-	for volID, vol := range ss.volumeMap {
-		fi, _ := vol.StoreFile.Stat()
-		fileSize := fi.Size()
-		volsInfo = append(volsInfo, volumeInfo{ID: volID, Size: fileSize})
+	ss.volLock.RLock()
+	for _, vol := range ss.volumeMap {
+		volsInfo = append(volsInfo, newVolumeInfo(vol))
+	}
+	volsCount := uint32(len(ss.localVolIDIPs))
+	ss.volLock.RUnlock()
+	free, total, err := diskSpace(ss.volumeDir)
+	if err != nil {
+		log4go.Warn("get disk space of %s error: %s", ss.volumeDir, err.Error())
 	}
 	stat := storeStat{
-		IsAlive:   true,
-		VolsCount: uint32(len(ss.localVolIDIPs)),
-		VolsInfo:  volsInfo,
+		IsAlive:      true,
+		VolsCount:    volsCount,
+		VolsInfo:     volsInfo,
+		FreeSpace:    free,
+		TotalSpace:   total,
+		WrittenBytes: atomic.LoadUint64(&ss.writtenBytes),
 	}
 	bytes, _ := json.Marshal(stat)
 	w.Write(bytes)
@@ -256,6 +522,33 @@ func newFileID(fileIDStr string) (uint32, uint64, uint32, error) {
 	return volID, needleID, uint32(cookie), nil
 }
 
+// expiryOf returns when a file uploaded to the volume with the ttl expires,
+// the ttl defaults to the volume's, and may not be longer than it.
+// It returns the zero time for files that never expire.
+func (ss *StoreServer) expiryOf(volID uint32, ttlStr string) (time.Time, error) {
+	ttl, err := parseTTL(ttlStr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	volIDIP, _ := ss.getVolIDIP(volID)
+	volTTL, err := parseTTL(volIDIP.TTL)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if volTTL > 0 {
+		if ttl > volTTL {
+			return time.Time{}, fmt.Errorf("ttl %s is longer than the ttl %s of volume %d", ttlStr, volIDIP.TTL, volID)
+		}
+		if ttl == 0 {
+			ttl = volTTL
+		}
+	}
+	if ttl == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(ttl), nil
+}
+
 func parseUpload(r *http.Request) ([]byte, []byte, error) {
 	form, err := r.MultipartReader()
 	if err != nil {
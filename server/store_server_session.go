@@ -0,0 +1,380 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/twinj/uuid"
+)
+
+// sessionCheckInterval is how often the store looks for abandoned upload sessions
+const sessionCheckInterval = time.Minute
+
+// maxSessionParts is the largest part number of an upload session
+const maxSessionParts = 10000
+
+// uploadSession uploads a file in parts, which are staged under
+// the session directory until the session is completed
+type uploadSession struct {
+	ID          string    `json:"id"`
+	FileID      string    `json:"fileid"`
+	Name        string    `json:"name"`
+	Collection  string    `json:"collection,omitempty"`
+	Replication string    `json:"replication,omitempty"`
+	TTL         string    `json:"ttl,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type sessionResult struct {
+	Session string `json:"session,omitempty"`
+	FileID  string `json:"fileid,omitempty"`
+	Parts   []int  `json:"parts,omitempty"` // the parts received
+	Size    int64  `json:"size,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (ss *StoreServer) sessionsDir() string {
+	return filepath.Join(ss.volumeDir, "sessions")
+}
+
+func (ss *StoreServer) sessionDir(id string) string {
+	return filepath.Join(ss.sessionsDir(), id)
+}
+
+func partName(part int) string {
+	return fmt.Sprintf("part.%d", part)
+}
+
+// createSessionHandler starts an upload session for the file id,
+// whose volume must be on this store
+func (ss *StoreServer) createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	fileID := r.FormValue("fileid")
+	volID, _, _, err := newFileID(fileID)
+	if err == nil && ss.getVolume(volID) == nil {
+		err = fmt.Errorf("no volume %d", volID)
+	}
+	if err == nil {
+		_, err = parseTTL(r.FormValue("ttl"))
+	}
+	if err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	session := uploadSession{
+		ID:          uuid.NewV4().String(),
+		FileID:      fileID,
+		Name:        filepath.Base(r.FormValue("name")),
+		Collection:  r.FormValue("collection"),
+		Replication: r.FormValue("replication"),
+		TTL:         r.FormValue("ttl"),
+		CreatedAt:   time.Now(),
+	}
+	if err = ss.saveSession(session); err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, sessionResult{Session: session.ID, FileID: fileID}, http.StatusOK)
+}
+
+func (ss *StoreServer) saveSession(session uploadSession) error {
+	dir := ss.sessionDir(session.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "session.json"), b, 0644)
+}
+
+func (ss *StoreServer) loadSession(id string) (uploadSession, error) {
+	var session uploadSession
+	// the id comes from the client, it must not climb out of sessionsDir
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return session, fmt.Errorf("invalid session %s", id)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(ss.sessionDir(id), "session.json"))
+	if os.IsNotExist(err) {
+		return session, fmt.Errorf("no session %s", id)
+	} else if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal(b, &session)
+	return session, err
+}
+
+// sessionParts returns the numbers and the total size of the parts received
+func (ss *StoreServer) sessionParts(id string) ([]int, int64, error) {
+	infos, err := ioutil.ReadDir(ss.sessionDir(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	parts := []int{}
+	size := int64(0)
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), "part.") {
+			continue
+		}
+		part, err := strconv.Atoi(strings.TrimPrefix(info.Name(), "part."))
+		if err != nil {
+			continue // a part being written
+		}
+		parts = append(parts, part)
+		size += info.Size()
+	}
+	sort.Ints(parts)
+	return parts, size, nil
+}
+
+// uploadPartHandler stages the request body as the numbered part,
+// uploading a part again replaces it
+func (ss *StoreServer) uploadPartHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	id := r.FormValue("session")
+	session, err := ss.loadSession(id)
+	if err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	part, err := strconv.Atoi(r.FormValue("part"))
+	if err != nil || part < 1 || part > maxSessionParts {
+		helper.WriteJson(w, sessionResult{Error: fmt.Sprintf("part must be from 1 to %d", maxSessionParts)}, http.StatusInternalServerError)
+		return
+	}
+	if ss.sessionCompleting(id) {
+		helper.WriteJson(w, sessionResult{Error: fmt.Sprintf("session %s is completing", id)}, http.StatusInternalServerError)
+		return
+	}
+	// write aside and rename, so a part is never seen half written
+	tmp, err := ioutil.TempFile(ss.sessionDir(id), partName(part)+".tmp")
+	if err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(tmp, io.LimitReader(r.Body, ss.maxChunkSize()+1))
+	if err == nil && n > ss.maxChunkSize() {
+		err = fmt.Errorf("part is larger than %d bytes", ss.maxChunkSize())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(ss.sessionDir(id), partName(part)))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, sessionResult{Session: session.ID, Parts: []int{part}, Size: n}, http.StatusOK)
+}
+
+// sessionStatusHandler lists the parts received, so an interrupted
+// client knows which parts to upload again
+func (ss *StoreServer) sessionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := ss.loadSession(r.FormValue("session"))
+	if err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	parts, size, err := ss.sessionParts(session.ID)
+	if err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, sessionResult{Session: session.ID, FileID: session.FileID, Parts: parts, Size: size}, http.StatusOK)
+}
+
+// abortSessionHandler drops the session and its parts
+func (ss *StoreServer) abortSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := ss.loadSession(r.FormValue("session"))
+	if err == nil && ss.sessionCompleting(session.ID) {
+		err = fmt.Errorf("session %s is completing", session.ID)
+	}
+	if err == nil {
+		err = os.RemoveAll(ss.sessionDir(session.ID))
+	}
+	if err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	helper.WriteJson(w, sessionResult{Session: session.ID}, http.StatusOK)
+}
+
+// completeSessionHandler stores the parts as the file of the session.
+// Parts adding up to no more than MaxChunkSize are joined into one file,
+// otherwise every part becomes a chunk of a chunk manifest.
+func (ss *StoreServer) completeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := ss.loadSession(r.FormValue("session"))
+	if err != nil {
+		helper.WriteJson(w, sessionResult{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if !ss.startCompleting(session.ID) {
+		helper.WriteJson(w, sessionResult{Error: fmt.Sprintf("session %s is completing", session.ID)}, http.StatusInternalServerError)
+		return
+	}
+	defer ss.stopCompleting(session.ID)
+	size, err := ss.completeSession(session)
+	if err != nil {
+		// the session is kept, completing can be retried
+		helper.WriteJson(w, sessionResult{Session: session.ID, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if err = os.RemoveAll(ss.sessionDir(session.ID)); err != nil {
+		log4go.Warn("remove session %s error: %s", session.ID, err.Error())
+	}
+	helper.WriteJson(w, sessionResult{FileID: session.FileID, Size: size}, http.StatusOK)
+}
+
+func (ss *StoreServer) completeSession(session uploadSession) (int64, error) {
+	parts, size, err := ss.sessionParts(session.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) == 0 {
+		return 0, errors.New("no part uploaded")
+	}
+	for i, part := range parts {
+		if part != i+1 {
+			return 0, fmt.Errorf("part %d is missing", i+1)
+		}
+	}
+	query := url.Values{}
+	if session.TTL != "" {
+		query.Set("ttl", session.TTL)
+	}
+	if size <= ss.maxChunkSize() {
+		data := make([]byte, 0, size)
+		for _, part := range parts {
+			b, err := ioutil.ReadFile(filepath.Join(ss.sessionDir(session.ID), partName(part)))
+			if err != nil {
+				return 0, err
+			}
+			data = append(data, b...)
+		}
+		return size, postUpload(fmt.Sprintf("http://%s/%s?%s", ss.Addr, session.FileID, query.Encode()), session.Name, data)
+	}
+
+	manifest := ChunkManifest{Name: session.Name}
+	defer func() {
+		// the chunks are dropped on failure, completing again uploads them again
+		if err != nil && len(manifest.Chunks) > 0 {
+			if derr := ss.deleteChunks(&manifest); derr != nil {
+				log4go.Warn("delete chunks of session %s error: %s", session.ID, derr.Error())
+			}
+		}
+	}()
+	for _, part := range parts {
+		var data []byte
+		if data, err = ioutil.ReadFile(filepath.Join(ss.sessionDir(session.ID), partName(part))); err != nil {
+			return 0, err
+		}
+		var a assignFileIDResult
+		if a, err = ss.assign(session); err != nil {
+			return 0, err
+		}
+		if err = postUpload(fmt.Sprintf("http://%s/%s?%s", a.VolIP, a.FID, query.Encode()), session.Name, data); err != nil {
+			return 0, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ChunkInfo{FileID: a.FID, Offset: manifest.Size, Size: int64(len(data))})
+		manifest.Size += int64(len(data))
+	}
+	var b []byte
+	if b, err = json.Marshal(manifest); err != nil {
+		return 0, err
+	}
+	query.Set("manifest", "true")
+	err = postUpload(fmt.Sprintf("http://%s/%s?%s", ss.Addr, session.FileID, query.Encode()), session.Name, b)
+	return manifest.Size, err
+}
+
+// assign asks the directory for a file id in the session's collection
+func (ss *StoreServer) assign(session uploadSession) (assignFileIDResult, error) {
+	var a assignFileIDResult
+	query := url.Values{}
+	query.Set("collection", session.Collection)
+	query.Set("replication", session.Replication)
+	query.Set("ttl", session.TTL)
+	err := errors.New("no directory")
+	for _, dir := range ss.conf.Directories {
+		var body io.ReadCloser
+		if body, err = getAndError(fmt.Sprintf("http://%s/dir/assign?%s", dir, query.Encode())); err != nil {
+			continue
+		}
+		err = json.NewDecoder(body).Decode(&a)
+		body.Close()
+		if err == nil {
+			return a, nil
+		}
+	}
+	return a, err
+}
+
+func (ss *StoreServer) sessionCompleting(id string) bool {
+	ss.sessionLock.Lock()
+	defer ss.sessionLock.Unlock()
+	return ss.completing[id]
+}
+
+func (ss *StoreServer) startCompleting(id string) bool {
+	ss.sessionLock.Lock()
+	defer ss.sessionLock.Unlock()
+	if ss.completing[id] {
+		return false
+	}
+	ss.completing[id] = true
+	return true
+}
+
+func (ss *StoreServer) stopCompleting(id string) {
+	ss.sessionLock.Lock()
+	delete(ss.completing, id)
+	ss.sessionLock.Unlock()
+}
+
+func (ss *StoreServer) maxChunkSize() int64 {
+	return int64(ss.conf.MaxChunkSize) * 1024 * 1024
+}
+
+// tickerCleanSessions drops the sessions which got no part
+// for UploadSessionTimeout, along with their parts
+func (ss *StoreServer) tickerCleanSessions() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	for range ticker.C {
+		infos, err := ioutil.ReadDir(ss.sessionsDir())
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log4go.Warn("list upload sessions error: %s", err.Error())
+			}
+			continue
+		}
+		timeout := time.Duration(ss.conf.UploadSessionTimeout) * time.Second
+		for _, info := range infos {
+			// receiving a part updates the modification time of the directory
+			if !info.IsDir() || time.Since(info.ModTime()) < timeout || ss.sessionCompleting(info.Name()) {
+				continue
+			}
+			log4go.Info("drop abandoned upload session %s", info.Name())
+			if err = os.RemoveAll(filepath.Join(ss.sessionsDir(), info.Name())); err != nil {
+				log4go.Warn("remove session %s error: %s", info.Name(), err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/gorilla/mux"
+	"github.com/lilwulin/rabbitfs/storage"
+)
+
+// purgeInterval is how often the store purges the files deleted before
+// the soft delete window
+const purgeInterval = time.Minute
+
+// undeleteFileHandler restores a file deleted within the soft delete
+// window, a large file gets its chunks restored on every replica too
+func (ss *StoreServer) undeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	volID, needleID, cookie, err := newFileID(mux.Vars(r)["fileID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vol := ss.getVolume(volID)
+	if vol == nil {
+		http.Error(w, fmt.Sprintf("no volume %d", volID), http.StatusInternalServerError)
+		return
+	}
+	// the manifest goes first to read the chunks from, undeleting
+	// it again does nothing, so a failed undelete can be retried
+	if err = vol.Undelete(needleID, cookie); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, err := vol.GetNeedle(needleID, cookie); err == nil && n.IsManifest() {
+		m, err := parseManifest(n.Data)
+		if err == nil {
+			err = ss.undeleteChunks(m)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// tickerPurgeDeleted drops the files deleted before the soft delete
+// window for good, so compaction can reclaim them
+func (ss *StoreServer) tickerPurgeDeleted() {
+	ticker := time.NewTicker(purgeInterval)
+	for range ticker.C {
+		ss.volLock.RLock()
+		vols := []*storage.Volume{}
+		for _, vol := range ss.volumeMap {
+			vols = append(vols, vol)
+		}
+		ss.volLock.RUnlock()
+		for _, vol := range vols {
+			if _, err := vol.PurgeDeleted(); err != nil {
+				log4go.Warn("purge deleted files of volume %d error: %s", vol.ID, err.Error())
+			}
+		}
+	}
+}
@@ -1,11 +1,63 @@
 package server
 
+import "time"
+
 // type logicVolume struct {
 // 	logicVolID   uint32
 // 	physicVolMap map[uint32]string
 // }
 
+// Volume states, a volume starts writable, gets sealed read-only
+// when it's full or on request, and can then be deleted
+const (
+	VolumeWritable = "writable"
+	VolumeSealed   = "sealed"
+	VolumeDeleted  = "deleted"
+)
+
 type VolumeIDIP struct {
-	ID uint32   `json:"id,omitempty"`
-	IP []string `json:"ip,omitempty"`
+	ID         uint32   `json:"id,omitempty"`
+	IP         []string `json:"ip,omitempty"`
+	State      string   `json:"state,omitempty"`
+	MaxSize    int64    `json:"max_size,omitempty"`
+	Collection string   `json:"collection,omitempty"`
+	TTL        string   `json:"ttl,omitempty"`        // the longest TTL of the files in the volume
+	CreatedAt  int64    `json:"created_at,omitempty"` // unix time in seconds
+	SealedAt   int64    `json:"sealed_at,omitempty"`  // unix time in seconds
+	// the files of a volume under retention or legal hold can't be deleted
+	// or overwritten, and the volume can't be compacted or deleted. The hold
+	// of the volume itself and the hold of its collection are kept apart,
+	// so lifting one leaves the other.
+	RetainUntil    int64 `json:"retain_until,omitempty"` // unix time in seconds
+	LegalHold      bool  `json:"legal_hold,omitempty"`
+	ColRetainUntil int64 `json:"col_retain_until,omitempty"` // unix time in seconds
+	ColLegalHold   bool  `json:"col_legal_hold,omitempty"`
+}
+
+// Writable reports whether files can be appended to the volume,
+// volumes created before states were introduced have an empty state
+func (v VolumeIDIP) Writable() bool {
+	return v.State == "" || v.State == VolumeWritable
+}
+
+// hold returns the later retention date of the volume and its collection,
+// and whether either is under legal hold
+func (v VolumeIDIP) hold() (int64, bool) {
+	retainUntil := v.RetainUntil
+	if v.ColRetainUntil > retainUntil {
+		retainUntil = v.ColRetainUntil
+	}
+	return retainUntil, v.LegalHold || v.ColLegalHold
+}
+
+// Held reports whether the volume is under retention or legal hold,
+// its own or its collection's
+func (v VolumeIDIP) Held() bool {
+	return v.HeldAt(time.Now().Unix())
+}
+
+// HeldAt is Held at the unix time at, in seconds
+func (v VolumeIDIP) HeldAt(at int64) bool {
+	retainUntil, legalHold := v.hold()
+	return legalHold || at < retainUntil
 }
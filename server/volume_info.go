@@ -1,6 +1,28 @@
 package server
 
+import "github.com/lilwulin/rabbitfs/storage"
+
 type volumeInfo struct {
-	ID   uint32 `json:"id,omitempty"`
-	Size int64  `json:"size,omitempty"`
+	ID          uint32 `json:"id,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ReadOnly    bool   `json:"read_only,omitempty"`
+	FileCount   int64  `json:"file_count,omitempty"`
+	DeletedSize int64  `json:"deleted_size,omitempty"`
+	RetainUntil int64  `json:"retain_until,omitempty"` // unix time in seconds
+	LegalHold   bool   `json:"legal_hold,omitempty"`
+	Plaintext   bool   `json:"plaintext,omitempty"` // a version 1 volume of an encrypting store
+}
+
+func newVolumeInfo(vol *storage.Volume) volumeInfo {
+	vi := volumeInfo{ID: vol.ID, ReadOnly: vol.ReadOnly(), FileCount: vol.FileCount()}
+	vi.Size, _ = vol.Size()
+	deletedSize, _ := vol.DeletedSize()
+	vi.DeletedSize = int64(deletedSize)
+	retainUntil, legalHold := vol.Retention()
+	if !retainUntil.IsZero() {
+		vi.RetainUntil = retainUntil.Unix()
+	}
+	vi.LegalHold = legalHold
+	vi.Plaintext = vol.Plaintext()
+	return vi
 }
@@ -1,52 +1,137 @@
 package storage
 
-import "github.com/syndtr/goleveldb/leveldb"
+import (
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Index versions. A version 1 index stores the offsets in bytes, so it
+// can't address more than 4GiB. A version 2 index stores the offsets in
+// units of NeedlePaddingSize.
+const (
+	IndexVersion1       byte = 1
+	IndexVersion2       byte = 2
+	CurrentIndexVersion      = IndexVersion2
+)
+
+const KeyIndexVersion = "key.index.version"
+
+// MaxVolumeSize is the size of StoreFile the index can address
+const MaxVolumeSize = int64(1<<32) * NeedlePaddingSize
 
 type Mapping struct {
 	db *leveldb.DB
 }
 
+// NewLevelDBMapping opens the mapping, and migrates
+// an index of an older version to the current one
 func NewLevelDBMapping(filename string) (*Mapping, error) {
 	// kvs, err := raftkv.NewLevelDB(filename)
 	ldb, err := leveldb.OpenFile(filename, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &Mapping{db: ldb}, nil
+	m := &Mapping{db: ldb}
+	if err = m.migrate(); err != nil {
+		ldb.Close()
+		return nil, err
+	}
+	return m, nil
 }
 
-func (m *Mapping) Put(key uint64, cookie uint32, offset uint32, size uint32) error {
-	keyBytes := make([]byte, 12)
-	UInt64ToBytes(keyBytes[0:8], key)
-	UInt32ToBytes(keyBytes[8:12], cookie)
-	val := make([]byte, 8)
-	UInt32ToBytes(val[0:4], offset)
-	UInt32ToBytes(val[4:8], size)
-	return m.db.Put(keyBytes, val, nil)
+// migrate rewrites the offsets of a version 1 index in units of
+// NeedlePaddingSize. The entries and the new version are written in
+// one batch, so a crash leaves the index either migrated or not.
+func (m *Mapping) migrate() error {
+	versionBytes, err := m.db.Get([]byte(KeyIndexVersion), nil)
+	if err == nil {
+		if versionBytes[0] > CurrentIndexVersion {
+			return fmt.Errorf("unknown index version %d", versionBytes[0])
+		}
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	// an index without version is of version 1, or new
+	batch := new(leveldb.Batch)
+	iter := m.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if len(iter.Key()) != 12 {
+			continue
+		}
+		offset := BytesToUInt32(iter.Value()[0:4])
+		if offset%NeedlePaddingSize != 0 {
+			iter.Release()
+			return fmt.Errorf("offset %d is not aligned to %d", offset, NeedlePaddingSize)
+		}
+		val := make([]byte, 8)
+		copy(val, iter.Value())
+		UInt32ToBytes(val[0:4], offset/NeedlePaddingSize)
+		batch.Put(append([]byte{}, iter.Key()...), val)
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	batch.Put([]byte(KeyIndexVersion), []byte{CurrentIndexVersion})
+	return m.db.Write(batch, nil)
 }
 
-func (m *Mapping) Get(key uint64, cookie uint32) (offset uint32, size uint32, err error) {
-	keyBytes := make([]byte, 12)
-	UInt64ToBytes(keyBytes[0:8], key)
-	UInt32ToBytes(keyBytes[8:12], cookie)
-	val, err := m.db.Get(keyBytes, nil)
+// Put maps <key,cookie> to the needle at offset, which
+// must be aligned to NeedlePaddingSize and below MaxVolumeSize
+func (m *Mapping) Put(key uint64, cookie uint32, offset int64, size uint32) error {
+	val, err := encodeEntry(offset, size)
+	if err != nil {
+		return err
+	}
+	return m.db.Put(entryKey(key, cookie), val, nil)
+}
+
+func (m *Mapping) Get(key uint64, cookie uint32) (offset int64, size uint32, err error) {
+	val, err := m.db.Get(entryKey(key, cookie), nil)
 	if err != nil {
 		return 0, 0, err
 	}
-	return BytesToUInt32(val[0:4]), BytesToUInt32(val[4:8]), err
+	offset, size = decodeEntry(val)
+	return offset, size, nil
 }
 
-func (m *Mapping) Del(key uint64, cookie uint32) error {
+// entryKey returns the key of the mapping entry of <key,cookie>
+func entryKey(key uint64, cookie uint32) []byte {
 	keyBytes := make([]byte, 12)
 	UInt64ToBytes(keyBytes[0:8], key)
 	UInt32ToBytes(keyBytes[8:12], cookie)
-	return m.db.Delete(keyBytes, nil)
+	return keyBytes
+}
+
+// encodeEntry returns the mapping value of the needle at offset
+func encodeEntry(offset int64, size uint32) ([]byte, error) {
+	if offset%NeedlePaddingSize != 0 || offset >= MaxVolumeSize {
+		return nil, fmt.Errorf("offset %d can't be indexed", offset)
+	}
+	val := make([]byte, 8)
+	UInt32ToBytes(val[0:4], uint32(offset/NeedlePaddingSize))
+	UInt32ToBytes(val[4:8], size)
+	return val, nil
+}
+
+// decodeEntry returns the offset in bytes and the size of a mapping value
+func decodeEntry(val []byte) (offset int64, size uint32) {
+	return int64(BytesToUInt32(val[0:4])) * NeedlePaddingSize, BytesToUInt32(val[4:8])
+}
+
+func (m *Mapping) Del(key uint64, cookie uint32) error {
+	return m.db.Delete(entryKey(key, cookie), nil)
 }
 
 func (m *Mapping) Iter(mapIterFunc func(key uint64, cookie uint32) error) error {
 	iter := m.db.NewIterator(nil, nil)
 	for iter.Next() {
 		keyBytes := iter.Key()
+		if len(keyBytes) != 12 { // skip the volume metadata, e.g. KeyDeletedSize
+			continue
+		}
 		key := BytesToUInt64(keyBytes[0:8])
 		cookie := BytesToUInt32(keyBytes[8:12])
 		if err := mapIterFunc(key, cookie); err != nil {
@@ -56,3 +141,21 @@ func (m *Mapping) Iter(mapIterFunc func(key uint64, cookie uint32) error) error
 	iter.Release()
 	return iter.Error()
 }
+
+// IterEntries is like Iter, but also passes the offset and size of the needle
+func (m *Mapping) IterEntries(mapIterFunc func(key uint64, cookie uint32, offset int64, size uint32) error) error {
+	iter := m.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		keyBytes := iter.Key()
+		if len(keyBytes) != 12 {
+			continue
+		}
+		offset, size := decodeEntry(iter.Value())
+		err := mapIterFunc(BytesToUInt64(keyBytes[0:8]), BytesToUInt32(keyBytes[8:12]), offset, size)
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
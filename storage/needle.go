@@ -1,25 +1,43 @@
 package storage
 
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
 const (
 	NeedleHeaderSize   = 16 // NeedleHeaderSize = sizeof(Cookie)+sizeof(Key)+sizeof(Size)
 	NeedlePaddingSize  = 8  // Total needle size is aligned to 8 bytes
 	NeedleChecksumSize = 4
 	NeedleNameSize     = 256
+	NeedleExpiresSize  = 8
+)
+
+// Needle flags, only needles in version 2 volumes have flags
+const (
+	FlagHasTTL           byte = 1 << iota // the needle has an expiry time
+	FlagManifest                          // the needle data lists the chunks of a large file
+	FlagGzipped                           // the needle data is gzipped
+	FlagEncrypted                         // the needle data is the name and data encrypted
+	FlagContentAddressed                  // the key and cookie are derived from the SHA-256 of the content
 )
 
 // Needle is the unit stored in volume.
 // It contains header(Cookie, Key, Data Size),
-// file data, checksum, and padding.
+// file data, checksum, flags, optional fields, name and padding.
 type Needle struct {
-	Cookie   uint32
-	Key      uint64
-	Size     uint32 // the size of Data
-	Data     []byte
-	CheckSum uint32
-	NameSize uint8
-	Name     []byte
-	Padding  []byte
-	// TODO: Add more data
+	Cookie    uint32
+	Key       uint64
+	Size      uint32 // the size of Data
+	Data      []byte
+	CheckSum  uint32
+	Flags     byte
+	ExpiresAt uint64 // unix time in seconds, set when Flags has FlagHasTTL
+	NameSize  uint8
+	Name      []byte
 }
 
 // NewNeedle returns a new needle for volume
@@ -29,20 +47,175 @@ func NewNeedle(cookie uint32, key uint64, data []byte, name []byte) *Needle {
 		nameSize = 0
 		name = make([]byte, 0)
 	}
-	size := len(data)
-	needleSize := NeedleHeaderSize + size + NeedleChecksumSize + 1 + nameSize
 	return &Needle{
 		Cookie:   cookie,
 		Key:      key,
-		Size:     uint32(size),
+		Size:     uint32(len(data)),
 		Data:     data,
 		CheckSum: newCheckSum(data),
 		NameSize: uint8(nameSize),
 		Name:     name,
-		Padding:  make([]byte, NeedlePaddingSize-(needleSize)%NeedlePaddingSize),
 	}
 }
 
-func (n *Needle) fullSize() uint32 {
-	return NeedleHeaderSize + n.Size + NeedleChecksumSize + 1 + uint32(n.NameSize)
+// SetExpiresAt makes the needle expire at the given time
+func (n *Needle) SetExpiresAt(t time.Time) {
+	n.Flags |= FlagHasTTL
+	n.ExpiresAt = uint64(t.Unix())
+}
+
+// SetManifest marks the needle as the chunk manifest of a large file
+func (n *Needle) SetManifest() {
+	n.Flags |= FlagManifest
+}
+
+// IsManifest reports whether the needle is a chunk manifest
+func (n *Needle) IsManifest() bool {
+	return n.Flags&FlagManifest != 0
+}
+
+// Gzip compresses the needle data, unless compressing doesn't make it smaller
+func (n *Needle) Gzip() error {
+	if n.IsGzipped() {
+		return nil
+	}
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	if _, err := gw.Write(n.Data); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	if b.Len() >= len(n.Data) {
+		return nil
+	}
+	n.SetGzipped(b.Bytes())
+	return nil
+}
+
+// SetGzipped sets the needle data to data already gzipped
+func (n *Needle) SetGzipped(data []byte) {
+	n.Flags |= FlagGzipped
+	n.Data = data
+	n.Size = uint32(len(data))
+	n.CheckSum = newCheckSum(data)
+}
+
+// IsGzipped reports whether the needle data is gzipped
+func (n *Needle) IsGzipped() bool {
+	return n.Flags&FlagGzipped != 0
+}
+
+// Content returns the needle data, decompressed if it's gzipped
+func (n *Needle) Content() ([]byte, error) {
+	if !n.IsGzipped() {
+		return n.Data, nil
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(n.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
+
+// SetContentAddressed marks the needle's key and cookie as derived from its content
+func (n *Needle) SetContentAddressed() {
+	n.Flags |= FlagContentAddressed
+}
+
+// IsContentAddressed reports whether the needle's key and cookie are derived from its content
+func (n *Needle) IsContentAddressed() bool {
+	return n.Flags&FlagContentAddressed != 0
+}
+
+// Expired reports whether the needle has outlived its TTL
+func (n *Needle) Expired() bool {
+	return n.Flags&FlagHasTTL != 0 && uint64(time.Now().Unix()) >= n.ExpiresAt
+}
+
+func (n *Needle) fullSize(version byte) uint32 {
+	size := NeedleHeaderSize + n.Size + NeedleChecksumSize + 1 + uint32(n.NameSize)
+	if version >= Version2 {
+		size++ // flags
+		if n.Flags&FlagHasTTL != 0 {
+			size += NeedleExpiresSize
+		}
+	}
+	return size
+}
+
+// marshal returns the bytes of the needle in the given volume version,
+// padded to NeedlePaddingSize
+func (n *Needle) marshal(version byte) []byte {
+	size := n.fullSize(version)
+	if size%NeedlePaddingSize != 0 {
+		size += NeedlePaddingSize - size%NeedlePaddingSize
+	}
+	b := make([]byte, size)
+	UInt32ToBytes(b[0:4], n.Cookie)
+	UInt64ToBytes(b[4:12], n.Key)
+	UInt32ToBytes(b[12:16], n.Size)
+	i := uint32(NeedleHeaderSize)
+	i += uint32(copy(b[i:], n.Data))
+	UInt32ToBytes(b[i:i+4], n.CheckSum)
+	i += NeedleChecksumSize
+	if version >= Version2 {
+		b[i] = n.Flags
+		i++
+		if n.Flags&FlagHasTTL != 0 {
+			UInt64ToBytes(b[i:i+8], n.ExpiresAt)
+			i += NeedleExpiresSize
+		}
+	}
+	b[i] = n.NameSize
+	copy(b[i+1:], n.Name)
+	return b
+}
+
+// unmarshalNeedle parses the needle bytes read from a volume of the given version
+func unmarshalNeedle(b []byte, version byte) (*Needle, error) {
+	if len(b) < NeedleHeaderSize {
+		return nil, errors.New("needle too short")
+	}
+	n := &Needle{
+		Cookie: BytesToUInt32(b[0:4]),
+		Key:    BytesToUInt64(b[4:12]),
+		Size:   BytesToUInt32(b[12:NeedleHeaderSize]),
+	}
+	i := uint64(NeedleHeaderSize) + uint64(n.Size)
+	if i+NeedleChecksumSize > uint64(len(b)) {
+		return nil, errors.New("needle too short")
+	}
+	n.Data = b[NeedleHeaderSize:i]
+	n.CheckSum = BytesToUInt32(b[i : i+NeedleChecksumSize])
+	if n.CheckSum != newCheckSum(n.Data) {
+		return nil, errors.New("data on disk corrupted")
+	}
+	i += NeedleChecksumSize
+	if version >= Version2 {
+		if i >= uint64(len(b)) {
+			return nil, errors.New("needle too short")
+		}
+		n.Flags = b[i]
+		i++
+		if n.Flags&FlagHasTTL != 0 {
+			if i+NeedleExpiresSize > uint64(len(b)) {
+				return nil, errors.New("needle too short")
+			}
+			n.ExpiresAt = BytesToUInt64(b[i : i+NeedleExpiresSize])
+			i += NeedleExpiresSize
+		}
+	}
+	if i >= uint64(len(b)) {
+		return nil, errors.New("needle too short")
+	}
+	n.NameSize = b[i]
+	i++
+	if i+uint64(n.NameSize) > uint64(len(b)) {
+		return nil, errors.New("needle too short")
+	}
+	n.Name = b[i : i+uint64(n.NameSize)]
+	return n, nil
 }
@@ -7,10 +7,13 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/lilwulin/rabbitfs/helper"
+	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/visionmedia/go-bench"
 )
 
@@ -55,8 +58,9 @@ func TestBehavior(t *testing.T) {
 	fmt.Println("Create Volume")
 	volTest, err = NewVolume(0, file, "./test_mapping", 0.4)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer volTest.Close()
 
 	fmt.Println("Get non-existent key-cookie")
 	if _, _, err = volTest.mapping.Get(1024, 1024); err == nil {
@@ -127,8 +131,8 @@ func TestBehavior(t *testing.T) {
 	}
 
 	fmt.Println("Delete Needle 1")
-	oldFileInfo, _ := volTest.StoreFile.Stat()
-	fmt.Println("the old StoreFile size is ", oldFileInfo.Size())
+	oldSize, _ := volTest.Size()
+	fmt.Println("the old StoreFile size is ", oldSize)
 	if err := volTest.DelNeedle(uint64(testKey1), testCookie1); err != nil {
 		t.Error(err)
 	}
@@ -138,12 +142,13 @@ func TestBehavior(t *testing.T) {
 	} else {
 		fmt.Println(err)
 	}
-	time.Sleep(200 * time.Millisecond)
-	newFileInfo, _ := volTest.StoreFile.Stat()
-	fmt.Println("the new StoreFile size is ", newFileInfo.Size())
-	if oldFileInfo.Size() <= newFileInfo.Size() {
+	// the StoreFile is swapped by the compaction, its size is read through the volume
+	waitCompaction(t, volTest)
+	newSize, _ := volTest.Size()
+	fmt.Println("the new StoreFile size is ", newSize)
+	if oldSize <= newSize {
 		t.Errorf("expect old StoreFile size to be bigger than new StoreFile size, but got old size:%d, new size:%d\n",
-			oldFileInfo.Size(), newFileInfo.Size())
+			oldSize, newSize)
 	}
 	fmt.Println("Get Needle 2")
 	if n2O, err = volTest.GetNeedle(uint64(testKey2), testCookie2); err != nil {
@@ -156,13 +161,27 @@ func TestBehavior(t *testing.T) {
 	}
 }
 
+// waitCompaction waits for the compaction vol started by itself to finish
+func waitCompaction(t *testing.T, vol *Volume) {
+	for i := 0; i < 500; i++ {
+		if status := vol.CompactionStatus(); !status.FinishedAt.IsZero() {
+			if status.Error != "" {
+				t.Error(status.Error)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expect the volume to be compacted")
+}
+
 type idCookie struct {
 	id     uint64
 	cookie uint32
 }
 
 type offsetSize struct {
-	offset uint32
+	offset int64
 	size   uint32
 }
 
@@ -204,38 +223,1062 @@ var memMapping = map[idCookie]offsetSize{}
 
 func TestCleanProcess(t *testing.T) {
 	printTestInfo("TESTING CLEANING PROCESS")
-	defer helper.RemoveDirs("./testData/data", "./test_mapping")
+	defer helper.RemoveDirs("./testData/data_clean", "./test_mapping_clean")
 	f1DataI, err := ioutil.ReadFile(path.Join(inputPath, pic1Name))
 	if err != nil {
 		t.Error(err)
 	}
-	file, err := os.OpenFile("./testData/data", os.O_RDWR|os.O_CREATE, 0644)
+	file, err := os.OpenFile("./testData/data_clean", os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		t.Error(err)
 	}
-	volTest, err = NewVolume(0, file, "./test_mapping", 0.4)
+	vol, err := NewVolume(0, file, "./test_mapping_clean", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	// the compaction is started by hand, so that the test knows when it's over
+	vol.SetAutoCompact(false)
 
 	for i := 0; i < 1500; i++ {
 		n := NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))
-		if err := volTest.AppendNeedle(n); err != nil {
+		if err := vol.AppendNeedle(n); err != nil {
 			t.Error(err)
 		}
-		o, s, _ := volTest.mapping.Get(uint64(i), uint32(i))
+		o, s, _ := vol.mapping.Get(uint64(i), uint32(i))
 		memMapping[idCookie{id: uint64(i), cookie: uint32(i)}] = offsetSize{offset: o, size: s}
 	}
 
+	done, err := vol.StartCompaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
 	for i := 0; i < 1400; i++ {
-		if err := volTest.DelNeedle(uint64(i), uint32(i)); err != nil {
+		if err := vol.DelNeedle(uint64(i), uint32(i)); err != nil {
 			t.Error(err)
 		}
-		go func(i int, t *testing.T) {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
 			n := NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))
-			if err := volTest.AppendNeedle(n); err != nil {
+			if err := vol.AppendNeedle(n); err != nil {
 				t.Error(err)
 			}
-		}(i, t)
+		}(i)
+	}
+	wg.Wait()
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+	// the needles deleted and appended again while compacting are kept
+	for i := 0; i < 1500; i++ {
+		if n, err := vol.GetNeedle(uint64(i), uint32(i)); err != nil {
+			t.Error(err)
+		} else if bytes.Compare(n.Data, f1DataI) != 0 {
+			t.Error("data should be the same after compaction")
+		}
+	}
+	if count := vol.FileCount(); count != 1500 {
+		t.Errorf("expect 1500 files, get %d", count)
+	}
+}
+
+func TestReadOnlyAndMaxSize(t *testing.T) {
+	printTestInfo("TESTING READ-ONLY AND MAX SIZE")
+	defer helper.RemoveDirs("./testData/data_readonly", "./test_mapping_readonly")
+	vol, f1DataI := getVolAndData("readonly")
+	defer vol.Close()
+	vol.SetMaxSize(int64(len(f1DataI)) + NeedlePaddingSize*64)
+	if err := vol.AppendNeedle(NewNeedle(1, 1, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	if err := vol.AppendNeedle(NewNeedle(2, 2, f1DataI, []byte(pic1Name))); err == nil {
+		t.Error("expect volume full error")
+	}
+	vol.SetMaxSize(0)
+	vol.SetReadOnly(true)
+	if err := vol.AppendNeedle(NewNeedle(3, 3, f1DataI, []byte(pic1Name))); err == nil {
+		t.Error("expect read-only error")
+	}
+	if _, err := vol.GetNeedle(1, 1); err != nil {
+		t.Error(err)
+	}
+	vol.SetReadOnly(false)
+	if err := vol.AppendNeedle(NewNeedle(3, 3, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	if count := vol.FileCount(); count != 2 {
+		t.Errorf("expect 2 files, get %d", count)
+	}
+}
+
+func TestCopyVolume(t *testing.T) {
+	printTestInfo("TESTING COPY VOLUME")
+	defer helper.RemoveDirs("./testData/data_copy_src", "./test_mapping_copy_src", "./testData/data_copy", "./test_mapping_copy")
+	vol, f1DataI := getVolAndData("copy_src")
+	defer vol.Close()
+	vol.SetAutoCompact(false)
+	for i := 0; i < 10; i++ {
+		if err := vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := vol.DelNeedle(3, 3); err != nil {
+		t.Error(err)
+	}
+	var data, index bytes.Buffer
+	if _, err := vol.WriteDataTo(&data, 0); err != nil {
+		t.Error(err)
+	}
+	if err := vol.WriteIndexTo(&index); err != nil {
+		t.Error(err)
+	}
+	file, err := os.OpenFile("./testData/data_copy", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Error(err)
+	}
+	volCopy, err := NewVolume(0, file, "./test_mapping_copy", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer volCopy.Close()
+	if _, err = volCopy.AppendData(&data); err != nil {
+		t.Error(err)
+	}
+	if err = volCopy.ReadIndexFrom(&index); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 10; i++ {
+		n, err := volCopy.GetNeedle(uint64(i), uint32(i))
+		if i == 3 {
+			if err == nil {
+				t.Error("expect deleted needle to be missing in the copy")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+		} else if bytes.Compare(n.Data, f1DataI) != 0 {
+			t.Error("copied data should be the same")
+		}
+	}
+	// catch up on the needles appended and deleted after copying
+	if err = vol.AppendNeedle(NewNeedle(10, 10, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	if err = vol.DelNeedle(4, 4); err != nil {
+		t.Error(err)
+	}
+	if volCopy.Generation() != vol.Generation() {
+		t.Error("expect the copy to have the same generation")
+	}
+	size, _ := volCopy.Size()
+	data.Reset()
+	index.Reset()
+	if _, err = vol.WriteChangesTo(&data, size, volCopy.Generation()); err != nil {
+		t.Error(err)
+	}
+	if _, err = volCopy.AppendData(&data); err != nil {
+		t.Error(err)
+	}
+	if err = vol.WriteIndexTo(&index); err != nil {
+		t.Error(err)
+	}
+	if err = volCopy.ReadIndexFrom(&index); err != nil {
+		t.Error(err)
+	}
+	if _, err = volCopy.GetNeedle(10, 10); err != nil {
+		t.Error(err)
+	}
+	if _, err = volCopy.GetNeedle(4, 4); err == nil {
+		t.Error("expect needle deleted after copying to be missing in the copy")
+	}
+	// the copy keeps appending after the copied needles
+	if err = volCopy.AppendNeedle(NewNeedle(11, 11, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	if _, err = volCopy.GetNeedle(0, 0); err != nil {
+		t.Error(err)
+	}
+	// the bytes copied are gone once vol is compacted
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if vol.Generation() == volCopy.Generation() {
+		t.Error("expect compaction to change the generation")
+	}
+	size, _ = volCopy.Size()
+	data.Reset()
+	if _, err = vol.WriteChangesTo(&data, size, volCopy.Generation()); err != ErrCompacted {
+		t.Errorf("expect ErrCompacted, get %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	printTestInfo("TESTING TTL")
+	defer helper.RemoveDirs("./testData/data_ttl", "./test_mapping_ttl")
+	file, _ := os.OpenFile("./testData/data_ttl", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_ttl", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	expired := NewNeedle(1, 1, f1DataI, []byte(pic1Name))
+	expired.SetExpiresAt(time.Now().Add(-time.Minute))
+	alive := NewNeedle(2, 2, f1DataI, []byte(pic1Name))
+	alive.SetExpiresAt(time.Now().Add(time.Hour))
+	for _, n := range []*Needle{expired, alive} {
+		if err := vol.AppendNeedle(n); err != nil {
+			t.Error(err)
+		}
+	}
+	n, err := vol.GetNeedle(1, 1)
+	if err != nil {
+		t.Error(err)
+	} else if !n.Expired() {
+		t.Error("expect needle 1 to be expired")
+	}
+	if n, err = vol.GetNeedle(2, 2); err != nil {
+		t.Error(err)
+	} else if n.Expired() || n.ExpiresAt != alive.ExpiresAt {
+		t.Error("expect needle 2 to keep its expiry time")
+	}
+	// compaction drops the expired needles
+	if err = vol.Compact(); err != nil {
+		t.Error(err)
+	}
+	if _, err = vol.GetNeedle(1, 1); err == nil {
+		t.Error("expect expired needle to be reclaimed")
+	}
+	if _, err = vol.GetNeedle(2, 2); err != nil {
+		t.Error(err)
+	}
+	if count := vol.FileCount(); count != 1 {
+		t.Errorf("expect 1 file, get %d", count)
+	}
+}
+
+func TestGzipNeedle(t *testing.T) {
+	printTestInfo("TESTING GZIP NEEDLE")
+	defer helper.RemoveDirs("./testData/data_gzip", "./test_mapping_gzip")
+	file, _ := os.OpenFile("./testData/data_gzip", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_gzip", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte(`{"name":"rabbitfs","kind":"json"}`), 100)
+	n := NewNeedle(1, 1, text, []byte("a.json"))
+	if err = n.Gzip(); err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsGzipped() || len(n.Data) >= len(text) {
+		t.Errorf("expect %d bytes of text to be gzipped, get %d bytes", len(text), len(n.Data))
+	}
+	// jpeg data doesn't get smaller
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	pic := NewNeedle(2, 2, f1DataI, []byte(pic1Name))
+	if err = pic.Gzip(); err != nil {
+		t.Fatal(err)
+	}
+	if pic.IsGzipped() {
+		t.Error("expect the picture to stay raw")
+	}
+	for _, n := range []*Needle{n, pic} {
+		if err = vol.AppendNeedle(n); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = vol.Compact(); err != nil {
+		t.Error(err)
+	}
+	for _, expect := range []struct {
+		id      uint64
+		gzipped bool
+		data    []byte
+	}{{1, true, text}, {2, false, f1DataI}} {
+		n, err := vol.GetNeedle(expect.id, uint32(expect.id))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if n.IsGzipped() != expect.gzipped {
+			t.Errorf("expect needle %d gzipped to be %v", expect.id, expect.gzipped)
+		}
+		if data, err := n.Content(); err != nil {
+			t.Error(err)
+		} else if bytes.Compare(data, expect.data) != 0 {
+			t.Errorf("expect needle %d to read back its data", expect.id)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	printTestInfo("TESTING DEDUP")
+	defer helper.RemoveDirs("./testData/data_dedup", "./test_mapping_dedup")
+	file, _ := os.OpenFile("./testData/data_dedup", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_dedup", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol.SetAutoCompact(false)
+	vol.SetDedup(true)
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	f2DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic2Name))
+	for i := 1; i <= 3; i++ {
+		if err = vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = vol.AppendNeedle(NewNeedle(4, 4, f2DataI, []byte(pic2Name))); err != nil {
+		t.Fatal(err)
+	}
+	pic1Size := paddedSize(NewNeedle(1, 1, f1DataI, []byte(pic1Name)).fullSize(CurrentVersion))
+	pic2Size := paddedSize(NewNeedle(4, 4, f2DataI, []byte(pic2Name)).fullSize(CurrentVersion))
+	if size, _ := vol.Size(); size != superBlockSize+pic1Size+pic2Size {
+		t.Errorf("expect the identical files to be stored once, volume size %d", size)
+	}
+	if count := vol.FileCount(); count != 4 {
+		t.Errorf("expect 4 files, get %d", count)
+	}
+	// deleting the file the needle was written for keeps it for the others
+	if err = vol.DelNeedle(1, 1); err != nil {
+		t.Error(err)
+	}
+	if deletedSize, _ := vol.DeletedSize(); deletedSize != 0 {
+		t.Errorf("expect no garbage while the needle is shared, get %d", deletedSize)
+	}
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := vol.Size(); size != superBlockSize+pic1Size+pic2Size {
+		t.Errorf("expect compaction to keep the needle shared, volume size %d", size)
+	}
+	for i := 2; i <= 3; i++ {
+		if n, err := vol.GetNeedle(uint64(i), uint32(i)); err != nil {
+			t.Error(err)
+		} else if bytes.Compare(n.Data, f1DataI) != 0 {
+			t.Error("data should be the same")
+		}
+	}
+	// the references survive compaction
+	for i := 2; i <= 3; i++ {
+		if err = vol.DelNeedle(uint64(i), uint32(i)); err != nil {
+			t.Error(err)
+		}
+	}
+	if deletedSize, _ := vol.DeletedSize(); deletedSize != uint64(NewNeedle(1, 1, f1DataI, []byte(pic1Name)).fullSize(CurrentVersion)) {
+		t.Errorf("expect the needle to be garbage once unreferenced, get %d", deletedSize)
+	}
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := vol.Size(); size != superBlockSize+pic2Size {
+		t.Errorf("expect the needle to be reclaimed, volume size %d", size)
+	}
+	// the content is indexed again once reclaimed
+	if err = vol.AppendNeedle(NewNeedle(5, 5, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	if n, err := vol.GetNeedle(5, 5); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(n.Data, f1DataI) != 0 {
+		t.Error("data should be the same")
+	}
+	vol.Close()
+}
+
+func TestVersioning(t *testing.T) {
+	printTestInfo("TESTING VERSIONING")
+	defer helper.RemoveDirs("./testData/data_ver", "./test_mapping_ver", "./testData/data_ver_copy", "./test_mapping_ver_copy")
+	file, _ := os.OpenFile("./testData/data_ver", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_ver", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol.SetAutoCompact(false)
+	content := func(i int) []byte { return []byte(fmt.Sprintf("version %d of the file", i)) }
+	if err = vol.AppendNeedle(NewNeedle(1, 1, content(1), []byte("file.txt"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.AppendNeedle(NewNeedle(1, 1, content(2), []byte("file.txt"))); err == nil {
+		t.Error("expect overwriting to be refused without versioning")
+	}
+	vol.SetVersions(3)
+	for i := 2; i <= 4; i++ {
+		if err = vol.AppendNeedle(NewNeedle(1, 1, content(i), []byte("file.txt"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := vol.FileCount(); count != 1 {
+		t.Errorf("expect 1 file, get %d", count)
+	}
+	if versions, err := vol.Versions(1, 1); err != nil {
+		t.Error(err)
+	} else if fmt.Sprint(versions) != "[2 3 4]" {
+		t.Errorf("expect versions [2 3 4], get %v", versions)
+	}
+	if n, err := vol.GetNeedle(1, 1); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(n.Data, content(4)) != 0 {
+		t.Error("expect the latest version")
+	}
+	if n, err := vol.GetNeedleVersion(1, 1, 2); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(n.Data, content(2)) != 0 {
+		t.Error("expect version 2")
+	}
+	// the version beyond the limit is garbage
+	if _, err = vol.GetNeedleVersion(1, 1, 1); err != leveldb.ErrNotFound {
+		t.Errorf("expect version 1 to be dropped, get %v", err)
+	}
+	if deletedSize, _ := vol.DeletedSize(); deletedSize != uint64(NewNeedle(1, 1, content(1), []byte("file.txt")).fullSize(CurrentVersion)) {
+		t.Errorf("expect version 1 to be garbage, get %d", deletedSize)
+	}
+	manifest := NewNeedle(2, 2, []byte("{}"), []byte("large"))
+	manifest.SetManifest()
+	if err = vol.AppendNeedle(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.AppendNeedle(NewNeedle(2, 2, content(1), []byte("large"))); err == nil {
+		t.Error("expect overwriting a manifest to be refused")
+	}
+	// compaction keeps the versions under the new limit
+	vol.SetVersions(2)
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := vol.Versions(1, 1); err != nil {
+		t.Error(err)
+	} else if fmt.Sprint(versions) != "[3 4]" {
+		t.Errorf("expect versions [3 4] after compaction, get %v", versions)
+	}
+	if n, err := vol.GetNeedleVersion(1, 1, 3); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(n.Data, content(3)) != 0 {
+		t.Error("expect version 3")
+	}
+	// copies of the volume keep the versions
+	copyFile, _ := os.OpenFile("./testData/data_ver_copy", os.O_RDWR|os.O_CREATE, 0644)
+	copyVol, err := NewVolume(0, copyFile, "./test_mapping_ver_copy", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data, index bytes.Buffer
+	if _, err = vol.WriteDataTo(&data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.WriteIndexTo(&index); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = copyVol.AppendData(&data); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyVol.ReadIndexFrom(&index); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := copyVol.GetNeedleVersion(1, 1, 3); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(n.Data, content(3)) != 0 {
+		t.Error("expect version 3 in the copy")
+	}
+	copyVol.Close()
+	// deleting the file deletes its versions
+	if err = vol.DelNeedle(1, 1); err != nil {
+		t.Error(err)
+	}
+	if _, err = vol.GetNeedleVersion(1, 1, 3); err == nil {
+		t.Error("expect the versions to be deleted with the file")
+	}
+	if count := vol.FileCount(); count != 1 {
+		t.Errorf("expect 1 file, get %d", count)
+	}
+	vol.Close()
+}
+
+func TestSoftDelete(t *testing.T) {
+	printTestInfo("TESTING SOFT DELETE")
+	defer helper.RemoveDirs("./testData/data_soft", "./test_mapping_soft", "./testData/data_soft_copy", "./test_mapping_soft_copy")
+	file, _ := os.OpenFile("./testData/data_soft", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_soft", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol.SetAutoCompact(false)
+	vol.SetSoftDelete(time.Hour)
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	f2DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic2Name))
+	for i := 1; i <= 2; i++ {
+		if err = vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = vol.DelNeedle(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vol.GetNeedle(1, 1); err == nil {
+		t.Error("expect the deleted file to be hidden")
+	}
+	if deletedSize, _ := vol.DeletedSize(); deletedSize != 0 {
+		t.Errorf("expect no garbage within the window, get %d", deletedSize)
+	}
+	if count := vol.FileCount(); count != 1 {
+		t.Errorf("expect 1 file, get %d", count)
+	}
+	// the deleted file survives compaction and copying
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	copyFile, _ := os.OpenFile("./testData/data_soft_copy", os.O_RDWR|os.O_CREATE, 0644)
+	copyVol, err := NewVolume(0, copyFile, "./test_mapping_soft_copy", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyVol.SetSoftDelete(time.Hour)
+	var data, index bytes.Buffer
+	vol.WriteDataTo(&data, 0)
+	vol.WriteIndexTo(&index)
+	if _, err = copyVol.AppendData(&data); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyVol.ReadIndexFrom(&index); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []*Volume{vol, copyVol} {
+		if err = v.Undelete(1, 1); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := v.GetNeedle(1, 1); err != nil {
+			t.Error(err)
+		} else if bytes.Compare(n.Data, f1DataI) != 0 {
+			t.Error("data should be the same")
+		}
+	}
+	copyVol.Close()
+	if count := vol.FileCount(); count != 2 {
+		t.Errorf("expect 2 files, get %d", count)
 	}
+	if err = vol.Undelete(1, 1); err != nil {
+		t.Errorf("expect undeleting a file not deleted to do nothing, get %v", err)
+	}
+	// a file written again once deleted replaces the deleted one
+	if err = vol.DelNeedle(2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.AppendNeedle(NewNeedle(2, 2, f2DataI, []byte(pic2Name))); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := vol.GetNeedle(2, 2); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(n.Data, f2DataI) != 0 {
+		t.Error("expect the file written again")
+	}
+	// past the window the deleted files are purged
+	if err = vol.DelNeedle(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	vol.SetSoftDelete(0)
+	if purged, err := vol.PurgeDeleted(); err != nil || purged != 1 {
+		t.Errorf("expect 1 file purged, get %d, %v", purged, err)
+	}
+	if err = vol.Undelete(1, 1); err == nil {
+		t.Error("expect undeleting a purged file to fail")
+	}
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	pic2Size := paddedSize(NewNeedle(2, 2, f2DataI, []byte(pic2Name)).fullSize(CurrentVersion))
+	if size, _ := vol.Size(); size != superBlockSize+pic2Size {
+		t.Errorf("expect the deleted files to be reclaimed, volume size %d", size)
+	}
+	vol.Close()
+}
+
+func TestRetention(t *testing.T) {
+	printTestInfo("TESTING RETENTION")
+	defer helper.RemoveDirs("./testData/data_retain", "./test_mapping_retain")
+	file, _ := os.OpenFile("./testData/data_retain", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_retain", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol.SetAutoCompact(false)
+	vol.SetVersions(2)
+	vol.SetSoftDelete(time.Hour)
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	f2DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic2Name))
+	for i := 1; i <= 2; i++ {
+		if err = vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = vol.DelNeedle(2, 2); err != nil {
+		t.Fatal(err)
+	}
+	retainUntil := time.Now().Add(time.Hour)
+	vol.SetRetention(retainUntil, false)
+	if !vol.Held() {
+		t.Fatal("expect the volume held")
+	}
+	if err = vol.DelNeedle(1, 1); err != ErrHeld {
+		t.Errorf("expect deleting to be refused, get %v", err)
+	}
+	if err = vol.AppendNeedle(NewNeedle(1, 1, f2DataI, []byte(pic2Name))); err != ErrHeld {
+		t.Errorf("expect overwriting to be refused, get %v", err)
+	}
+	if err = vol.AppendNeedle(NewNeedle(2, 2, f2DataI, []byte(pic2Name))); err != ErrHeld {
+		t.Errorf("expect replacing a deleted file to be refused, get %v", err)
+	}
+	if err = vol.Compact(); err != ErrHeld {
+		t.Errorf("expect compacting to be refused, get %v", err)
+	}
+	vol.SetSoftDelete(0)
+	if purged, err := vol.PurgeDeleted(); err != nil || purged != 0 {
+		t.Errorf("expect no file purged, get %d, %v", purged, err)
+	}
+	// a file deleted before the hold can still be undeleted
+	vol.SetSoftDelete(time.Hour)
+	if err = vol.Undelete(2, 2); err != nil {
+		t.Error(err)
+	}
+	if n, err := vol.GetNeedle(1, 1); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(n.Data, f1DataI) != 0 {
+		t.Error("expect the held file unchanged")
+	}
+	// the retention date can't be brought forward
+	vol.SetRetention(time.Now().Add(-time.Hour), false)
+	if until, _ := vol.Retention(); until.Unix() != retainUntil.Unix() {
+		t.Errorf("expect retention until %v, get %v", retainUntil, until)
+	}
+	vol.retainUntil = 0
+	vol.SetRetention(time.Time{}, true)
+	if err = vol.DelNeedle(1, 1); err != ErrHeld {
+		t.Errorf("expect deleting under legal hold to be refused, get %v", err)
+	}
+	vol.SetRetention(time.Time{}, false)
+	if vol.Held() {
+		t.Fatal("expect the hold lifted")
+	}
+	if err = vol.DelNeedle(1, 1); err != nil {
+		t.Error(err)
+	}
+	if err = vol.Compact(); err != nil {
+		t.Error(err)
+	}
+	vol.Close()
+}
+
+func TestEncryption(t *testing.T) {
+	printTestInfo("TESTING ENCRYPTION")
+	defer helper.RemoveDirs("./testData/data_crypt", "./test_mapping_crypt", "./testData/data_crypt_copy", "./test_mapping_crypt_copy")
+	masterKey := bytes.Repeat([]byte{7}, DataKeySize)
+	file, _ := os.OpenFile("./testData/data_crypt", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_crypt", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol.SetAutoCompact(false)
+	if err = vol.SetMasterKey(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("the secret content of a customer file")
+	for i := 1; i <= 2; i++ {
+		if err = vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), secret, []byte("secret.txt"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, _ := ioutil.ReadFile("./testData/data_crypt")
+	if bytes.Contains(raw, secret) || bytes.Contains(raw, []byte("secret.txt")) {
+		t.Error("expect the data and the name encrypted on disk")
+	}
+	checkNeedle := func(vol *Volume, id uint64) {
+		n, err := vol.GetNeedle(id, uint32(id))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(n.Data, secret) || string(n.Name) != "secret.txt" {
+			t.Errorf("expect needle %d decrypted, get %q named %q", id, n.Data, n.Name)
+		}
+	}
+	checkNeedle(vol, 1)
+	keys, _ := vol.WrappedDataKeys()
+	// compaction encrypts the needles under a new data key
+	if err = vol.DelNeedle(2, 2); err != nil {
+		t.Error(err)
+	}
+	if err = vol.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkNeedle(vol, 1)
+	rotated, _ := vol.WrappedDataKeys()
+	if len(rotated) != 1 {
+		t.Errorf("expect 1 data key after compaction, get %d", len(rotated))
+	}
+	for id := range rotated {
+		if keys[id] != nil {
+			t.Error("expect compaction to rotate the data key")
+		}
+	}
+	// a copy reads the needles with the data keys of the volume
+	copyFile, _ := os.OpenFile("./testData/data_crypt_copy", os.O_RDWR|os.O_CREATE, 0644)
+	copyVol, err := NewVolume(0, copyFile, "./test_mapping_crypt_copy", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = copyVol.SetMasterKey(bytes.Repeat([]byte{8}, DataKeySize)); err != nil {
+		t.Fatal(err)
+	}
+	// the data keys travel wrapped, another master key can't unwrap them
+	if err = copyVol.AddWrappedDataKeys(rotated); err == nil {
+		t.Error("expect the data keys of another master key to fail")
+	}
+	copyVol.Destroy()
+	copyFile, _ = os.OpenFile("./testData/data_crypt_copy", os.O_RDWR|os.O_CREATE, 0644)
+	if copyVol, err = NewVolume(0, copyFile, "./test_mapping_crypt_copy", 0.4); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyVol.SetMasterKey(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	var data, index bytes.Buffer
+	vol.WriteDataTo(&data, 0)
+	vol.WriteIndexTo(&index)
+	copyVol.AppendData(&data)
+	if err = copyVol.AddWrappedDataKeys(rotated); err != nil {
+		t.Error(err)
+	}
+	if err = copyVol.ReadIndexFrom(&index); err != nil {
+		t.Error(err)
+	}
+	checkNeedle(copyVol, 1)
+	copyVol.Close()
+	// reopening needs the master key
+	vol.Close()
+	file, _ = os.OpenFile("./testData/data_crypt", os.O_RDWR, 0644)
+	if vol, err = NewVolume(0, file, "./test_mapping_crypt", 0.4); err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	if err = vol.SetMasterKey(bytes.Repeat([]byte{8}, DataKeySize)); err == nil {
+		t.Error("expect a wrong master key to fail")
+	}
+	if err = vol.SetMasterKey(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	checkNeedle(vol, 1)
+}
 
+func TestDedupEncryption(t *testing.T) {
+	printTestInfo("TESTING DEDUP ACROSS ENCRYPTION")
+	defer helper.RemoveDirs("./testData/data_dedup_crypt", "./test_mapping_dedup_crypt")
+	file, _ := os.OpenFile("./testData/data_dedup_crypt", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_dedup_crypt", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	vol.SetAutoCompact(false)
+	vol.SetDedup(true)
+	content := []byte("the content stored in plain text before the volume got a key")
+	plain := NewNeedle(1, 1, content, []byte("plain.txt"))
+	if err = vol.AppendNeedle(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.SetMasterKey(bytes.Repeat([]byte{7}, DataKeySize)); err != nil {
+		t.Fatal(err)
+	}
+	// the needle is shared as it's stored, in plain text
+	if err = vol.AppendNeedle(NewNeedle(2, 2, content, []byte("plain.txt"))); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := vol.Size(); size != superBlockSize+paddedSize(plain.fullSize(CurrentVersion)) {
+		t.Errorf("expect the content to be stored once, volume size %d", size)
+	}
+	for id := uint64(1); id <= 2; id++ {
+		if n, err := vol.GetNeedle(id, uint32(id)); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(n.Data, content) {
+			t.Errorf("expect needle %d to read the shared content, get %q", id, n.Data)
+		}
+	}
+	for id := uint64(1); id <= 2; id++ {
+		if err = vol.DelNeedle(id, uint32(id)); err != nil {
+			t.Error(err)
+		}
+	}
+	if deletedSize, _ := vol.DeletedSize(); deletedSize != uint64(plain.fullSize(CurrentVersion)) {
+		t.Errorf("expect the plain needle to be garbage once unreferenced, get %d", deletedSize)
+	}
+}
+
+func TestCompactionRecovery(t *testing.T) {
+	printTestInfo("TESTING COMPACTION RECOVERY")
+	dataPath, mapPath := "./testData/data_recovery", "./test_mapping_recovery"
+	defer helper.RemoveDirs(dataPath, mapPath, dataPath+compactSuffix, mapPath+compactSuffix, dataPath+compactMarkerSuffix)
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	openVol := func(dataPath string, mapPath string) *Volume {
+		file, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vol, err := NewVolume(0, file, mapPath, 0.4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vol
+	}
+	closeVol := func(vol *Volume) {
+		vol.StoreFile.Close()
+		vol.mapping.db.Close()
+	}
+	vol := openVol(dataPath, mapPath)
+	for i := 1; i <= 2; i++ {
+		if err := vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))); err != nil {
+			t.Error(err)
+		}
+	}
+	closeVol(vol)
+	// crashed before committing, the compacted files are dropped
+	compacted := openVol(dataPath+compactSuffix, mapPath+compactSuffix)
+	if err := compacted.AppendNeedle(NewNeedle(1, 1, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	closeVol(compacted)
+	vol = openVol(dataPath, mapPath)
+	if _, err := vol.GetNeedle(2, 2); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(dataPath + compactSuffix); !os.IsNotExist(err) {
+		t.Error("expect uncommitted compaction to be removed")
+	}
+	closeVol(vol)
+	// crashed after committing, the compacted files replace the old ones
+	compacted = openVol(dataPath+compactSuffix, mapPath+compactSuffix)
+	if err := compacted.AppendNeedle(NewNeedle(1, 1, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	closeVol(compacted)
+	if err := ioutil.WriteFile(dataPath+compactMarkerSuffix, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	vol = openVol(dataPath, mapPath)
+	defer closeVol(vol)
+	if _, err := vol.GetNeedle(1, 1); err != nil {
+		t.Error(err)
+	}
+	if _, err := vol.GetNeedle(2, 2); err == nil {
+		t.Error("expect committed compaction to be finished")
+	}
+	if _, err := os.Stat(dataPath + compactMarkerSuffix); !os.IsNotExist(err) {
+		t.Error("expect commit marker to be removed")
+	}
+}
+
+func TestVersion1Volume(t *testing.T) {
+	printTestInfo("TESTING VERSION 1 VOLUME")
+	defer helper.RemoveDirs("./testData/data_v1", "./test_mapping_v1")
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	n := NewNeedle(1, 1, f1DataI, []byte(pic1Name))
+	// a volume written before the super block
+	if err := ioutil.WriteFile("./testData/data_v1", n.marshal(Version1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewLevelDBMapping("./test_mapping_v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Put(1, 1, 0, n.fullSize(Version1)); err != nil {
+		t.Error(err)
+	}
+	m.db.Close()
+	file, _ := os.OpenFile("./testData/data_v1", os.O_RDWR, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_v1", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+	if vol.version != Version1 {
+		t.Errorf("expect version 1, get %d", vol.version)
+	}
+	// a version 1 volume has no flag to mark its needles encrypted
+	if err = vol.SetMasterKey(bytes.Repeat([]byte{7}, DataKeySize)); err != nil {
+		t.Error(err)
+	}
+	if !vol.Plaintext() {
+		t.Error("expect a version 1 volume to store its files in plain text")
+	}
+	if err = vol.AppendNeedle(NewNeedle(2, 2, f1DataI, []byte(pic2Name))); err != nil {
+		t.Error(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if n, err := vol.GetNeedle(uint64(i), uint32(i)); err != nil {
+			t.Error(err)
+		} else if bytes.Compare(n.Data, f1DataI) != 0 {
+			t.Error("data should be the same")
+		}
+	}
+}
+
+func TestSyncAlways(t *testing.T) {
+	printTestInfo("TESTING SYNC ALWAYS")
+	defer helper.RemoveDirs("./testData/data_sync", "./test_mapping_sync")
+	file, _ := os.OpenFile("./testData/data_sync", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_sync", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.SetSyncPolicy("sometimes"); err == nil {
+		t.Error("expect unknown sync policy to fail")
+	}
+	if err = vol.SetSyncPolicy(SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	errs := make(chan error)
+	for i := 1; i <= 20; i++ {
+		go func(i int) {
+			errs <- vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name)))
+		}(i)
+	}
+	for i := 1; i <= 20; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if err = vol.DelNeedle(1, 1); err != nil {
+		t.Error(err)
+	}
+	// every acknowledged write is synced
+	size, _ := vol.Size()
+	sizeBytes, err := vol.mapping.db.Get([]byte(KeySyncedSize), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced := BytesToUInt64(sizeBytes); int64(synced) != size {
+		t.Errorf("expect synced size %d, get %d", size, synced)
+	}
+	if vol.syncer.synced != vol.writeSeq {
+		t.Errorf("expect %d writes synced, get %d", vol.writeSeq, vol.syncer.synced)
+	}
+}
+
+func TestRecoverTail(t *testing.T) {
+	printTestInfo("TESTING RECOVER TAIL")
+	defer helper.RemoveDirs("./testData/data_recover", "./test_mapping_recover")
+	file, _ := os.OpenFile("./testData/data_recover", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_recover", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	for i := 1; i <= 2; i++ {
+		if err = vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = vol.Sync(); err != nil {
+		t.Error(err)
+	}
+	// needle 3 is written after the checkpoint
+	if err = vol.AppendNeedle(NewNeedle(3, 3, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	size, _ := vol.Size()
+	// needle 4 is indexed but torn, the bytes after it aren't indexed
+	torn := NewNeedle(4, 4, f1DataI, []byte(pic1Name))
+	if _, err = vol.StoreFile.WriteAt(torn.marshal(vol.version)[:100], size); err != nil {
+		t.Error(err)
+	}
+	if err = vol.mapping.Put(4, 4, size, torn.fullSize(vol.version)); err != nil {
+		t.Error(err)
+	}
+	// crash without syncing
+	vol.StoreFile.Close()
+	vol.mapping.db.Close()
+
+	file, _ = os.OpenFile("./testData/data_recover", os.O_RDWR, 0644)
+	if vol, err = NewVolume(0, file, "./test_mapping_recover", 0.4); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err = vol.GetNeedle(uint64(i), uint32(i)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err = vol.GetNeedle(4, 4); err == nil {
+		t.Error("expect torn needle to be removed")
+	}
+	if recovered, _ := vol.Size(); recovered != size {
+		t.Errorf("expect volume truncated to %d, get %d", size, recovered)
+	}
+	if count := vol.FileCount(); count != 3 {
+		t.Errorf("expect 3 files, get %d", count)
+	}
+	// appending goes on after the recovered needles
+	if err = vol.AppendNeedle(NewNeedle(5, 5, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	if _, err = vol.GetNeedle(5, 5); err != nil {
+		t.Error(err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIndexMigration(t *testing.T) {
+	printTestInfo("TESTING INDEX MIGRATION")
+	defer helper.RemoveDirs("./testData/data_migrate", "./test_mapping_migrate")
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	n := NewNeedle(1, 1, f1DataI, []byte(pic1Name))
+	data := append(newSuperBlock(CurrentVersion, 0), n.marshal(CurrentVersion)...)
+	if err := ioutil.WriteFile("./testData/data_migrate", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a version 1 index stores the offset in bytes
+	ldb, err := leveldb.OpenFile("./test_mapping_migrate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := make([]byte, 12), make([]byte, 8)
+	UInt64ToBytes(key[0:8], 1)
+	UInt32ToBytes(key[8:12], 1)
+	UInt32ToBytes(val[0:4], superBlockSize)
+	UInt32ToBytes(val[4:8], n.fullSize(CurrentVersion))
+	if err = ldb.Put(key, val, nil); err != nil {
+		t.Fatal(err)
+	}
+	ldb.Close()
+
+	file, _ := os.OpenFile("./testData/data_migrate", os.O_RDWR, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_migrate", 0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := vol.GetNeedle(1, 1); err != nil {
+		t.Error(err)
+	} else if bytes.Compare(got.Data, f1DataI) != 0 {
+		t.Error("data should be the same")
+	}
+	if err = vol.AppendNeedle(NewNeedle(2, 2, f1DataI, []byte(pic1Name))); err != nil {
+		t.Error(err)
+	}
+	// the migrated index isn't migrated again
+	vol.Close()
+	file, _ = os.OpenFile("./testData/data_migrate", os.O_RDWR, 0644)
+	if vol, err = NewVolume(0, file, "./test_mapping_migrate", 0.4); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err = vol.GetNeedle(uint64(i), uint32(i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// offsets beyond MaxVolumeSize can't be indexed
+	if err = vol.mapping.Put(3, 3, MaxVolumeSize, 8); err == nil {
+		t.Error("expect offset beyond MaxVolumeSize to fail")
+	}
+	vol.Close()
 }
 
 func TestNameTooLong(t *testing.T) {
@@ -259,25 +1302,27 @@ func TestNameTooLong(t *testing.T) {
 
 func BenchmarkWriteAndRead(b *testing.B) {
 	printTestInfo("BENCHMARKING")
-	vol, f1DataI := getVolAndData()
+	vol, f1DataI := getVolAndData("rw")
 	ops := 5000
 	ben := bench.Start("Append-Needles-5000")
 	for i := 0; i < ops; i++ {
 		vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name)))
 	}
 	ben.End(ops)
-	helper.RemoveDirs("./testData/data", "./test_mapping")
+	vol.Close()
+	helper.RemoveDirs("./testData/data_rw", "./test_mapping_rw")
 
-	vol, f1DataI = getVolAndData()
+	vol, f1DataI = getVolAndData("rw")
 	ops = 10000
 	ben = bench.Start("Append-Needles-10000")
 	for i := 0; i < ops; i++ {
 		vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name)))
 	}
 	ben.End(ops)
-	helper.RemoveDirs("./testData/data", "./test_mapping")
+	vol.Close()
+	helper.RemoveDirs("./testData/data_rw", "./test_mapping_rw")
 
-	vol, f1DataI = getVolAndData()
+	vol, f1DataI = getVolAndData("rw")
 	ops = 20000
 	ben = bench.Start("Append-Needles-20000")
 	for i := 0; i < ops; i++ {
@@ -305,12 +1350,72 @@ func BenchmarkWriteAndRead(b *testing.B) {
 		_, _ = vol.GetNeedle(uint64(i), uint32(i))
 	}
 	ben.End(ops)
-	helper.RemoveDirs("./testData/data", "./test_mapping")
+	vol.Close()
+	helper.RemoveDirs("./testData/data_rw", "./test_mapping_rw")
 }
 
-func getVolAndData() (*Volume, []byte) {
-	file, _ := os.OpenFile("./testData/data", os.O_RDWR|os.O_CREATE, 0644)
-	vol, _ := NewVolume(0, file, "./test_mapping", 0.4)
+// getVolAndData opens a volume of its own for each name,
+// so that no test sees the files of another one
+func getVolAndData(name string) (*Volume, []byte) {
+	file, _ := os.OpenFile("./testData/data_"+name, os.O_RDWR|os.O_CREATE, 0644)
+	vol, _ := NewVolume(0, file, "./test_mapping_"+name, 0.4)
 	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
 	return vol, f1DataI
 }
+
+func BenchmarkGetNeedle(b *testing.B) {
+	benchmarkGetNeedle(b, 0)
+}
+
+// reading doesn't wait for the appending writers
+func BenchmarkGetNeedleUnderWriteLoad(b *testing.B) {
+	benchmarkGetNeedle(b, 4)
+}
+
+func benchmarkGetNeedle(b *testing.B, writers int) {
+	defer helper.RemoveDirs("./testData/data_bench", "./test_mapping_bench")
+	file, _ := os.OpenFile("./testData/data_bench", os.O_RDWR|os.O_CREATE, 0644)
+	vol, err := NewVolume(0, file, "./test_mapping_bench", 0.4)
+	if err != nil {
+		b.Fatal(err)
+	}
+	f1DataI, _ := ioutil.ReadFile(path.Join(inputPath, pic1Name))
+	const stored = 1000
+	for i := 0; i < stored; i++ {
+		vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name)))
+	}
+	stop := make(chan bool)
+	done := make(chan bool)
+	appended := int64(0)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := stored + w; ; i += writers {
+				select {
+				case <-stop:
+					done <- true
+					return
+				default:
+				}
+				if vol.AppendNeedle(NewNeedle(uint32(i), uint64(i), f1DataI, []byte(pic1Name))) == nil {
+					atomic.AddInt64(&appended, 1)
+				}
+			}
+		}(w)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := rand.Intn(stored)
+		if _, err := vol.GetNeedle(uint64(key), uint32(key)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if writers > 0 {
+		b.ReportMetric(float64(atomic.LoadInt64(&appended))/b.Elapsed().Seconds(), "appends/s")
+	}
+	close(stop)
+	for w := 0; w < writers; w++ {
+		<-done
+	}
+	vol.Close()
+}
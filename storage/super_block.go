@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Volume versions. Version 1 volumes are the volumes created before
+// the super block, their needles have no flags. A version 2 volume starts
+// with a super block, and its needles have flags and optional fields.
+const (
+	Version1       byte = 1
+	Version2       byte = 2
+	CurrentVersion      = Version2
+)
+
+// superBlockSize keeps the first needle aligned to NeedlePaddingSize
+const superBlockSize = 8
+
+// The super block is the magic, the version, then the compaction generation
+// in the last 3 bytes. The generation counts the compactions of the volume,
+// wrapping around at generationMask, so that a replica copied byte for byte
+// can tell whether the bytes it copied are still the same.
+const generationMask = 1<<24 - 1
+
+var superBlockMagic = []byte("RBFS")
+
+func newSuperBlock(version byte, generation uint32) []byte {
+	b := make([]byte, superBlockSize)
+	copy(b, superBlockMagic)
+	b[len(superBlockMagic)] = version
+	generation &= generationMask
+	b[5], b[6], b[7] = byte(generation>>16), byte(generation>>8), byte(generation)
+	return b
+}
+
+// readSuperBlock reads the version and the compaction generation of a volume
+// file of the given size, an empty file has no version yet, and a version 1
+// file has no generation
+func readSuperBlock(r io.ReaderAt, size int64) (byte, uint32, error) {
+	if size == 0 {
+		return 0, 0, nil
+	}
+	if size < superBlockSize {
+		return Version1, 0, nil
+	}
+	b := make([]byte, superBlockSize)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(b[:len(superBlockMagic)], superBlockMagic) {
+		return Version1, 0, nil
+	}
+	version := b[len(superBlockMagic)]
+	if version < Version2 || version > CurrentVersion {
+		return 0, 0, fmt.Errorf("unknown volume version %d", version)
+	}
+	return version, uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7]), nil
+}
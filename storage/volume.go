@@ -1,186 +1,404 @@
 package storage
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.google.com/p/log4go"
 
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
-// TODO: when to change readOnly???
-
 const KeyDeletedSize = "key.deleted.size"
 
 // Volume is formed by multiple Needles
 type Volume struct {
+	fileCount        int64  // accessed atomically, keep it 64-bit aligned
+	end              int64  // where the next needle goes, accessed atomically
+	writeSeq         uint64 // counts the appends and deletes, accessed atomically
 	ID               uint32
 	StoreFile        *os.File
 	mapping          *Mapping
 	mappingName      string
-	fileLock         sync.RWMutex
+	fileLock         sync.RWMutex // held for reading while using StoreFile, held for writing to replace it
+	mapLock          sync.RWMutex // held for reading while using mapping, compaction swaps mapping with it held
+	writeLock        sync.Mutex   // serializes appending and deleting, and protects the settings below
 	garbageThreshold float32
+	autoCompact      bool
 	readOnly         bool
-	volTmp           *Volume
-	isCleaning       bool
-	isTmp            bool
+	maxSize          int64
+	version          byte   // 0 until the super block is written to an empty StoreFile
+	generation       uint32 // the compaction generation in the super block
+	compacting       bool
+	compactAppended  []needleKey // needles appended while compacting
+	compactDeleted   []needleKey // needles deleted while compacting
+	compactCancel    int32       // accessed atomically
+	compactLock      sync.Mutex  // protects compactStatus
+	compactStatus    CompactionStatus
+	syncPolicy       string
+	syncer           groupSync
+	dedup            bool
+	versions         int           // the versions kept of each file, 0 refuses overwriting
+	softDelete       time.Duration // how long the deleted files can be undeleted
+	retainUntil      int64         // unix time in seconds, the files can't be deleted before
+	legalHold        bool          // the files can't be deleted while set
+	keyLock          sync.RWMutex  // protects masterKey, dataKeys and currentKey
+	masterKey        []byte
+	dataKeys         map[uint32]cipher.AEAD
+	currentKey       uint32
 }
 
-// NewVolume returns a new *Volume and an error
+// NewVolume returns a new *Volume and an error. A compaction interrupted
+// by a crash is finished or rolled back before opening the volume, and
+// the needles written after the last checkpoint are checked against the mapping.
 func NewVolume(id uint32, storeFile *os.File, mapFilePath string, threshold float32) (*Volume, error) {
+	replaced, err := recoverCompaction(storeFile.Name(), mapFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if replaced {
+		// storeFile is the file before compacting, open the compacted one
+		name := storeFile.Name()
+		storeFile.Close()
+		if storeFile, err = os.OpenFile(name, os.O_RDWR, 0644); err != nil {
+			return nil, err
+		}
+	}
 	m, err := NewLevelDBMapping(mapFilePath) // TODO: this needs to be changed
 	if err != nil {
 		return nil, err
 	}
+	// append after the existing needles
+	size, err := storeFile.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, err
+	}
+	version, generation, err := readSuperBlock(storeFile, size)
+	if err != nil {
+		return nil, err
+	}
 	v := &Volume{
+		end:              size,
+		version:          version,
+		generation:       generation,
 		ID:               id,
 		StoreFile:        storeFile,
 		mappingName:      mapFilePath,
 		mapping:          m,
 		garbageThreshold: threshold,
+		autoCompact:      true,
 		readOnly:         false,
-		isCleaning:       false,
-		isTmp:            false,
+	}
+	if size, err = v.recoverTail(size); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		v.version = 0
+	}
+	if err = v.countFiles(); err != nil {
+		return nil, err
 	}
 	return v, nil
 }
 
+// Version returns the version vol writes needles in
+func (vol *Volume) Version() byte {
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	if vol.version == 0 {
+		return CurrentVersion
+	}
+	return vol.version
+}
+
 // AppendNeedle appends needle to vol's StoreFile
 func (vol *Volume) AppendNeedle(n *Needle) error {
+	seq, err := vol.appendNeedle(n, false)
+	if err != nil || seq == 0 {
+		return err
+	}
+	return vol.waitSync(seq)
+}
+
+// appendNeedle returns the write sequence to sync, or 0 if
+// the sync policy doesn't sync on every write. A needle is
+// deduplicated in dedup mode, or if share is set. With versioning,
+// a needle of an existing file becomes its latest version.
+func (vol *Volume) appendNeedle(n *Needle, share bool) (uint64, error) {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	oldOffset, oldSize, err := vol.mapping.Get(n.Key, n.Cookie)
+	overwrite := err == nil
+	if overwrite {
+		if err = vol.checkOverwrite(n, oldOffset, oldSize); err != nil {
+			return 0, err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return 0, errors.New("file exists")
+	}
 	if vol.readOnly {
-		return fmt.Errorf("volume %d is read-only", vol.ID)
+		return 0, fmt.Errorf("volume %d is read-only", vol.ID)
 	}
-	if _, _, err := vol.mapping.Get(n.Key, n.Cookie); err != leveldb.ErrNotFound && !vol.isTmp {
-		return errors.New("file exists")
+	if !overwrite {
+		// a file written again once deleted can't be undeleted
+		if _, err = getTombstone(vol.mapping.db, n.Key, n.Cookie); err == nil {
+			if vol.held() {
+				return 0, ErrHeld
+			}
+			err = vol.removeFile(n.Key, n.Cookie)
+		}
+		if err != nil && err != leveldb.ErrNotFound {
+			return 0, err
+		}
 	}
-	vol.fileLock.Lock()
-	defer vol.fileLock.Unlock()
-	// cleaning process is very time-consuming.
-	// so I think it's necessary to handle AppendNeedle
-	// during cleaning
-	if vol.volTmp != nil {
-		return vol.volTmp.AppendNeedle(n)
+	var hash []byte
+	if (vol.dedup || share) && dedupable(n) && !overwrite {
+		hash = contentHash(n)
 	}
-	offset, err := vol.StoreFile.Seek(0, os.SEEK_CUR)
+	// the hash is of the plain needle, so the encrypted ones dedup too
+	n, err = vol.encrypt(n)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if offset%NeedlePaddingSize != 0 {
-		offset += NeedlePaddingSize - (offset % NeedlePaddingSize)
-		if offset, err = vol.StoreFile.Seek(offset, os.SEEK_SET); err != nil {
-			return err
+	if hash != nil {
+		if ok, err := vol.appendShared(n, hash); err != nil || ok {
+			if err != nil {
+				return 0, err
+			}
+			return vol.nextWriteSeq(), nil
 		}
 	}
-	header := make([]byte, NeedleHeaderSize)
-	UInt32ToBytes(header[0:4], n.Cookie)
-	UInt64ToBytes(header[4:12], n.Key)
-	UInt32ToBytes(header[12:16], n.Size)
-	if _, err = vol.StoreFile.Write(header); err != nil {
-		return err
+	offset, end, err := vol.writeNeedle(n)
+	if err != nil {
+		return 0, err
 	}
-	if _, err = vol.StoreFile.Write(n.Data); err != nil {
-		return err
+	// Add this <key,cookie>-<offset,size> pair to mapping
+	if overwrite {
+		err = vol.putVersion(n, offset, oldOffset, oldSize)
+	} else if hash != nil {
+		err = vol.putIndexed(n, offset, hash)
+	} else {
+		err = vol.mapping.Put(n.Key, n.Cookie, offset, n.fullSize(vol.version))
 	}
-	csbytes := make([]byte, 4)
-	UInt32ToBytes(csbytes, n.CheckSum)
-	if _, err = vol.StoreFile.Write(csbytes); err != nil {
-		return err
+	if err != nil {
+		return 0, err
 	}
-
-	if _, err = vol.StoreFile.Write([]byte{n.NameSize}); err != nil {
-		return err
+	if vol.compacting {
+		vol.compactAppended = append(vol.compactAppended, needleKey{n.Key, n.Cookie})
+	}
+	if !overwrite {
+		atomic.AddInt64(&vol.fileCount, 1)
 	}
+	// the needle is complete and indexed before the end moves past it
+	atomic.StoreInt64(&vol.end, end)
+	return vol.nextWriteSeq(), nil
+}
 
-	if _, err = vol.StoreFile.Write(n.Name); err != nil {
-		return err
+// writeNeedle writes n after the needles of vol, and returns where n
+// starts and ends. The caller indexes n and then moves vol's end,
+// writeLock must be held.
+func (vol *Volume) writeNeedle(n *Needle) (int64, int64, error) {
+	offset := atomic.LoadInt64(&vol.end)
+	if vol.version == 0 {
+		if _, err := vol.StoreFile.WriteAt(newSuperBlock(CurrentVersion, vol.generation), 0); err != nil {
+			return 0, 0, err
+		}
+		vol.version = CurrentVersion
+		offset = superBlockSize
+		atomic.StoreInt64(&vol.end, offset)
+	}
+	if offset%NeedlePaddingSize != 0 {
+		offset += NeedlePaddingSize - (offset % NeedlePaddingSize)
+	}
+	if n.Flags != 0 && vol.version < Version2 {
+		return 0, 0, fmt.Errorf("volume %d of version %d can't store needle flags", vol.ID, vol.version)
+	}
+	b := n.marshal(vol.version)
+	if vol.maxSize > 0 && offset+int64(n.fullSize(vol.version)) > vol.maxSize {
+		return 0, 0, fmt.Errorf("volume %d is full", vol.ID)
+	}
+	// refuse the needle before its end overflows the index
+	if offset+int64(len(b)) > MaxVolumeSize {
+		return 0, 0, fmt.Errorf("volume %d is full", vol.ID)
+	}
+	if _, err := vol.StoreFile.WriteAt(b, offset); err != nil {
+		return 0, 0, err
 	}
+	return offset, offset + int64(len(b)), nil
+}
 
-	if _, err = vol.StoreFile.Write(n.Padding); err != nil {
-		return err
+// nextWriteSeq counts a write, writeLock must be held
+func (vol *Volume) nextWriteSeq() uint64 {
+	seq := atomic.AddUint64(&vol.writeSeq, 1)
+	if vol.syncPolicy != SyncAlways {
+		return 0
 	}
-	// Add this <key,cookie>-<offset,size> pair to mapping
-	return vol.mapping.Put(n.Key, n.Cookie, uint32(offset), n.fullSize())
+	return seq
+}
+
+// lockSettings locks the settings of vol, which are read by the writers
+func (vol *Volume) lockSettings() {
+	vol.fileLock.RLock()
+	vol.writeLock.Lock()
+}
+
+func (vol *Volume) unlockSettings() {
+	vol.writeLock.Unlock()
+	vol.fileLock.RUnlock()
+}
+
+// SetReadOnly makes vol refuse or accept appending needles
+func (vol *Volume) SetReadOnly(readOnly bool) {
+	vol.lockSettings()
+	vol.readOnly = readOnly
+	vol.unlockSettings()
 }
 
-// GetNeedle gets the needle from volume by given <key, cookie>
+// ReadOnly reports whether vol refuses appending needles
+func (vol *Volume) ReadOnly() bool {
+	vol.lockSettings()
+	defer vol.unlockSettings()
+	return vol.readOnly
+}
+
+// SetMaxSize limits the size of vol's StoreFile, 0 means no limit
+func (vol *Volume) SetMaxSize(maxSize int64) {
+	vol.lockSettings()
+	vol.maxSize = maxSize
+	vol.unlockSettings()
+}
+
+// GetNeedle gets the needle from volume by given <key, cookie>.
+// It doesn't wait for appending, the needles are read with ReadAt.
 func (vol *Volume) GetNeedle(key uint64, cookie uint32) (*Needle, error) {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.mapLock.RLock()
 	offset, fullsize, err := vol.mapping.Get(key, cookie)
+	vol.mapLock.RUnlock()
 	if err != nil {
 		return nil, err
 	}
-	vol.fileLock.RLock()
-	defer vol.fileLock.RUnlock()
+	return vol.readPlainNeedle(offset, fullsize)
+}
+
+// readNeedle reads the needle at offset, fileLock must be held
+func (vol *Volume) readNeedle(offset int64, fullsize uint32) (*Needle, error) {
 	needleBytes := make([]byte, fullsize)
-	readSize, err := vol.StoreFile.ReadAt(needleBytes, int64(offset))
+	readSize, err := vol.StoreFile.ReadAt(needleBytes, offset)
 	if err != nil {
 		return nil, err
 	}
 	if uint32(readSize) != fullsize {
 		return nil, fmt.Errorf("expected size %d, get size %d", fullsize, readSize)
 	}
-	ncookie := BytesToUInt32(needleBytes[0:4])
-	nkey := BytesToUInt64(needleBytes[4:12])
-	size := BytesToUInt32(needleBytes[12:NeedleHeaderSize])
-	data := needleBytes[NeedleHeaderSize : NeedleHeaderSize+size]
-	checkSum := BytesToUInt32(needleBytes[NeedleHeaderSize+size : NeedleHeaderSize+size+4])
-	nCheckSum := newCheckSum(data)
-	if checkSum != nCheckSum {
-		return nil, errors.New("data on disk corrupted")
-	}
-	nameSizeIndex := NeedleHeaderSize + size + 4 // 4 means skip checksum
-	nameSize := needleBytes[nameSizeIndex]
-	nameIndex := nameSizeIndex + 1
-	name := needleBytes[nameIndex : nameIndex+uint32(nameSize)]
-	return &Needle{
-		Cookie:   ncookie,
-		Key:      nkey,
-		Size:     size,
-		Data:     data,
-		CheckSum: checkSum,
-		NameSize: nameSize,
-		Name:     name,
-	}, nil
+	return unmarshalNeedle(needleBytes, vol.version)
 }
 
 // DelNeedle delete the <key,cookie>-<offset,size> pair in mapping
-// the Cleaner will reclaim the space occupied by deleted needle
+// the compaction will reclaim the space occupied by deleted needle
 func (vol *Volume) DelNeedle(key uint64, cookie uint32) error {
-	_, size, err := vol.mapping.Get(key, cookie)
+	seq, err := vol.delNeedle(key, cookie)
+	if err != nil || seq == 0 {
+		return err
+	}
+	return vol.waitSync(seq)
+}
+
+func (vol *Volume) delNeedle(key uint64, cookie uint32) (uint64, error) {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	offset, size, err := vol.mapping.Get(key, cookie)
 	if size == 0 {
-		return nil
+		return 0, nil
 	}
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if vol.held() {
+		return 0, ErrHeld
+	}
+	if vol.softDelete > 0 {
+		err = vol.putTombstone(key, cookie, offset, size)
+	} else {
+		// the older versions go with the file
+		err = vol.removeFile(key, cookie)
 	}
-	vol.fileLock.Lock()
-	defer vol.fileLock.Unlock()
-	deletedSize, err := vol.increaseDeletedSize(uint64(size))
 	if err != nil {
+		return 0, err
+	}
+	if vol.compacting {
+		vol.compactDeleted = append(vol.compactDeleted, needleKey{key, cookie})
+	}
+	atomic.AddInt64(&vol.fileCount, -1)
+	return vol.nextWriteSeq(), nil
+}
+
+// release drops an index entry's reference to the needle at offset,
+// the needle is garbage once nothing points to it. writeLock and
+// mapLock must be held.
+func (vol *Volume) release(offset int64, size uint32) error {
+	refs, err := vol.unref(offset)
+	if err != nil || refs > 0 {
 		return err
 	}
-	fi, err := vol.StoreFile.Stat()
+	deletedSize, err := vol.increaseDeletedSize(uint64(size))
 	if err != nil {
 		return err
 	}
-	if !vol.isTmp {
-		if !vol.isCleaning {
-			if float32(deletedSize)/float32(fi.Size()) > vol.garbageThreshold {
-				vol.isCleaning = true
-				go func() {
-					if err := vol.cleanNeedles(); err != nil {
-						log4go.Error(err.Error())
-					}
-				}()
+	if !vol.compacting && vol.autoCompact && float32(deletedSize)/float32(atomic.LoadInt64(&vol.end)) > vol.garbageThreshold {
+		go func() {
+			if err := vol.Compact(); err != nil {
+				log4go.Error(err.Error())
 			}
-		} else if vol.volTmp != nil {
-			vol.volTmp.DelNeedle(key, cookie)
-		}
+		}()
 	}
+	return nil
+}
+
+// FileCount returns the number of needles in vol that are not deleted
+func (vol *Volume) FileCount() int64 {
+	return atomic.LoadInt64(&vol.fileCount)
+}
 
-	return vol.mapping.Del(key, cookie)
+// DeletedSize returns the size of the deleted needles
+// that are not reclaimed yet
+func (vol *Volume) DeletedSize() (uint64, error) {
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	sizeBytes, err := vol.mapping.db.Get([]byte(KeyDeletedSize), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return BytesToUInt64(sizeBytes), nil
+}
+
+func (vol *Volume) countFiles() error {
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	count := int64(0)
+	err := vol.mapping.Iter(func(key uint64, cookie uint32) error {
+		count++
+		return nil
+	})
+	atomic.StoreInt64(&vol.fileCount, count)
+	return err
 }
 
 func (vol *Volume) increaseDeletedSize(size uint64) (deletedSize uint64, err error) {
@@ -205,94 +423,18 @@ func (vol *Volume) increaseDeletedSize(size uint64) (deletedSize uint64, err err
 	return
 }
 
-func (vol *Volume) resetDeletedSize() error {
-	deletedSizeByte := make([]byte, 8)
-	deletedSize := uint64(0)
-	UInt64ToBytes(deletedSizeByte, deletedSize)
-	return vol.mapping.db.Put([]byte(KeyDeletedSize), deletedSizeByte, nil)
-}
-
-func (vol *Volume) cleanNeedles() error {
-	log4go.Info("volume%d is cleaning", vol.ID)
-	if err := vol.resetDeletedSize(); err != nil {
-		return err
-	}
-	tmpStoreFileName := vol.StoreFile.Name() + ".tmp"
-	tmpStoreFile, err := os.OpenFile(tmpStoreFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
-	}
-	if err != nil {
-		return err
-	}
-	tmpMappingName := vol.mappingName + "_tmp"
-	mappingTmp, err := NewLevelDBMapping(tmpMappingName)
-	if err != nil {
-		return err
-	}
-	vol.volTmp = &Volume{
-		StoreFile: tmpStoreFile,
-		mapping:   mappingTmp,
-		isTmp:     true,
-	}
-	// vol.isCleaning = true
-	// iterate the mapping, get the undeleted needles,
-	// and append them to the volTmp
-	err = vol.mapping.Iter(func(key uint64, cookie uint32) error {
-		n, err := vol.GetNeedle(key, cookie)
-		if err != nil {
-			if err == leveldb.ErrNotFound {
-				return nil
-			}
-			return err
-		}
-		return vol.volTmp.AppendNeedle(n)
-	})
-	if err != nil {
-		return err
-	}
-	oldFileInfo, err := vol.StoreFile.Stat() // save old StoreFile Info
-	if err != nil {
-		return err
-	}
-
+// Destroy closes vol and removes its StoreFile and mapping from disk
+func (vol *Volume) Destroy() error {
 	vol.fileLock.Lock()
-	defer func() {
-		vol.isCleaning = false
-		vol.volTmp = nil
-		vol.fileLock.Unlock()
-		vol.readOnly = false
-	}()
-	// Switch StoreFile
-	vol.StoreFile.Close()
-	if err = os.RemoveAll(vol.StoreFile.Name()); err != nil { // remove the old StoreFIle
-		return err
-	}
-	if err = tmpStoreFile.Sync(); err != nil {
-		return err
-	}
-	if err = tmpStoreFile.Close(); err != nil { // save the new StoreFile to disk
-		return err
-	}
-	// remove the ".tmp" in tmpStoreFile
-	if err = os.Rename(tmpStoreFileName, tmpStoreFileName[:len(tmpStoreFileName)-4]); err != nil {
-		return err
-	}
-	vol.StoreFile, err = os.OpenFile(tmpStoreFileName[:len(tmpStoreFileName)-4], os.O_RDWR, oldFileInfo.Mode())
-	if err != nil {
-		return err
+	defer vol.fileLock.Unlock()
+	if vol.compacting {
+		return fmt.Errorf("volume %d is compacting", vol.ID)
 	}
-	// switch the mapping
+	vol.readOnly = true
+	vol.StoreFile.Close()
 	vol.mapping.db.Close()
-	if err = os.RemoveAll(vol.mappingName); err != nil {
+	if err := os.RemoveAll(vol.StoreFile.Name()); err != nil {
 		return err
 	}
-	mappingTmp.db.Close()
-	if err = os.Rename(tmpMappingName, vol.mappingName); err != nil {
-		return err
-	}
-	if vol.mapping, err = NewLevelDBMapping(vol.mappingName); err != nil {
-		return err
-	}
-	return nil
+	return os.RemoveAll(vol.mappingName)
 }
@@ -0,0 +1,423 @@
+package storage
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// A compaction writes the new volume into the files with compactSuffix.
+// Once they are complete and synced, the commit marker is created, and the
+// new files are renamed over the old ones. On restart, a volume with the
+// marker is rolled forward, otherwise the leftover new files are removed.
+const (
+	compactSuffix       = ".cpt"
+	compactMarkerSuffix = ".cpt.commit"
+)
+
+// ErrCompactionCanceled is returned by Compact when canceled by CancelCompaction
+var ErrCompactionCanceled = errors.New("compaction canceled")
+
+// CompactionStatus is the progress of the running or last compaction
+type CompactionStatus struct {
+	Running    bool      `json:"running"`
+	Progress   float64   `json:"progress"`            // from 0 to 1
+	Reclaimed  int64     `json:"reclaimed,omitempty"` // bytes
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type needleKey struct {
+	key    uint64
+	cookie uint32
+}
+
+// SetAutoCompact makes vol compact itself, or not, as soon as
+// its deleted needles take more than its garbage threshold
+func (vol *Volume) SetAutoCompact(autoCompact bool) {
+	vol.lockSettings()
+	vol.autoCompact = autoCompact
+	vol.unlockSettings()
+}
+
+// GarbageRatio returns the share of vol's StoreFile taken by the deleted needles
+func (vol *Volume) GarbageRatio() (float32, error) {
+	size, err := vol.Size()
+	if err != nil || size == 0 {
+		return 0, err
+	}
+	deletedSize, err := vol.DeletedSize()
+	if err != nil {
+		return 0, err
+	}
+	return float32(deletedSize) / float32(size), nil
+}
+
+// CompactionStatus returns the progress of the running or last compaction
+func (vol *Volume) CompactionStatus() CompactionStatus {
+	vol.compactLock.Lock()
+	defer vol.compactLock.Unlock()
+	return vol.compactStatus
+}
+
+// CancelCompaction stops the running compaction, vol stays as it was
+func (vol *Volume) CancelCompaction() error {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	if !vol.compacting {
+		return fmt.Errorf("volume %d is not compacting", vol.ID)
+	}
+	atomic.StoreInt32(&vol.compactCancel, 1)
+	return nil
+}
+
+// Compact rewrites vol without the deleted and expired needles, in the
+// current version. Needles can be appended and deleted while compacting,
+// they are caught up at the end while appending is blocked.
+// Compact returns when the compaction is done, failed or canceled.
+func (vol *Volume) Compact() error {
+	done, err := vol.StartCompaction()
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// StartCompaction starts compacting vol in background like Compact,
+// the result of the compaction is sent to the returned channel
+func (vol *Volume) StartCompaction() (<-chan error, error) {
+	vol.fileLock.Lock()
+	defer vol.fileLock.Unlock()
+	if vol.compacting {
+		return nil, fmt.Errorf("volume %d is compacting", vol.ID)
+	}
+	// compaction drops the expired files and the versions beyond the limit
+	vol.writeLock.Lock()
+	held := vol.held()
+	vol.writeLock.Unlock()
+	if held {
+		return nil, ErrHeld
+	}
+	oldSize := atomic.LoadInt64(&vol.end)
+	generation := (vol.generation + 1) & generationMask
+	// the needles in the snapshot are copied without blocking,
+	// the ones appended later are caught up
+	vol.mapLock.RLock()
+	snapshot, err := vol.mapping.db.GetSnapshot()
+	vol.mapLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	vol.compacting = true
+	vol.compactAppended = nil
+	vol.compactDeleted = nil
+	atomic.StoreInt32(&vol.compactCancel, 0)
+	vol.setCompactStatus(CompactionStatus{Running: true, StartedAt: time.Now()})
+	log4go.Info("volume %d is compacting", vol.ID)
+
+	done := make(chan error, 1)
+	go func() {
+		err := vol.compact(snapshot, oldSize, generation)
+		vol.fileLock.Lock()
+		vol.compacting = false
+		vol.compactAppended = nil
+		vol.compactDeleted = nil
+		newSize := atomic.LoadInt64(&vol.end)
+		vol.fileLock.Unlock()
+
+		status := vol.CompactionStatus()
+		status.Running = false
+		status.FinishedAt = time.Now()
+		if err != nil {
+			status.Error = err.Error()
+		} else {
+			status.Progress = 1
+			status.Reclaimed = oldSize - newSize
+			log4go.Info("volume %d is compacted, %d bytes reclaimed", vol.ID, status.Reclaimed)
+		}
+		vol.setCompactStatus(status)
+		done <- err
+	}()
+	return done, nil
+}
+
+func (vol *Volume) setCompactStatus(status CompactionStatus) {
+	vol.compactLock.Lock()
+	vol.compactStatus = status
+	vol.compactLock.Unlock()
+}
+
+func (vol *Volume) compact(snapshot *leveldb.Snapshot, oldSize int64, generation uint32) (err error) {
+	defer snapshot.Release()
+	dataPath := vol.StoreFile.Name() + compactSuffix
+	mapPath := vol.mappingName + compactSuffix
+	// the files left by an interrupted compaction are stale
+	if err = removeCompactFiles(dataPath, mapPath); err != nil {
+		return err
+	}
+	dataFile, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	m, err := NewLevelDBMapping(mapPath)
+	if err != nil {
+		dataFile.Close()
+		return err
+	}
+	newVol := &Volume{ID: vol.ID, StoreFile: dataFile, mapping: m, mappingName: mapPath}
+	committed := false
+	defer func() {
+		if !committed {
+			dataFile.Close()
+			m.db.Close()
+			removeCompactFiles(dataPath, mapPath)
+		}
+	}()
+	// the super block is written even if no needle is left,
+	// so that the generation tells the replicas vol was compacted
+	if _, err = dataFile.WriteAt(newSuperBlock(CurrentVersion, generation), 0); err != nil {
+		return err
+	}
+	newVol.version, newVol.generation, newVol.end = CurrentVersion, generation, superBlockSize
+	// the needles are encrypted again under a new data key
+	vol.keyLock.RLock()
+	masterKey := vol.masterKey
+	vol.keyLock.RUnlock()
+	if err = newVol.SetMasterKey(masterKey); err != nil {
+		return err
+	}
+	vol.lockSettings()
+	keep, window := vol.versions, vol.softDelete
+	vol.unlockSettings()
+
+	copied := int64(0)
+	iter := snapshot.NewIterator(nil, nil)
+	for iter.Next() {
+		if len(iter.Key()) != 12 {
+			continue
+		}
+		if atomic.LoadInt32(&vol.compactCancel) != 0 {
+			iter.Release()
+			return ErrCompactionCanceled
+		}
+		offset, size := decodeEntry(iter.Value())
+		key, cookie := BytesToUInt64(iter.Key()[0:8]), BytesToUInt32(iter.Key()[8:12])
+		if err = vol.copyNeedleTo(newVol, snapshot, key, cookie, offset, size, keep); err != nil {
+			iter.Release()
+			return err
+		}
+		copied += int64(size)
+		vol.compactLock.Lock()
+		vol.compactStatus.Progress = float64(copied) / float64(oldSize)
+		vol.compactLock.Unlock()
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	// the files deleted within the window stay deleted, the others are dropped
+	err = iterTombstones(snapshot, func(key uint64, cookie uint32, t tombstone) error {
+		if atomic.LoadInt32(&vol.compactCancel) != 0 {
+			return ErrCompactionCanceled
+		}
+		return vol.copyTombstoneTo(newVol, snapshot, key, cookie, t, keep, window)
+	})
+	if err != nil {
+		return err
+	}
+
+	// catch up and switch to the new files while appending is blocked
+	vol.fileLock.Lock()
+	defer vol.fileLock.Unlock()
+	if atomic.LoadInt32(&vol.compactCancel) != 0 {
+		return ErrCompactionCanceled
+	}
+	// a file written, deleted or undeleted meanwhile is copied again as it is now
+	caught := map[needleKey]bool{}
+	changed := append(append([]needleKey{}, vol.compactDeleted...), vol.compactAppended...)
+	for _, k := range changed {
+		if caught[k] {
+			continue
+		}
+		caught[k] = true
+		if err = newVol.purgeFile(k.key, k.cookie); err != nil {
+			return err
+		}
+		if offset, size, err := vol.mapping.Get(k.key, k.cookie); err == nil {
+			err = vol.copyNeedleToLocked(newVol, vol.mapping.db, k.key, k.cookie, offset, size, keep)
+			if err != nil {
+				return err
+			}
+		} else if t, err := getTombstone(vol.mapping.db, k.key, k.cookie); err == nil {
+			err = vol.copyTombstoneToLocked(newVol, vol.mapping.db, k.key, k.cookie, t, keep, window)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// syncs dataFile and checkpoints the new mapping
+	if err = newVol.Sync(); err != nil {
+		return err
+	}
+	m.db.Close()
+	committed = true
+	return vol.commitCompaction(dataFile, newVol.version, newVol.generation)
+}
+
+// copyNeedleTo maps <key,cookie> in newVol to a copy of the needle at
+// offset, unless it expired, along with the newest older versions of
+// the file up to keep versions. The needles shared in db, the mapping
+// or its snapshot, stay shared in newVol.
+func (vol *Volume) copyNeedleTo(newVol *Volume, db leveldb.Reader, key uint64, cookie uint32, offset int64, size uint32, keep int) error {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	return vol.copyNeedleToLocked(newVol, db, key, cookie, offset, size, keep)
+}
+
+func (vol *Volume) copyNeedleToLocked(newVol *Volume, db leveldb.Reader, key uint64, cookie uint32, offset int64, size uint32, keep int) error {
+	n, err := vol.readPlainNeedle(offset, size)
+	if err != nil {
+		return err
+	}
+	if n.Expired() {
+		return nil
+	}
+	if err = vol.copyVersionsTo(newVol, db, key, cookie, keep); err != nil {
+		return err
+	}
+	share, err := shared(db, offset)
+	if err != nil {
+		return err
+	}
+	// a shared needle was written under the key of one of its entries
+	n.Key, n.Cookie = key, cookie
+	_, err = newVol.appendNeedle(n, share)
+	return err
+}
+
+// commitCompaction switches vol to the compacted files, fileLock must be held
+func (vol *Volume) commitCompaction(dataFile *os.File, version byte, generation uint32) error {
+	vol.mapLock.Lock()
+	defer vol.mapLock.Unlock()
+	dataPath := vol.StoreFile.Name()
+	markerPath := dataPath + compactMarkerSuffix
+	marker, err := os.Create(markerPath)
+	if err == nil {
+		err = marker.Sync()
+		marker.Close()
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(markerPath))
+	}
+	if err != nil {
+		dataFile.Close()
+		removeCompactFiles(dataFile.Name(), vol.mappingName+compactSuffix)
+		os.Remove(markerPath)
+		return err
+	}
+	// from here on the compaction is committed, if anything goes wrong
+	// it gets finished when the volume is opened again
+	dataFile.Close()
+	vol.StoreFile.Close()
+	vol.mapping.db.Close()
+	vol.readOnly = true
+	if _, err = recoverCompaction(dataPath, vol.mappingName); err != nil {
+		return fmt.Errorf("volume %d must be reopened to finish compacting: %s", vol.ID, err.Error())
+	}
+	// vol keeps the closed files on error, so it fails instead of panicking
+	storeFile, err := os.OpenFile(dataPath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := storeFile.Stat()
+	if err != nil {
+		storeFile.Close()
+		return err
+	}
+	m, err := NewLevelDBMapping(vol.mappingName)
+	if err != nil {
+		storeFile.Close()
+		return err
+	}
+	vol.StoreFile = storeFile
+	atomic.StoreInt64(&vol.end, fi.Size())
+	vol.mapping = m
+	vol.version = version
+	vol.generation = generation
+	vol.keyLock.Lock()
+	vol.dataKeys = map[uint32]cipher.AEAD{}
+	if vol.masterKey != nil {
+		err = vol.loadDataKeys(vol.masterKey)
+	}
+	vol.keyLock.Unlock()
+	if err != nil {
+		return err
+	}
+	vol.readOnly = false
+	count := int64(0)
+	err = vol.mapping.Iter(func(key uint64, cookie uint32) error {
+		count++
+		return nil
+	})
+	atomic.StoreInt64(&vol.fileCount, count)
+	return err
+}
+
+// recoverCompaction finishes a committed compaction of the volume,
+// or removes the files of an uncommitted one. It reports whether
+// the data file got replaced.
+func recoverCompaction(dataPath string, mapPath string) (bool, error) {
+	markerPath := dataPath + compactMarkerSuffix
+	if _, err := os.Stat(markerPath); os.IsNotExist(err) {
+		return false, removeCompactFiles(dataPath+compactSuffix, mapPath+compactSuffix)
+	} else if err != nil {
+		return false, err
+	}
+	replaced := false
+	if _, err := os.Stat(dataPath + compactSuffix); err == nil {
+		if err = os.Rename(dataPath+compactSuffix, dataPath); err != nil {
+			return false, err
+		}
+		replaced = true
+	}
+	if _, err := os.Stat(mapPath + compactSuffix); err == nil {
+		if err = os.RemoveAll(mapPath); err != nil {
+			return replaced, err
+		}
+		if err = os.Rename(mapPath+compactSuffix, mapPath); err != nil {
+			return replaced, err
+		}
+	}
+	if err := syncDir(filepath.Dir(dataPath)); err != nil {
+		return replaced, err
+	}
+	return replaced, os.Remove(markerPath)
+}
+
+func removeCompactFiles(dataPath string, mapPath string) error {
+	if err := os.Remove(dataPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(mapPath)
+}
+
+// syncDir makes the renames in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// directories can't be synced on some platforms, e.g. windows
+	d.Sync()
+	return nil
+}
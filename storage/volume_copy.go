@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ErrCompacted is returned by WriteChangesTo when the volume
+// was compacted after the replica catching up copied it
+var ErrCompacted = errors.New("the volume was compacted since it was copied")
+
+// indexEntrySize = sizeof(Key)+sizeof(Cookie)+sizeof(offset)+sizeof(size)+sizeof(version)+sizeof(deletedAt),
+// the offset takes 8 bytes, the version is 0 for the latest version of a file,
+// and deletedAt, unix time in seconds, is 0 unless the file is deleted
+const indexEntrySize = 36
+
+// indexEntry is a pair written by WriteIndexTo
+type indexEntry struct {
+	key       uint64
+	cookie    uint32
+	version   uint32
+	deleted   bool
+	offset    int64
+	size      uint32
+	deletedAt int64
+}
+
+// Size returns the size of vol's StoreFile, up to the end of the last needle
+func (vol *Volume) Size() (int64, error) {
+	return atomic.LoadInt64(&vol.end), nil
+}
+
+// Generation returns the compaction generation of vol, it changes each time
+// vol is compacted, and a replica copied byte for byte has the same one
+func (vol *Volume) Generation() uint32 {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	return vol.generation
+}
+
+// WriteDataTo writes the bytes of vol's StoreFile from offset to the
+// current end into w. It doesn't block appending, the needles appended
+// while writing are simply not included.
+func (vol *Volume) WriteDataTo(w io.Writer, offset int64) (int64, error) {
+	return vol.writeDataTo(w, offset, nil)
+}
+
+// WriteChangesTo is WriteDataTo for a replica catching up, which copied the
+// bytes of vol before offset at the given compaction generation. If vol was
+// compacted since, those bytes are gone and ErrCompacted is returned, the
+// replica has to copy vol again.
+func (vol *Volume) WriteChangesTo(w io.Writer, offset int64, generation uint32) (int64, error) {
+	return vol.writeDataTo(w, offset, &generation)
+}
+
+func (vol *Volume) writeDataTo(w io.Writer, offset int64, generation *uint32) (int64, error) {
+	vol.fileLock.RLock()
+	if vol.compacting {
+		vol.fileLock.RUnlock()
+		return 0, fmt.Errorf("volume %d is compacting", vol.ID)
+	}
+	storeFile := vol.StoreFile
+	end := atomic.LoadInt64(&vol.end)
+	vol.writeLock.Lock()
+	current := vol.generation
+	vol.writeLock.Unlock()
+	vol.fileLock.RUnlock()
+	if generation != nil && (*generation != current || offset > end) {
+		return 0, ErrCompacted
+	}
+	if offset > end {
+		return 0, fmt.Errorf("offset %d is beyond the end of volume %d", offset, vol.ID)
+	}
+	return io.Copy(w, io.NewSectionReader(storeFile, offset, end-offset))
+}
+
+// WriteIndexTo writes every <key,cookie>-<offset,size> pair of vol's
+// mapping, the older versions and the deleted files included, into w,
+// each pair takes indexEntrySize bytes
+func (vol *Volume) WriteIndexTo(w io.Writer) error {
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	bw := bufio.NewWriter(w)
+	b := make([]byte, indexEntrySize)
+	write := func(e indexEntry) error {
+		UInt64ToBytes(b[0:8], e.key)
+		UInt32ToBytes(b[8:12], e.cookie)
+		UInt64ToBytes(b[12:20], uint64(e.offset))
+		UInt32ToBytes(b[20:24], e.size)
+		UInt32ToBytes(b[24:28], e.version)
+		UInt64ToBytes(b[28:36], uint64(e.deletedAt))
+		_, err := bw.Write(b)
+		return err
+	}
+	err := vol.mapping.IterEntries(func(key uint64, cookie uint32, offset int64, size uint32) error {
+		return write(indexEntry{key: key, cookie: cookie, offset: offset, size: size})
+	})
+	if err != nil {
+		return err
+	}
+	err = iterVersions(vol.mapping.db, func(key uint64, cookie uint32, v fileVersion) error {
+		return write(indexEntry{key: key, cookie: cookie, version: v.version, offset: v.offset, size: v.size})
+	})
+	if err != nil {
+		return err
+	}
+	err = iterTombstones(vol.mapping.db, func(key uint64, cookie uint32, t tombstone) error {
+		return write(indexEntry{key: key, cookie: cookie, offset: t.offset, size: t.size, deletedAt: t.deletedAt})
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// AppendData appends the raw bytes from r, which are read by WriteDataTo
+// from another replica, to the end of vol's StoreFile
+func (vol *Volume) AppendData(r io.Reader) (int64, error) {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	if vol.compacting {
+		return 0, fmt.Errorf("volume %d is compacting", vol.ID)
+	}
+	size := atomic.LoadInt64(&vol.end)
+	n, err := io.Copy(&offsetWriter{vol.StoreFile, size}, r)
+	atomic.StoreInt64(&vol.end, size+n)
+	if err == nil && size == 0 {
+		// the copied bytes bring the super block of the other replica
+		vol.version, vol.generation, err = readSuperBlock(vol.StoreFile, n)
+	}
+	return n, err
+}
+
+// ReadIndexFrom makes vol's mapping the same as the pairs written by
+// WriteIndexTo, the pairs pointing beyond the end of vol's StoreFile are skipped
+func (vol *Volume) ReadIndexFrom(r io.Reader) error {
+	size, err := vol.Size()
+	if err != nil {
+		return err
+	}
+	if err = vol.readIndexFrom(r, size); err != nil {
+		return err
+	}
+	if err = vol.recountRefs(); err != nil {
+		return err
+	}
+	if err = vol.countFiles(); err != nil {
+		return err
+	}
+	return vol.Sync()
+}
+
+func (vol *Volume) readIndexFrom(r io.Reader, size int64) error {
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	br := bufio.NewReader(r)
+	b := make([]byte, indexEntrySize)
+	// the pairs received, without their offsets and sizes
+	received := map[indexEntry]bool{}
+	var err error
+	for {
+		if _, err = io.ReadFull(br, b); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		e := indexEntry{
+			key:       BytesToUInt64(b[0:8]),
+			cookie:    BytesToUInt32(b[8:12]),
+			offset:    int64(BytesToUInt64(b[12:20])),
+			size:      BytesToUInt32(b[20:24]),
+			version:   BytesToUInt32(b[24:28]),
+			deletedAt: int64(BytesToUInt64(b[28:36])),
+		}
+		e.deleted = e.deletedAt != 0
+		if e.offset+int64(e.size) > size {
+			continue
+		}
+		if err = vol.putIndexEntry(e); err != nil {
+			return err
+		}
+		received[indexEntry{key: e.key, cookie: e.cookie, version: e.version, deleted: e.deleted}] = true
+	}
+	// remove the needles deleted on the other replica
+	deleted := []indexEntry{}
+	mark := func(e indexEntry) error {
+		if !received[e] {
+			deleted = append(deleted, e)
+		}
+		return nil
+	}
+	err = vol.mapping.IterEntries(func(key uint64, cookie uint32, offset int64, size uint32) error {
+		return mark(indexEntry{key: key, cookie: cookie})
+	})
+	if err != nil {
+		return err
+	}
+	err = iterVersions(vol.mapping.db, func(key uint64, cookie uint32, v fileVersion) error {
+		return mark(indexEntry{key: key, cookie: cookie, version: v.version})
+	})
+	if err != nil {
+		return err
+	}
+	err = iterTombstones(vol.mapping.db, func(key uint64, cookie uint32, t tombstone) error {
+		return mark(indexEntry{key: key, cookie: cookie, deleted: true})
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range deleted {
+		if err = vol.mapping.db.Delete(e.mappingKey(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mappingKey returns the key of the mapping record of e
+func (e indexEntry) mappingKey() []byte {
+	if e.deleted {
+		return tombstoneKey(e.key, e.cookie)
+	} else if e.version > 0 {
+		return versionKey(e.key, e.cookie, e.version)
+	}
+	return entryKey(e.key, e.cookie)
+}
+
+// putIndexEntry puts the pair e received into the mapping, mapLock must be held
+func (vol *Volume) putIndexEntry(e indexEntry) error {
+	var val []byte
+	var err error
+	if e.deleted {
+		val, err = encodeTombstone(tombstone{e.offset, e.size, e.deletedAt})
+	} else {
+		val, err = encodeEntry(e.offset, e.size)
+	}
+	if err != nil {
+		return err
+	}
+	return vol.mapping.db.Put(e.mappingKey(), val, nil)
+}
+
+// offsetWriter writes to w with WriteAt from offset on
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"code.google.com/p/log4go"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// A volume with a master key encrypts the data and the name of its
+// needles with AES-GCM under a data key of the volume. The data keys
+// are stored in the mapping, wrapped by the master key. An encrypted
+// needle has no name, its data is the id of the data key, the nonce,
+// then the sealed name size, name and data. Compaction re-encrypts
+// every needle under a new data key and drops the old ones.
+const (
+	keyDataPrefix  = "key.data."        // + data key id -> wrapped data key
+	KeyDataCurrent = "key.data.current" // the id of the data key encrypting new needles
+	DataKeySize    = 32                 // AES-256
+	keyIDSize      = 4
+)
+
+// ReadMasterKey reads the master key, hex encoded, from the file
+func ReadMasterKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(key) != DataKeySize {
+		return nil, fmt.Errorf("master key file %s must hold %d bytes in hex", path, DataKeySize)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func dataKeyKey(id uint32) []byte {
+	key := make([]byte, len(keyDataPrefix)+keyIDSize)
+	copy(key, keyDataPrefix)
+	UInt32ToBytes(key[len(keyDataPrefix):], id)
+	return key
+}
+
+// seal encrypts plain with a random nonce, the nonce goes first
+func seal(aead cipher.AEAD, plain []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+func unseal(aead cipher.AEAD, sealed []byte, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+}
+
+// SetMasterKey makes vol encrypt the needles appended from now on with
+// the master key, which also unwraps the data keys of the needles already
+// encrypted. A nil master key stops encrypting, the encrypted needles
+// can't be read then. Version 1 volumes can't be encrypted, their
+// needles are appended in plain text until they are compacted.
+func (vol *Volume) SetMasterKey(masterKey []byte) error {
+	vol.writeLock.Lock()
+	version := vol.version
+	vol.writeLock.Unlock()
+	if masterKey != nil && version == Version1 {
+		log4go.Warn("volume %d is of version 1, its files are stored unencrypted until it's compacted", vol.ID)
+	}
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	vol.keyLock.Lock()
+	defer vol.keyLock.Unlock()
+	vol.masterKey = nil
+	vol.dataKeys = map[uint32]cipher.AEAD{}
+	if masterKey == nil {
+		return nil
+	}
+	if err := vol.loadDataKeys(masterKey); err != nil {
+		return err
+	}
+	vol.masterKey = masterKey
+	if _, ok := vol.dataKeys[vol.currentKey]; ok {
+		return nil
+	}
+	return vol.rotateDataKey()
+}
+
+// loadDataKeys unwraps the data keys in the mapping, keyLock and mapLock must be held
+func (vol *Volume) loadDataKeys(masterKey []byte) error {
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return err
+	}
+	iter := vol.mapping.db.NewIterator(util.BytesPrefix([]byte(keyDataPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if len(iter.Key()) != len(keyDataPrefix)+keyIDSize {
+			continue // KeyDataCurrent
+		}
+		id := BytesToUInt32(iter.Key()[len(keyDataPrefix):])
+		key, err := unseal(master, iter.Value(), iter.Key())
+		if err != nil {
+			return fmt.Errorf("unwrap data key %d of volume %d: %s", id, vol.ID, err.Error())
+		}
+		if vol.dataKeys[id], err = newGCM(key); err != nil {
+			return err
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	val, err := vol.mapping.db.Get([]byte(KeyDataCurrent), nil)
+	if err == nil {
+		vol.currentKey = BytesToUInt32(val)
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// rotateDataKey makes a new data key the current one, keyLock and mapLock must be held
+func (vol *Volume) rotateDataKey() error {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	idBytes := make([]byte, keyIDSize)
+	var id uint32
+	// the ids are random, so the keys added from other replicas don't collide
+	for {
+		if _, err := rand.Read(idBytes); err != nil {
+			return err
+		}
+		if id = BytesToUInt32(idBytes); vol.dataKeys[id] == nil {
+			break
+		}
+	}
+	if err := vol.putDataKey(id, key); err != nil {
+		return err
+	}
+	if err := vol.mapping.db.Put([]byte(KeyDataCurrent), idBytes, nil); err != nil {
+		return err
+	}
+	vol.currentKey = id
+	return nil
+}
+
+// putDataKey stores the data key wrapped, keyLock and mapLock must be held
+func (vol *Volume) putDataKey(id uint32, key []byte) error {
+	master, err := newGCM(vol.masterKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	wrapped, err := seal(master, key, dataKeyKey(id))
+	if err != nil {
+		return err
+	}
+	if err = vol.mapping.db.Put(dataKeyKey(id), wrapped, nil); err != nil {
+		return err
+	}
+	vol.dataKeys[id] = aead
+	return nil
+}
+
+// WrappedDataKeys returns the data keys of vol as stored, wrapped by
+// the master key, for copying the volume to another store. The data
+// keys never leave the store unwrapped.
+func (vol *Volume) WrappedDataKeys() (map[uint32][]byte, error) {
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	vol.keyLock.RLock()
+	defer vol.keyLock.RUnlock()
+	keys := map[uint32][]byte{}
+	for id := range vol.dataKeys {
+		wrapped, err := vol.mapping.db.Get(dataKeyKey(id), nil)
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = wrapped
+	}
+	return keys, nil
+}
+
+// AddWrappedDataKeys adds the wrapped data keys of another replica, so vol
+// can read the needles it encrypted. They are unwrapped by vol's master
+// key, so the replicas must share the master key.
+func (vol *Volume) AddWrappedDataKeys(keys map[uint32][]byte) error {
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	vol.keyLock.Lock()
+	defer vol.keyLock.Unlock()
+	if len(keys) == 0 {
+		return nil
+	}
+	if vol.masterKey == nil {
+		return fmt.Errorf("volume %d is encrypted, a master key is needed", vol.ID)
+	}
+	master, err := newGCM(vol.masterKey)
+	if err != nil {
+		return err
+	}
+	for id, wrapped := range keys {
+		if vol.dataKeys[id] != nil {
+			continue
+		}
+		key, err := unseal(master, wrapped, dataKeyKey(id))
+		if err != nil {
+			return fmt.Errorf("unwrap data key %d of volume %d, the master keys differ: %s", id, vol.ID, err.Error())
+		}
+		if len(key) != DataKeySize {
+			return fmt.Errorf("data key %d should have %d bytes", id, DataKeySize)
+		}
+		if err = vol.putDataKey(id, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Plaintext reports whether vol has a master key but appends its needles
+// unencrypted, being a version 1 volume
+func (vol *Volume) Plaintext() bool {
+	vol.writeLock.Lock()
+	version := vol.version
+	vol.writeLock.Unlock()
+	vol.keyLock.RLock()
+	defer vol.keyLock.RUnlock()
+	return vol.masterKey != nil && version == Version1
+}
+
+// encrypt returns n encrypted under the current data key, or n itself
+// if vol has no master key or is Plaintext, writeLock and mapLock must be held
+func (vol *Volume) encrypt(n *Needle) (*Needle, error) {
+	vol.keyLock.RLock()
+	defer vol.keyLock.RUnlock()
+	// version 1 volumes have no flags to mark the needle encrypted
+	if vol.masterKey == nil || vol.version == Version1 {
+		return n, nil
+	}
+	plain := make([]byte, 1+len(n.Name)+len(n.Data))
+	plain[0] = n.NameSize
+	copy(plain[1:], n.Name)
+	copy(plain[1+len(n.Name):], n.Data)
+	sealed, err := seal(vol.dataKeys[vol.currentKey], plain, needleAD(n))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, keyIDSize+len(sealed))
+	UInt32ToBytes(data[0:keyIDSize], vol.currentKey)
+	copy(data[keyIDSize:], sealed)
+	enc := *n
+	enc.Flags |= FlagEncrypted
+	enc.Data = data
+	enc.Size = uint32(len(data))
+	enc.CheckSum = newCheckSum(data)
+	enc.NameSize = 0
+	enc.Name = []byte{}
+	return &enc, nil
+}
+
+// decrypt turns the encrypted needle n back into plain text in place
+func (vol *Volume) decrypt(n *Needle) error {
+	if n.Flags&FlagEncrypted == 0 {
+		return nil
+	}
+	if len(n.Data) < keyIDSize {
+		return errors.New("encrypted needle too short")
+	}
+	id := BytesToUInt32(n.Data[0:keyIDSize])
+	vol.keyLock.RLock()
+	aead := vol.dataKeys[id]
+	vol.keyLock.RUnlock()
+	if aead == nil {
+		return fmt.Errorf("no data key %d for needle %d,%d of volume %d", id, n.Key, n.Cookie, vol.ID)
+	}
+	plain, err := unseal(aead, n.Data[keyIDSize:], needleAD(n))
+	if err != nil {
+		return err
+	}
+	if len(plain) < 1 || len(plain) < 1+int(plain[0]) {
+		return errors.New("decrypted needle too short")
+	}
+	n.NameSize = plain[0]
+	n.Name = plain[1 : 1+int(plain[0])]
+	n.Data = plain[1+int(plain[0]):]
+	n.Size = uint32(len(n.Data))
+	n.CheckSum = newCheckSum(n.Data)
+	n.Flags &^= FlagEncrypted
+	return nil
+}
+
+// needleAD binds the sealed data to the needle it's written in
+func needleAD(n *Needle) []byte {
+	ad := make([]byte, 12)
+	UInt64ToBytes(ad[0:8], n.Key)
+	UInt32ToBytes(ad[8:12], n.Cookie)
+	return ad
+}
+
+// readPlainNeedle reads the needle at offset and decrypts it, fileLock must be held
+func (vol *Volume) readPlainNeedle(offset int64, fullsize uint32) (*Needle, error) {
+	n, err := vol.readNeedle(offset, fullsize)
+	if err != nil {
+		return nil, err
+	}
+	return n, vol.decrypt(n)
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// A volume in dedup mode indexes its needles by the hash of their
+// content. A needle appended with the content of an indexed one gets
+// its mapping entry pointed to the indexed needle instead of being
+// written again. The needles shared this way count their references,
+// and are garbage once the last entry pointing to them is deleted.
+const (
+	dedupHashPrefix = "dedup.hash." // + content hash -> offset
+	dedupRefPrefix  = "dedup.ref."  // + offset -> references + full size + content hash
+)
+
+// SetDedup makes vol store the needles of identical content once, or not.
+// The needles already shared stay shared.
+func (vol *Volume) SetDedup(dedup bool) {
+	vol.lockSettings()
+	vol.dedup = dedup
+	vol.unlockSettings()
+}
+
+// dedupable reports whether n can share its needle with others, the
+// needles expiring and the manifests, which own their chunks, can't
+func dedupable(n *Needle) bool {
+	return n.Flags&(FlagHasTTL|FlagManifest) == 0
+}
+
+// contentHash hashes what a needle holds besides its key and cookie
+func contentHash(n *Needle) []byte {
+	h := sha256.New()
+	h.Write([]byte{n.Flags, n.NameSize})
+	h.Write(n.Name)
+	h.Write(n.Data)
+	return h.Sum(nil)
+}
+
+func hashKey(hash []byte) []byte {
+	return append([]byte(dedupHashPrefix), hash...)
+}
+
+func refKey(offset int64) []byte {
+	key := make([]byte, len(dedupRefPrefix)+8)
+	copy(key, dedupRefPrefix)
+	UInt64ToBytes(key[len(dedupRefPrefix):], uint64(offset))
+	return key
+}
+
+// refValue keeps the full size of the shared needle as stored, it may be
+// stored encrypted or not unlike the needles mapped to it later
+func refValue(refs uint32, size uint32, hash []byte) []byte {
+	val := make([]byte, 8+len(hash))
+	UInt32ToBytes(val[0:4], refs)
+	UInt32ToBytes(val[4:8], size)
+	copy(val[8:], hash)
+	return val
+}
+
+func decodeRef(val []byte) (refs uint32, size uint32, hash []byte) {
+	return BytesToUInt32(val[0:4]), BytesToUInt32(val[4:8]), val[8:]
+}
+
+// findDuplicate returns the offset of the needle with the content hash,
+// or -1 if there's none, mapLock must be held
+func (vol *Volume) findDuplicate(hash []byte) (int64, error) {
+	val, err := vol.mapping.db.Get(hashKey(hash), nil)
+	if err == leveldb.ErrNotFound {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int64(BytesToUInt64(val)), nil
+}
+
+// putShared maps n to the needle at offset which has the same content,
+// writeLock and mapLock must be held
+func (vol *Volume) putShared(n *Needle, offset int64) error {
+	val, err := vol.mapping.db.Get(refKey(offset), nil)
+	if err != nil {
+		return err
+	}
+	refs, size, hash := decodeRef(val)
+	entry, err := encodeEntry(offset, size)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(entryKey(n.Key, n.Cookie), entry)
+	batch.Put(refKey(offset), refValue(refs+1, size, hash))
+	return vol.mapping.db.Write(batch, nil)
+}
+
+// putIndexed maps n to its needle just written at offset, and indexes
+// its content hash, writeLock and mapLock must be held
+func (vol *Volume) putIndexed(n *Needle, offset int64, hash []byte) error {
+	size := n.fullSize(vol.version)
+	entry, err := encodeEntry(offset, size)
+	if err != nil {
+		return err
+	}
+	val := make([]byte, 8)
+	UInt64ToBytes(val, uint64(offset))
+	batch := new(leveldb.Batch)
+	batch.Put(entryKey(n.Key, n.Cookie), entry)
+	batch.Put(hashKey(hash), val)
+	batch.Put(refKey(offset), refValue(1, size, hash))
+	return vol.mapping.db.Write(batch, nil)
+}
+
+// unref drops a reference to the needle at offset, and returns how many
+// index entries still point to it, 0 if it's not shared. writeLock and
+// mapLock must be held.
+func (vol *Volume) unref(offset int64) (uint32, error) {
+	val, err := vol.mapping.db.Get(refKey(offset), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	refs, size, hash := decodeRef(val)
+	refs--
+	batch := new(leveldb.Batch)
+	if refs == 0 {
+		batch.Delete(refKey(offset))
+		batch.Delete(hashKey(hash))
+	} else {
+		batch.Put(refKey(offset), refValue(refs, size, hash))
+	}
+	return refs, vol.mapping.db.Write(batch, nil)
+}
+
+// shared reports whether the needle at offset counts its references,
+// in the mapping or its snapshot
+func shared(db leveldb.Reader, offset int64) (bool, error) {
+	_, err := db.Get(refKey(offset), nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// dropRefs removes the references and the content hash of the needle
+// at offset, after the entries pointing to it are removed
+func (vol *Volume) dropRefs(offset int64) error {
+	val, err := vol.mapping.db.Get(refKey(offset), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, _, hash := decodeRef(val)
+	batch := new(leveldb.Batch)
+	batch.Delete(refKey(offset))
+	batch.Delete(hashKey(hash))
+	return vol.mapping.db.Write(batch, nil)
+}
+
+// recountRefs makes the references of the shared needles agree with
+// the mapping, which is copied from another replica without them
+func (vol *Volume) recountRefs() error {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	counts := map[int64]uint32{}
+	sizes := map[int64]uint32{}
+	err := vol.mapping.IterEntries(func(key uint64, cookie uint32, offset int64, size uint32) error {
+		counts[offset]++
+		sizes[offset] = size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the older versions and the deleted files hold references too
+	err = iterVersions(vol.mapping.db, func(key uint64, cookie uint32, v fileVersion) error {
+		counts[v.offset]++
+		sizes[v.offset] = v.size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = iterTombstones(vol.mapping.db, func(key uint64, cookie uint32, t tombstone) error {
+		counts[t.offset]++
+		sizes[t.offset] = t.size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	counted := map[int64]bool{}
+	iter := vol.mapping.db.NewIterator(util.BytesPrefix([]byte(dedupRefPrefix)), nil)
+	for iter.Next() {
+		offset := int64(BytesToUInt64(iter.Key()[len(dedupRefPrefix):]))
+		counted[offset] = true
+		if counts[offset] == 0 {
+			_, _, hash := decodeRef(iter.Value())
+			batch.Delete(append([]byte{}, iter.Key()...))
+			batch.Delete(hashKey(hash))
+		}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return err
+	}
+	for offset, count := range counts {
+		if count < 2 && !counted[offset] {
+			continue
+		}
+		n, err := vol.readPlainNeedle(offset, sizes[offset])
+		if err != nil {
+			return err
+		}
+		hash := contentHash(n)
+		val := make([]byte, 8)
+		UInt64ToBytes(val, uint64(offset))
+		batch.Put(hashKey(hash), val)
+		batch.Put(refKey(offset), refValue(count, sizes[offset], hash))
+	}
+	return vol.mapping.db.Write(batch, nil)
+}
+
+// appendShared maps n to an indexed needle of the same content if there's
+// one, it reports whether n is mapped, writeLock and mapLock must be held
+func (vol *Volume) appendShared(n *Needle, hash []byte) (bool, error) {
+	offset, err := vol.findDuplicate(hash)
+	if err != nil || offset < 0 {
+		return false, err
+	}
+	if err = vol.putShared(n, offset); err != nil {
+		return false, err
+	}
+	if vol.compacting {
+		vol.compactAppended = append(vol.compactAppended, needleKey{n.Key, n.Cookie})
+	}
+	atomic.AddInt64(&vol.fileCount, 1)
+	return true, nil
+}
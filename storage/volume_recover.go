@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"code.google.com/p/log4go"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// recoverTail makes the mapping and StoreFile agree after a crash.
+// KeySyncedSize is the checkpoint: StoreFile up to it and the mapping
+// entries of its needles reached the disk together. Beyond it, the
+// entries pointing to torn or missing needles are removed, and the
+// bytes after the last indexed needle, which no entry points to, are
+// truncated. It returns the size of StoreFile after recovering.
+func (vol *Volume) recoverTail(size int64) (int64, error) {
+	checkpoint := int64(0)
+	sizeBytes, err := vol.mapping.db.Get([]byte(KeySyncedSize), nil)
+	if err == nil {
+		checkpoint = int64(BytesToUInt64(sizeBytes))
+	} else if err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	end := checkpoint
+	if end > size {
+		end = size
+	}
+	// check reports whether the needle at offset is intact and of <key,cookie>
+	check := func(key uint64, cookie uint32, offset int64, fullsize uint32) (bool, error) {
+		if offset < checkpoint {
+			return true, nil
+		}
+		n, err := vol.readNeedle(offset, fullsize)
+		if err == nil && (n.Key != key || n.Cookie != cookie) {
+			// the entries sharing a needle point to the needle of another key
+			var share bool
+			if share, err = shared(vol.mapping.db, offset); err != nil {
+				return false, err
+			}
+			if !share {
+				err = errors.New("needle of another key")
+			}
+		}
+		if err != nil {
+			return false, nil
+		}
+		if e := offset + paddedSize(fullsize); e > end {
+			end = e
+		}
+		return true, nil
+	}
+	broken := []needleKey{}
+	brokenOffsets := []int64{}
+	err = vol.mapping.IterEntries(func(key uint64, cookie uint32, offset int64, fullsize uint32) error {
+		ok, err := check(key, cookie, offset, fullsize)
+		if err == nil && !ok {
+			broken = append(broken, needleKey{key, cookie})
+			brokenOffsets = append(brokenOffsets, offset)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	brokenVersions := [][]byte{}
+	err = iterVersions(vol.mapping.db, func(key uint64, cookie uint32, v fileVersion) error {
+		ok, err := check(key, cookie, v.offset, v.size)
+		if err == nil && !ok {
+			brokenVersions = append(brokenVersions, versionKey(key, cookie, v.version))
+			brokenOffsets = append(brokenOffsets, v.offset)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range brokenVersions {
+		if err = vol.mapping.db.Delete(k, nil); err != nil {
+			return 0, err
+		}
+	}
+	for _, k := range broken {
+		log4go.Warn("volume %d: remove the index of broken needle %d,%d", vol.ID, k.key, k.cookie)
+		if err = vol.mapping.Del(k.key, k.cookie); err != nil {
+			return 0, err
+		}
+		// the file goes back to its previous version
+		if _, err = vol.promoteVersion(k.key, k.cookie); err != nil {
+			return 0, err
+		}
+	}
+	for _, offset := range brokenOffsets {
+		if err = vol.dropRefs(offset); err != nil {
+			return 0, err
+		}
+	}
+	if end < size {
+		log4go.Warn("volume %d: truncate %d bytes not indexed", vol.ID, size-end)
+		if err = vol.StoreFile.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	if end == size && end == checkpoint && len(brokenOffsets) == 0 {
+		return end, nil
+	}
+	atomic.StoreInt64(&vol.end, end)
+	// move the checkpoint, so the recovered needles aren't checked again
+	_, err = vol.sync()
+	return end, err
+}
+
+// paddedSize returns the size a needle takes in StoreFile
+func paddedSize(fullsize uint32) int64 {
+	size := int64(fullsize)
+	if size%NeedlePaddingSize != 0 {
+		size += NeedlePaddingSize - size%NeedlePaddingSize
+	}
+	return size
+}
+
+// Close syncs vol to disk and closes its StoreFile and mapping,
+// vol can't be used afterwards
+func (vol *Volume) Close() error {
+	err := vol.Sync()
+	vol.fileLock.Lock()
+	defer vol.fileLock.Unlock()
+	vol.readOnly = true
+	vol.StoreFile.Close()
+	vol.mapping.db.Close()
+	return err
+}
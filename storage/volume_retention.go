@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// A volume under retention, until its retention date, or under legal
+// hold, until the hold is lifted, is write once: its files can't be
+// deleted or overwritten, and it can't be compacted.
+var ErrHeld = errors.New("the volume is under retention or legal hold")
+
+// SetRetention keeps the files of vol from being deleted or overwritten
+// until the retention date, or for as long as legalHold is set. The
+// retention date can only be pushed back, an earlier date is ignored.
+func (vol *Volume) SetRetention(retainUntil time.Time, legalHold bool) {
+	vol.lockSettings()
+	if !retainUntil.IsZero() && retainUntil.Unix() > vol.retainUntil {
+		vol.retainUntil = retainUntil.Unix()
+	}
+	vol.legalHold = legalHold
+	vol.unlockSettings()
+}
+
+// Retention returns the retention date of vol, the zero time if none,
+// and whether it's under legal hold
+func (vol *Volume) Retention() (time.Time, bool) {
+	vol.lockSettings()
+	defer vol.unlockSettings()
+	if vol.retainUntil == 0 {
+		return time.Time{}, vol.legalHold
+	}
+	return time.Unix(vol.retainUntil, 0), vol.legalHold
+}
+
+// Held reports whether vol is under retention or legal hold
+func (vol *Volume) Held() bool {
+	vol.lockSettings()
+	defer vol.unlockSettings()
+	return vol.held()
+}
+
+// held is Held with writeLock held
+func (vol *Volume) held() bool {
+	return vol.legalHold || time.Now().Unix() < vol.retainUntil
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// A volume in soft delete mode hides a deleted file behind a tombstone
+// instead of dropping its needle. The tombstone keeps the mapping entry
+// of the file and when it was deleted, so the file can be undeleted
+// within the window. Past the window, the tombstone is purged and the
+// needle becomes garbage, and compaction drops the tombstones left.
+const tombstonePrefix = "tomb." // + key + cookie -> offset and size + deletion time
+
+const tombstoneKeySize = len(tombstonePrefix) + 12
+
+type tombstone struct {
+	offset    int64
+	size      uint32
+	deletedAt int64 // unix time in seconds
+}
+
+// SetSoftDelete makes vol keep the deleted files for the window, so they
+// can be undeleted. 0 makes deletes permanent, and the deleted files kept
+// so far are purged.
+func (vol *Volume) SetSoftDelete(window time.Duration) {
+	vol.lockSettings()
+	vol.softDelete = window
+	vol.unlockSettings()
+}
+
+func tombstoneKey(key uint64, cookie uint32) []byte {
+	k := make([]byte, tombstoneKeySize)
+	copy(k, tombstonePrefix)
+	UInt64ToBytes(k[len(tombstonePrefix):], key)
+	UInt32ToBytes(k[len(tombstonePrefix)+8:], cookie)
+	return k
+}
+
+func encodeTombstone(t tombstone) ([]byte, error) {
+	entry, err := encodeEntry(t.offset, t.size)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, 16)
+	copy(val, entry)
+	UInt64ToBytes(val[8:16], uint64(t.deletedAt))
+	return val, nil
+}
+
+func decodeTombstone(val []byte) tombstone {
+	offset, size := decodeEntry(val)
+	return tombstone{offset, size, int64(BytesToUInt64(val[8:16]))}
+}
+
+// expired reports whether the file deleted is past the window
+func (t tombstone) expired(window time.Duration) bool {
+	return !time.Now().Before(time.Unix(t.deletedAt, 0).Add(window))
+}
+
+// getTombstone returns the tombstone of <key,cookie> in db, the mapping
+// or its snapshot, leveldb.ErrNotFound if the file isn't deleted
+func getTombstone(db leveldb.Reader, key uint64, cookie uint32) (tombstone, error) {
+	val, err := db.Get(tombstoneKey(key, cookie), nil)
+	if err != nil {
+		return tombstone{}, err
+	}
+	return decodeTombstone(val), nil
+}
+
+// iterTombstones calls fn with every tombstone in db
+func iterTombstones(db leveldb.Reader, fn func(key uint64, cookie uint32, t tombstone) error) error {
+	iter := db.NewIterator(util.BytesPrefix([]byte(tombstonePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := iter.Key()
+		if len(k) != tombstoneKeySize {
+			continue
+		}
+		err := fn(BytesToUInt64(k[len(tombstonePrefix):]), BytesToUInt32(k[len(tombstonePrefix)+8:]), decodeTombstone(iter.Value()))
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// putTombstone hides the file <key,cookie> whose needle is at offset
+// behind a tombstone, writeLock and mapLock must be held
+func (vol *Volume) putTombstone(key uint64, cookie uint32, offset int64, size uint32) error {
+	val, err := encodeTombstone(tombstone{offset, size, time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(entryKey(key, cookie))
+	batch.Put(tombstoneKey(key, cookie), val)
+	return vol.mapping.db.Write(batch, nil)
+}
+
+// removeFile drops the file <key,cookie> for good, deleted or not, with
+// its older versions, writeLock and mapLock must be held
+func (vol *Volume) removeFile(key uint64, cookie uint32) error {
+	needles, err := olderVersions(vol.mapping.db, key, cookie)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for _, v := range needles {
+		batch.Delete(versionKey(key, cookie, v.version))
+	}
+	if offset, size, err := vol.mapping.Get(key, cookie); err == nil {
+		batch.Delete(entryKey(key, cookie))
+		needles = append(needles, fileVersion{offset: offset, size: size})
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	if t, err := getTombstone(vol.mapping.db, key, cookie); err == nil {
+		batch.Delete(tombstoneKey(key, cookie))
+		needles = append(needles, fileVersion{offset: t.offset, size: t.size})
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	if len(needles) == 0 {
+		return nil
+	}
+	if err = vol.mapping.db.Write(batch, nil); err != nil {
+		return err
+	}
+	for _, v := range needles {
+		if err = vol.release(v.offset, v.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeFile is removeFile taking the locks, for the catch-up of compaction
+func (vol *Volume) purgeFile(key uint64, cookie uint32) error {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	return vol.removeFile(key, cookie)
+}
+
+// Undelete restores the file <key,cookie> deleted within the window,
+// with its older versions. Undeleting a file which isn't deleted does nothing.
+func (vol *Volume) Undelete(key uint64, cookie uint32) error {
+	seq, err := vol.undelete(key, cookie)
+	if err != nil || seq == 0 {
+		return err
+	}
+	return vol.waitSync(seq)
+}
+
+func (vol *Volume) undelete(key uint64, cookie uint32) (uint64, error) {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	t, err := getTombstone(vol.mapping.db, key, cookie)
+	if err == leveldb.ErrNotFound {
+		if _, _, err = vol.mapping.Get(key, cookie); err == nil {
+			return 0, nil
+		}
+		return 0, err
+	} else if err != nil {
+		return 0, err
+	}
+	if t.expired(vol.softDelete) {
+		return 0, errors.New("the file is deleted for good")
+	}
+	entry, err := encodeEntry(t.offset, t.size)
+	if err != nil {
+		return 0, err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(tombstoneKey(key, cookie))
+	batch.Put(entryKey(key, cookie), entry)
+	if err = vol.mapping.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	if vol.compacting {
+		vol.compactAppended = append(vol.compactAppended, needleKey{key, cookie})
+	}
+	atomic.AddInt64(&vol.fileCount, 1)
+	return vol.nextWriteSeq(), nil
+}
+
+// PurgeDeleted drops the files deleted before the window for good, their
+// needles become garbage. It returns the number of files purged, a held
+// volume purges none.
+func (vol *Volume) PurgeDeleted() (int, error) {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	if vol.held() {
+		return 0, nil
+	}
+	expired := []needleKey{}
+	err := iterTombstones(vol.mapping.db, func(key uint64, cookie uint32, t tombstone) error {
+		if t.expired(vol.softDelete) {
+			expired = append(expired, needleKey{key, cookie})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range expired {
+		if err = vol.removeFile(k.key, k.cookie); err != nil {
+			return 0, err
+		}
+		if vol.compacting {
+			vol.compactDeleted = append(vol.compactDeleted, k)
+		}
+	}
+	return len(expired), nil
+}
+
+// appendTombstone appends n as the needle of a deleted file, for copying
+// the deleted files while compacting
+func (vol *Volume) appendTombstone(n *Needle, deletedAt int64) error {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	n, err := vol.encrypt(n)
+	if err != nil {
+		return err
+	}
+	offset, end, err := vol.writeNeedle(n)
+	if err != nil {
+		return err
+	}
+	val, err := encodeTombstone(tombstone{offset, n.fullSize(vol.version), deletedAt})
+	if err != nil {
+		return err
+	}
+	if err = vol.mapping.db.Put(tombstoneKey(n.Key, n.Cookie), val, nil); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&vol.end, end)
+	return nil
+}
+
+// copyTombstoneTo copies the file <key,cookie> deleted within the window
+// to newVol, along with its older versions, like copyNeedleTo
+func (vol *Volume) copyTombstoneTo(newVol *Volume, db leveldb.Reader, key uint64, cookie uint32, t tombstone, keep int, window time.Duration) error {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	return vol.copyTombstoneToLocked(newVol, db, key, cookie, t, keep, window)
+}
+
+func (vol *Volume) copyTombstoneToLocked(newVol *Volume, db leveldb.Reader, key uint64, cookie uint32, t tombstone, keep int, window time.Duration) error {
+	if t.expired(window) {
+		return nil
+	}
+	n, err := vol.readPlainNeedle(t.offset, t.size)
+	if err != nil {
+		return err
+	}
+	if n.Expired() {
+		return nil
+	}
+	if err = vol.copyVersionsTo(newVol, db, key, cookie, keep); err != nil {
+		return err
+	}
+	n.Key, n.Cookie = key, cookie
+	return newVol.appendTombstone(n, t.deletedAt)
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Sync policies of a volume
+const (
+	SyncNone     = "none"     // leave flushing to the OS
+	SyncInterval = "interval" // the caller calls Sync periodically
+	SyncAlways   = "always"   // appending and deleting return once synced
+)
+
+// KeySyncedSize is the size of StoreFile when it was last synced
+const KeySyncedSize = "key.synced.size"
+
+// groupSync lets concurrent writers share one sync: the first writer
+// waiting syncs every write done so far, the others wait for it
+type groupSync struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	synced  uint64 // the last write sequence synced
+}
+
+// SetSyncPolicy sets when vol syncs its StoreFile and mapping to disk
+func (vol *Volume) SetSyncPolicy(policy string) error {
+	switch policy {
+	case SyncNone, SyncInterval, SyncAlways:
+	default:
+		return fmt.Errorf("unknown sync policy %s", policy)
+	}
+	vol.lockSettings()
+	vol.syncPolicy = policy
+	vol.unlockSettings()
+	return nil
+}
+
+// Sync flushes the needles appended and deleted so far to disk
+func (vol *Volume) Sync() error {
+	_, err := vol.sync()
+	return err
+}
+
+// waitSync returns once the write of sequence seq is synced
+func (vol *Volume) waitSync(seq uint64) error {
+	g := &vol.syncer
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.lock)
+	}
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.lock.Unlock()
+		synced, err := vol.sync()
+		g.lock.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if synced > g.synced {
+			g.synced = synced
+		}
+	}
+	return nil
+}
+
+// sync syncs StoreFile, then the mapping, so the mapping never points
+// to needles lost on power failure. It returns the write sequence synced.
+func (vol *Volume) sync() (uint64, error) {
+	vol.fileLock.RLock()
+	// the mapping and StoreFile are swapped by compaction with mapLock held
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	// the end is read after the sequence, so it covers the writes counted
+	seq := atomic.LoadUint64(&vol.writeSeq)
+	size := atomic.LoadInt64(&vol.end)
+	storeFile := vol.StoreFile
+	vol.fileLock.RUnlock()
+	if err := storeFile.Sync(); err != nil {
+		return 0, err
+	}
+	// a synced write syncs the leveldb journal with the writes before it
+	val := make([]byte, 8)
+	UInt64ToBytes(val, uint64(size))
+	if err := vol.mapping.db.Put([]byte(KeySyncedSize), val, &opt.WriteOptions{Sync: true}); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// A volume keeping versions lets a needle be appended for an existing
+// <key,cookie>. The mapping entry of the file points to the latest
+// version, the older ones are indexed under versionPrefix with their
+// version number, 1 being the oldest. The latest version is numbered
+// after the newest older one. Only the newest older versions are kept,
+// the ones beyond the limit are garbage.
+const versionPrefix = "ver." // + key + cookie + version -> offset and size of an older version
+
+const versionKeySize = len(versionPrefix) + 12 + 4
+
+type fileVersion struct {
+	version uint32
+	offset  int64
+	size    uint32
+}
+
+// SetVersions makes vol keep the given number of versions of each file,
+// the latest included. 0 refuses appending a needle for an existing file.
+// The versions beyond the limit are dropped by the next write of the
+// file, or by compaction.
+func (vol *Volume) SetVersions(versions int) {
+	vol.lockSettings()
+	vol.versions = versions
+	vol.unlockSettings()
+}
+
+func versionKey(key uint64, cookie uint32, version uint32) []byte {
+	k := make([]byte, versionKeySize)
+	copy(k, versionPrefix)
+	UInt64ToBytes(k[len(versionPrefix):], key)
+	UInt32ToBytes(k[len(versionPrefix)+8:], cookie)
+	UInt32ToBytes(k[len(versionPrefix)+12:], version)
+	return k
+}
+
+// olderVersions returns the older versions of <key,cookie> in db, the
+// mapping or its snapshot, from the oldest to the newest
+func olderVersions(db leveldb.Reader, key uint64, cookie uint32) ([]fileVersion, error) {
+	prefix := versionKey(key, cookie, 0)[:versionKeySize-4]
+	versions := []fileVersion{}
+	iter := db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		offset, size := decodeEntry(iter.Value())
+		versions = append(versions, fileVersion{BytesToUInt32(iter.Key()[versionKeySize-4:]), offset, size})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].version < versions[j].version })
+	return versions, nil
+}
+
+// iterVersions calls fn with every older version in db
+func iterVersions(db leveldb.Reader, fn func(key uint64, cookie uint32, v fileVersion) error) error {
+	iter := db.NewIterator(util.BytesPrefix([]byte(versionPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := iter.Key()
+		if len(k) != versionKeySize {
+			continue
+		}
+		offset, size := decodeEntry(iter.Value())
+		v := fileVersion{BytesToUInt32(k[versionKeySize-4:]), offset, size}
+		err := fn(BytesToUInt64(k[len(versionPrefix):]), BytesToUInt32(k[len(versionPrefix)+8:]), v)
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// latestVersion returns the number of the version after the older ones
+func latestVersion(versions []fileVersion) uint32 {
+	if len(versions) == 0 {
+		return 1
+	}
+	return versions[len(versions)-1].version + 1
+}
+
+// checkOverwrite tells whether n can become the latest version of its
+// file, whose needle is at offset, fileLock and writeLock must be held.
+// A held volume refuses overwriting.
+func (vol *Volume) checkOverwrite(n *Needle, offset int64, size uint32) error {
+	if vol.versions == 0 {
+		return errors.New("file exists")
+	}
+	if vol.held() {
+		return ErrHeld
+	}
+	// the chunks of a manifest are deleted with it, not versioned
+	if n.IsManifest() {
+		return errors.New("a large file can't be overwritten")
+	}
+	old, err := vol.readNeedle(offset, size)
+	if err != nil {
+		return err
+	}
+	if old.IsManifest() {
+		return errors.New("a large file can't be overwritten")
+	}
+	// the content of a content addressed file is fixed by its id
+	if old.IsContentAddressed() {
+		return errors.New("file exists")
+	}
+	return nil
+}
+
+// putVersion maps n to its needle just written at offset, and keeps the
+// needle it replaces as an older version, writeLock and mapLock must be held
+func (vol *Volume) putVersion(n *Needle, offset int64, oldOffset int64, oldSize uint32) error {
+	versions, err := olderVersions(vol.mapping.db, n.Key, n.Cookie)
+	if err != nil {
+		return err
+	}
+	entry, err := encodeEntry(offset, n.fullSize(vol.version))
+	if err != nil {
+		return err
+	}
+	oldEntry, err := encodeEntry(oldOffset, oldSize)
+	if err != nil {
+		return err
+	}
+	versions = append(versions, fileVersion{latestVersion(versions), oldOffset, oldSize})
+	batch := new(leveldb.Batch)
+	batch.Put(entryKey(n.Key, n.Cookie), entry)
+	batch.Put(versionKey(n.Key, n.Cookie, versions[len(versions)-1].version), oldEntry)
+	dropped := []fileVersion{}
+	for len(versions) > vol.versions-1 {
+		dropped = append(dropped, versions[0])
+		batch.Delete(versionKey(n.Key, n.Cookie, versions[0].version))
+		versions = versions[1:]
+	}
+	if err = vol.mapping.db.Write(batch, nil); err != nil {
+		return err
+	}
+	for _, v := range dropped {
+		if err = vol.release(v.offset, v.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendVersion appends n as an older version of its file, for copying
+// the versions while compacting. The file must have no latest version yet.
+func (vol *Volume) appendVersion(n *Needle, version uint32) error {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.writeLock.Lock()
+	defer vol.writeLock.Unlock()
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	n, err := vol.encrypt(n)
+	if err != nil {
+		return err
+	}
+	offset, end, err := vol.writeNeedle(n)
+	if err != nil {
+		return err
+	}
+	entry, err := encodeEntry(offset, n.fullSize(vol.version))
+	if err != nil {
+		return err
+	}
+	if err = vol.mapping.db.Put(versionKey(n.Key, n.Cookie, version), entry, nil); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&vol.end, end)
+	return nil
+}
+
+// Versions returns the version numbers of the file <key,cookie>, from
+// the oldest to the latest
+func (vol *Volume) Versions(key uint64, cookie uint32) ([]uint32, error) {
+	vol.mapLock.RLock()
+	defer vol.mapLock.RUnlock()
+	if _, _, err := vol.mapping.Get(key, cookie); err != nil {
+		return nil, err
+	}
+	versions, err := olderVersions(vol.mapping.db, key, cookie)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]uint32, 0, len(versions)+1)
+	for _, v := range versions {
+		numbers = append(numbers, v.version)
+	}
+	return append(numbers, latestVersion(versions)), nil
+}
+
+// GetNeedleVersion gets the needle of the given version of the file
+// <key,cookie>, leveldb.ErrNotFound if the version isn't kept
+func (vol *Volume) GetNeedleVersion(key uint64, cookie uint32, version uint32) (*Needle, error) {
+	vol.fileLock.RLock()
+	defer vol.fileLock.RUnlock()
+	vol.mapLock.RLock()
+	offset, size, err := vol.mapping.Get(key, cookie)
+	var versions []fileVersion
+	if err == nil {
+		versions, err = olderVersions(vol.mapping.db, key, cookie)
+	}
+	vol.mapLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if version != latestVersion(versions) {
+		found := false
+		for _, v := range versions {
+			if v.version == version {
+				offset, size, found = v.offset, v.size, true
+			}
+		}
+		if !found {
+			return nil, leveldb.ErrNotFound
+		}
+	}
+	return vol.readPlainNeedle(offset, size)
+}
+
+// promoteVersion makes the newest older version of <key,cookie> the
+// latest, after the needle of the latest one is lost. It reports
+// whether there was an older version.
+func (vol *Volume) promoteVersion(key uint64, cookie uint32) (bool, error) {
+	versions, err := olderVersions(vol.mapping.db, key, cookie)
+	if err != nil || len(versions) == 0 {
+		return false, err
+	}
+	v := versions[len(versions)-1]
+	entry, err := encodeEntry(v.offset, v.size)
+	if err != nil {
+		return false, err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(entryKey(key, cookie), entry)
+	batch.Delete(versionKey(key, cookie, v.version))
+	return true, vol.mapping.db.Write(batch, nil)
+}
+
+// copyVersionsTo copies the newest older versions of <key,cookie> in db
+// which vol keeps to newVol, the expired ones are dropped, fileLock must be held
+func (vol *Volume) copyVersionsTo(newVol *Volume, db leveldb.Reader, key uint64, cookie uint32, keep int) error {
+	versions, err := olderVersions(db, key, cookie)
+	if err != nil {
+		return err
+	}
+	if keep < 1 {
+		keep = 1
+	}
+	if len(versions) > keep-1 {
+		versions = versions[len(versions)-(keep-1):]
+	}
+	for _, v := range versions {
+		n, err := vol.readPlainNeedle(v.offset, v.size)
+		if err != nil {
+			return fmt.Errorf("version %d of needle %d,%d: %s", v.version, key, cookie, err.Error())
+		}
+		if n.Expired() {
+			continue
+		}
+		n.Key, n.Cookie = key, cookie
+		if err = newVol.appendVersion(n, v.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}